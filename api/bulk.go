@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// DefaultBulkConcurrency is how many requests the Bulk helpers have
+// in flight at once unless told otherwise.
+var DefaultBulkConcurrency = 10
+
+// BulkResult is how one item of a bulk operation turned out.
+type BulkResult struct {
+	Prefix string
+	Key    string
+	// Object is what the server sent back for the item, if the
+	// operation on it worked.
+	Object models.Model
+	Err    error
+}
+
+// BulkResults holds one BulkResult per item of a bulk operation, in
+// the same order as the items were passed in.
+type BulkResults []BulkResult
+
+// Failed returns the results that have an error.
+func (b BulkResults) Failed() BulkResults {
+	res := BulkResults{}
+	for _, r := range b {
+		if r.Err != nil {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// Err returns an *models.Error describing every item that failed, or
+// nil if they all worked.
+func (b BulkResults) Err() error {
+	res := &models.Error{Type: "BulkError"}
+	for _, r := range b.Failed() {
+		res.Errorf("%s %s: %v", r.Prefix, r.Key, r.Err)
+	}
+	return res.HasError()
+}
+
+// bulk runs op for each of count items, with at most concurrency of
+// them running at once.  Items that have not started when ctx is done
+// fail with ctx.Err().
+func bulk(ctx context.Context, count, concurrency int, op func(i int, r *BulkResult)) BulkResults {
+	if concurrency < 1 {
+		concurrency = DefaultBulkConcurrency
+	}
+	res := make(BulkResults, count)
+	sem := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	for i := range res {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			res[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			op(i, &res[i])
+		}(i)
+	}
+	wg.Wait()
+	return res
+}
+
+// BulkCreate creates every one of objs on the server, and keeps going
+// when some of them fail.  Each of objs is updated with what the
+// server sent back, just like CreateModel.
+func (c *Client) BulkCreate(objs []models.Model) BulkResults {
+	return c.BulkCreateCtx(context.Background(), DefaultBulkConcurrency, objs)
+}
+
+// BulkCreateCtx is BulkCreate using ctx, with at most concurrency
+// requests in flight at once.
+func (c *Client) BulkCreateCtx(ctx context.Context, concurrency int, objs []models.Model) BulkResults {
+	return bulk(ctx, len(objs), concurrency, func(i int, r *BulkResult) {
+		r.Prefix, r.Key = objs[i].Prefix(), objs[i].Key()
+		if r.Err = c.CreateModelCtx(ctx, objs[i]); r.Err == nil {
+			r.Object = objs[i]
+			r.Key = objs[i].Key()
+		}
+	})
+}
+
+// BulkPatch applies each of patches to the object of type prefix with
+// the matching key, and keeps going when some of them fail.  The
+// results are sorted by key.
+func (c *Client) BulkPatch(prefix string, patches map[string]jsonpatch2.Patch) BulkResults {
+	return c.BulkPatchCtx(context.Background(), DefaultBulkConcurrency, prefix, patches)
+}
+
+// BulkPatchCtx is BulkPatch using ctx, with at most concurrency
+// requests in flight at once.
+func (c *Client) BulkPatchCtx(ctx context.Context, concurrency int, prefix string, patches map[string]jsonpatch2.Patch) BulkResults {
+	keys := make([]string, 0, len(patches))
+	for k := range patches {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return bulk(ctx, len(keys), concurrency, func(i int, r *BulkResult) {
+		r.Prefix, r.Key = prefix, keys[i]
+		obj, err := c.PatchModelCtx(ctx, prefix, keys[i], patches[keys[i]])
+		if r.Err = err; err == nil {
+			r.Object = obj
+		}
+	})
+}
+
+// BulkDelete deletes every object of type prefix whose key is in
+// keys, and keeps going when some of them fail.
+func (c *Client) BulkDelete(prefix string, keys []string) BulkResults {
+	return c.BulkDeleteCtx(context.Background(), DefaultBulkConcurrency, prefix, keys)
+}
+
+// BulkDeleteCtx is BulkDelete using ctx, with at most concurrency
+// requests in flight at once.
+func (c *Client) BulkDeleteCtx(ctx context.Context, concurrency int, prefix string, keys []string) BulkResults {
+	return bulk(ctx, len(keys), concurrency, func(i int, r *BulkResult) {
+		r.Prefix, r.Key = prefix, keys[i]
+		obj, err := c.DeleteModelCtx(ctx, prefix, keys[i])
+		if r.Err = err; err == nil {
+			r.Object = obj
+		}
+	})
+}
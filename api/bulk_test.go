@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VictorLowther/jsonpatch2"
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestBulk(t *testing.T) {
+	mux := &sync.Mutex{}
+	inFlight, maxInFlight := 0, 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mux.Unlock()
+		defer func() {
+			mux.Lock()
+			inFlight--
+			mux.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		name := strings.TrimPrefix(r.URL.Path, "/api/v3/profiles")
+		name = strings.TrimPrefix(name, "/")
+		if r.Method == "POST" {
+			p := &models.Profile{}
+			json.NewDecoder(r.Body).Decode(p)
+			name = p.Name
+		}
+		if strings.HasPrefix(name, "bad") {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(&models.Error{Type: r.Method, Model: "profiles", Key: name, Code: http.StatusConflict, Messages: []string{"nope"}})
+			return
+		}
+		json.NewEncoder(w).Encode(&models.Profile{Name: name, Description: r.Method})
+	}))
+	defer srv.Close()
+	c, err := TokenSessionTLS(srv.URL, "token", &TLSOptions{Insecure: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer c.Close()
+
+	objs := []models.Model{}
+	for _, name := range []string{"p1", "bad1", "p2", "p3", "bad2", "p4"} {
+		objs = append(objs, &models.Profile{Name: name})
+	}
+	res := c.BulkCreateCtx(context.Background(), 2, objs)
+	if len(res) != len(objs) {
+		t.Fatalf("Expected %d results, got %d", len(objs), len(res))
+	}
+	for i, r := range res {
+		bad := strings.HasPrefix(r.Key, "bad")
+		if r.Key != objs[i].Key() || (r.Err != nil) != bad || (r.Object != nil) == bad {
+			t.Errorf("Unexpected result %d: %#v", i, r)
+		}
+	}
+	if objs[0].(*models.Profile).Description != "POST" {
+		t.Errorf("Created object was not updated from the server")
+	}
+	if failed := res.Failed(); len(failed) != 2 || failed[0].Key != "bad1" || failed[1].Key != "bad2" {
+		t.Errorf("Unexpected failures %v", failed)
+	}
+	if err := res.Err(); err == nil || !strings.Contains(err.Error(), "profiles bad2") {
+		t.Errorf("Unexpected combined error %v", err)
+	}
+	mux.Lock()
+	if maxInFlight != 2 {
+		t.Errorf("Expected 2 requests at once, saw %d", maxInFlight)
+	}
+	maxInFlight = 0
+	mux.Unlock()
+
+	patch := jsonpatch2.Patch{}
+	res = c.BulkPatch("profiles", map[string]jsonpatch2.Patch{"p2": patch, "bad3": patch, "p1": patch})
+	if len(res) != 3 || res[0].Key != "bad3" || res[0].Err == nil || res[1].Key != "p1" || res[2].Object.(*models.Profile).Description != "PATCH" {
+		t.Errorf("Unexpected patch results %v", res)
+	}
+	res = c.BulkDelete("profiles", []string{"p1", "bad4"})
+	if len(res) != 2 || res[0].Err != nil || res[1].Err == nil || res.Err() == nil {
+		t.Errorf("Unexpected delete results %v", res)
+	}
+	if err := c.BulkDelete("profiles", []string{"p1", "p2"}).Err(); err != nil {
+		t.Errorf("Expected deletes to work: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, r := range c.BulkDeleteCtx(ctx, 1, "profiles", []string{"p1", "p2", "p3"}) {
+		if r.Err == nil {
+			t.Errorf("Expected %s to fail with a cancelled context", r.Key)
+		}
+	}
+}
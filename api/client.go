@@ -52,11 +52,19 @@ type Client struct {
 	traceToken                   string
 	info                         *models.Info
 	iMux                         *sync.Mutex
+	retry                        RetryPolicy
+	tlsConfig                    *tls.Config
+	tlsOpts                      *TLSOptions
+	creds                        CredentialProvider
+	endpoints                    []string
+	foMux                        *sync.Mutex
+	streams                      map[*EventStream]struct{}
+	rt                           *endpointTransport
 }
 
 func (c *Client) realEndpoint() string {
 	if locallyProxied() == "" {
-		return c.endpoint
+		return c.Endpoint()
 	}
 	return "http://unix"
 }
@@ -64,6 +72,8 @@ func (c *Client) realEndpoint() string {
 // Endpoint returns the address of the dr-provision API endpoint that
 // we are talking to.
 func (c *Client) Endpoint() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	return c.endpoint
 }
 
@@ -85,6 +95,20 @@ func (c *Client) UrlFor(args ...string) (*url.URL, error) {
 	return c.UrlForProxy("", args...)
 }
 
+// SetRetryPolicy sets the RetryPolicy that requests made through the
+// Client will use unless they are given one of their own.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.retry = p
+}
+
+func (c *Client) retryPolicy() RetryPolicy {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.retry
+}
+
 // Trace sets the log level that incoming requests generated by a
 // Client will be logged at, overriding the levels they would normally
 // be logged at on the server side.  Setting lvl to an empty string
@@ -139,9 +163,10 @@ type R struct {
 	Resp                 *http.Response
 	err                  *models.Error
 	paranoid             bool
-	noRetry              bool
+	retry                RetryPolicy
 	traceLvl, traceToken string
 	proxy                string
+	ctx                  context.Context
 }
 
 // Req creates a new R for the current client.
@@ -154,6 +179,8 @@ func (c *Client) Req() *R {
 		traceLvl:   c.traceLvl,
 		traceToken: c.traceToken,
 		method:     "GET",
+		ctx:        context.Background(),
+		retry:      c.retry,
 		header:     http.Header{},
 		err: &models.Error{
 			Type: "CLIENT_ERROR",
@@ -167,6 +194,18 @@ func (r *R) Proxy(proxy string) *R {
 	return r
 }
 
+// Context arranges for the request to be made using ctx.  If ctx is
+// cancelled or its deadline passes, the request is abandoned, along
+// with any backoff retries that are in progress.
+func (r *R) Context(ctx context.Context) *R {
+	if ctx == nil {
+		r.err.Errorf("Cannot use a nil Context")
+		return r
+	}
+	r.ctx = ctx
+	return r
+}
+
 // Trace will arrange for the server to log this specific request at
 // the passed-in Level, overriding any client Trace requests or the
 // levels things would usually be logged at by the server.
@@ -463,11 +502,17 @@ func (r *R) Body(b interface{}) *R {
 	return r
 }
 
+// Retry sets the RetryPolicy this request will use in place of the
+// one from the Client.
+func (r *R) Retry(p RetryPolicy) *R {
+	r.retry = p
+	return r
+}
+
 // FailFast skips the usual fibbonaci backoff retry in the case of
-// transient errors.
+// transient errors.  It is the same as Retry(FailFastPolicy).
 func (r *R) FailFast() *R {
-	r.noRetry = true
-	return r
+	return r.Retry(FailFastPolicy)
 }
 
 // Response executes the request and returns a raw http.Response.
@@ -492,46 +537,53 @@ func (r *R) Response() (*http.Response, error) {
 		r.Headers("X-Log-Request", r.traceLvl)
 		r.Headers("X-Log-Token", r.traceToken)
 	}
-	timeouts := []time.Duration{
-		time.Second,
-		time.Second,
-		2 * time.Second,
-		3 * time.Second,
-		5 * time.Second,
-		8 * time.Second,
-	}
 	var resp *http.Response
 	var err error
-	for _, waitFor := range timeouts {
+	for attempt := 1; ; attempt++ {
 		var req *http.Request
 		req, err = http.NewRequest(r.method, r.uri.String(), r.body)
 		if err != nil {
 			r.err.AddError(err)
 			return nil, r.err
 		}
+		req = req.WithContext(r.ctx)
 		req.Header = r.header
 		r.Req = req
 		r.c.Authorize(req)
+		used := r.c.Endpoint()
 		resp, err = r.c.Do(req)
-		if err == nil || r.noRetry {
+		retry, waitFor := r.retry.retry(r.method, attempt, resp, err)
+		if !retry || r.ctx.Err() != nil {
 			break
 		}
-		if r.body == nil {
-			r.c.iMux.Lock()
-			r.c.info = nil
-			r.c.iMux.Unlock()
-			time.Sleep(waitFor)
-			continue
+		if err != nil && locallyProxied() == "" && r.c.failover(r.ctx, used) == nil && r.c.Endpoint() != used {
+			// We moved to another endpoint, so try again there
+			// right away.
+			if rerr := r.rebase(); rerr != nil {
+				break
+			}
+			waitFor = 0
 		}
-		seeker, ok := r.body.(io.ReadSeeker)
-		if r.body != nil && !ok {
+		if r.body == nil {
+			if err != nil {
+				r.c.iMux.Lock()
+				r.c.info = nil
+				r.c.iMux.Unlock()
+			}
+		} else if seeker, ok := r.body.(io.ReadSeeker); !ok {
 			// we cannot rewind the body, so don't even try.
 			break
+		} else if i, err := seeker.Seek(0, io.SeekStart); err != nil || i != 0 {
+			break
 		}
-		if i, err := seeker.Seek(0, io.SeekStart); err != nil || i != 0 {
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			resp = nil
+		}
+		if err = sleepCtx(r.ctx, waitFor); err != nil {
 			break
 		}
-		time.Sleep(waitFor)
 	}
 	if err != nil {
 		r.err.AddError(err)
@@ -542,13 +594,25 @@ func (r *R) Response() (*http.Response, error) {
 
 }
 
+// sleepCtx sleeps for d, or until ctx is done.  It returns ctx.Err()
+// if ctx finished first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Do attempts to execute the reqest built up by previous method calls
 // on R.  If any errors occurred while building up the request, they
 // will be returned and no API interaction will actually take place.
 // Otherwise, Do will generate an http.Request, perform it, and
-// marshal the results to val.  If any errors occur while processing
-// the request, fibonacci based backoff will be performed up to 6
-// times.
+// marshal the results to val.  If the request fails, it will be
+// retried as directed by the RetryPolicy of the R.
 //
 // If val is an io.Writer, the body of the response will be copied
 // verbatim into val using io.Copy
@@ -653,6 +717,8 @@ func (c *Client) Close() {
 // Token returns the current authentication token associated with the
 // Client.
 func (c *Client) Token() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	if c.token == nil {
 		return ""
 	}
@@ -703,8 +769,13 @@ func (c *Client) Authorize(req *http.Request) error {
 // ListBlobs lists the names of all the binary objects at 'at', using
 // the indexing parameters suppied by params.
 func (c *Client) ListBlobs(at string, params ...string) ([]string, error) {
+	return c.ListBlobsCtx(context.Background(), at, params...)
+}
+
+// ListBlobsCtx is ListBlobs using ctx.
+func (c *Client) ListBlobsCtx(ctx context.Context, at string, params ...string) ([]string, error) {
 	res := []string{}
-	return res, c.Req().UrlFor(path.Join("/", at)).Params(params...).Do(&res)
+	return res, c.Req().Context(ctx).UrlFor(path.Join("/", at)).Params(params...).Do(&res)
 }
 
 // GetBlob fetches a binary blob from the server, writing it to the
@@ -712,7 +783,12 @@ func (c *Client) ListBlobs(at string, params ...string) ([]string, error) {
 // with a Truncate method, GetBlob will only download the file
 // if it has changed on the server side.
 func (c *Client) GetBlob(dest io.Writer, at ...string) error {
-	req := c.Req().UrlFor(path.Join("/", path.Join(at...)))
+	return c.GetBlobCtx(context.Background(), dest, at...)
+}
+
+// GetBlobCtx is GetBlob using ctx.
+func (c *Client) GetBlobCtx(ctx context.Context, dest io.Writer, at ...string) error {
+	req := c.Req().Context(ctx).UrlFor(path.Join("/", path.Join(at...)))
 	shasum := ""
 	var startSz int64
 	if fi, ok := dest.(*os.File); ok {
@@ -773,8 +849,13 @@ func (c *Client) GetBlobSum(at ...string) (string, error) {
 // to the location specified by at on the server.  You are responsible
 // for closing the passed io.Reader.  Sends the explode boolean as a query parameter.
 func (c *Client) PostBlobExplode(blob io.Reader, explode bool, at ...string) (models.BlobInfo, error) {
+	return c.PostBlobExplodeCtx(context.Background(), blob, explode, at...)
+}
+
+// PostBlobExplodeCtx is PostBlobExplode using ctx.
+func (c *Client) PostBlobExplodeCtx(ctx context.Context, blob io.Reader, explode bool, at ...string) (models.BlobInfo, error) {
 	res := models.BlobInfo{}
-	r := c.Req().Post(blob).UrlFor(path.Join("/", path.Join(at...)))
+	r := c.Req().Context(ctx).Post(blob).UrlFor(path.Join("/", path.Join(at...)))
 	if explode {
 		r = r.Params("explode", "true")
 	}
@@ -785,13 +866,23 @@ func (c *Client) PostBlobExplode(blob io.Reader, explode bool, at ...string) (mo
 // to the location specified by at on the server.  You are responsible
 // for closing the passed io.Reader.
 func (c *Client) PostBlob(blob io.Reader, at ...string) (models.BlobInfo, error) {
-	return c.PostBlobExplode(blob, false, at...)
+	return c.PostBlobExplodeCtx(context.Background(), blob, false, at...)
+}
+
+// PostBlobCtx is PostBlob using ctx.
+func (c *Client) PostBlobCtx(ctx context.Context, blob io.Reader, at ...string) (models.BlobInfo, error) {
+	return c.PostBlobExplodeCtx(ctx, blob, false, at...)
 }
 
 // DeleteBlob deletes a blob on the server at the location indicated
 // by 'at'
 func (c *Client) DeleteBlob(at ...string) error {
-	return c.Req().Del().UrlFor(path.Join("/", path.Join(at...))).Do(nil)
+	return c.DeleteBlobCtx(context.Background(), at...)
+}
+
+// DeleteBlobCtx is DeleteBlob using ctx.
+func (c *Client) DeleteBlobCtx(ctx context.Context, at ...string) error {
+	return c.Req().Context(ctx).Del().UrlFor(path.Join("/", path.Join(at...))).Do(nil)
 }
 
 // AllIndexes returns all the static indexes available for all object
@@ -819,28 +910,67 @@ func (c *Client) OneIndex(prefix, param string) (models.Index, error) {
 // ListModel returns a list of models for prefix matching the request
 // parameters passed in by params.
 func (c *Client) ListModel(prefix string, params ...string) ([]models.Model, error) {
+	return c.ListModelCtx(context.Background(), prefix, params...)
+}
+
+// ListModelCtx is ListModel using ctx.
+func (c *Client) ListModelCtx(ctx context.Context, prefix string, params ...string) ([]models.Model, error) {
 	ref, err := models.New(prefix)
 	if err != nil {
 		return nil, err
 	}
 	res := ref.SliceOf()
-	err = c.Req().UrlForM(ref).Params(params...).Do(&res)
+	err = c.Req().Context(ctx).UrlForM(ref).Params(params...).Do(&res)
 	if err != nil {
 		return nil, err
 	}
 	return ref.ToModels(res), nil
 }
 
+// ListModelWhere is ListModel that only returns the objects that
+// also match the filter expression where.  The server applies params
+// first, and where is evaluated on the client against whatever the
+// server returned.  See CompileFilter for what where can contain.
+func (c *Client) ListModelWhere(prefix, where string, params ...string) ([]models.Model, error) {
+	return c.ListModelWhereCtx(context.Background(), prefix, where, params...)
+}
+
+// ListModelWhereCtx is ListModelWhere using ctx.
+func (c *Client) ListModelWhereCtx(ctx context.Context, prefix, where string, params ...string) ([]models.Model, error) {
+	test, err := CompileFilter(where)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := c.ListModelCtx(ctx, prefix, params...)
+	if err != nil {
+		return nil, err
+	}
+	res := []models.Model{}
+	for _, obj := range objs {
+		if ok, err := test(obj); err != nil {
+			return nil, err
+		} else if ok {
+			res = append(res, obj)
+		}
+	}
+	return res, nil
+}
+
 // GetModel returns an object if type prefix with the unique
 // identifier key, if such an object exists.  Key can be either the
 // unique key for an object, or any field on an object that has an
 // index that enforces uniqueness.
 func (c *Client) GetModel(prefix, key string, params ...string) (models.Model, error) {
+	return c.GetModelCtx(context.Background(), prefix, key, params...)
+}
+
+// GetModelCtx is GetModel using ctx.
+func (c *Client) GetModelCtx(ctx context.Context, prefix, key string, params ...string) (models.Model, error) {
 	res, err := models.New(prefix)
 	if err != nil {
 		return nil, err
 	}
-	return res, c.Req().UrlFor(res.Prefix(), key).Params(params...).Do(res)
+	return res, c.Req().Context(ctx).UrlFor(res.Prefix(), key).Params(params...).Do(res)
 }
 
 func (c *Client) GetModelForPatch(prefix, key string, params ...string) (models.Model, models.Model, error) {
@@ -854,7 +984,12 @@ func (c *Client) GetModelForPatch(prefix, key string, params ...string) (models.
 // ExistsModel tests to see if an object exists on the server
 // following the same rules as GetModel
 func (c *Client) ExistsModel(prefix, key string) (bool, error) {
-	err := c.Req().Head().UrlFor(prefix, key).Do(nil)
+	return c.ExistsModelCtx(context.Background(), prefix, key)
+}
+
+// ExistsModelCtx is ExistsModel using ctx.
+func (c *Client) ExistsModelCtx(ctx context.Context, prefix, key string) (bool, error) {
+	err := c.Req().Context(ctx).Head().UrlFor(prefix, key).Do(nil)
 	if e, ok := err.(*models.Error); ok && e.Code == http.StatusNotFound {
 		return false, nil
 	}
@@ -864,26 +999,39 @@ func (c *Client) ExistsModel(prefix, key string) (bool, error) {
 // FillModel fills the passed-in model with new information retrieved
 // from the server.
 func (c *Client) FillModel(ref models.Model, key string) error {
-	err := c.Req().UrlFor(ref.Prefix(), key).Do(&ref)
-	return err
+	return c.FillModelCtx(context.Background(), ref, key)
+}
+
+// FillModelCtx is FillModel using ctx.
+func (c *Client) FillModelCtx(ctx context.Context, ref models.Model, key string) error {
+	return c.Req().Context(ctx).UrlFor(ref.Prefix(), key).Do(&ref)
 }
 
 // CreateModel takes the passed-in model and creates an instance of it
 // on the server.  It will return an error if the passed-in model does
 // not validate or if it already exists on the server.
 func (c *Client) CreateModel(ref models.Model) error {
-	err := c.Req().Post(ref).UrlFor(ref.Prefix()).Do(&ref)
-	return err
+	return c.CreateModelCtx(context.Background(), ref)
+}
+
+// CreateModelCtx is CreateModel using ctx.
+func (c *Client) CreateModelCtx(ctx context.Context, ref models.Model) error {
+	return c.Req().Context(ctx).Post(ref).UrlFor(ref.Prefix()).Do(&ref)
 }
 
 // DeleteModel deletes the model matching the passed-in prefix and
 // key.  It returns the object that was deleted.
 func (c *Client) DeleteModel(prefix, key string) (models.Model, error) {
+	return c.DeleteModelCtx(context.Background(), prefix, key)
+}
+
+// DeleteModelCtx is DeleteModel using ctx.
+func (c *Client) DeleteModelCtx(ctx context.Context, prefix, key string) (models.Model, error) {
 	res, err := models.New(prefix)
 	if err != nil {
 		return nil, err
 	}
-	return res, c.Req().Del().UrlFor(prefix, key).Do(&res)
+	return res, c.Req().Context(ctx).Del().UrlFor(prefix, key).Do(&res)
 }
 
 func (c *Client) reauth(tok *models.UserToken) error {
@@ -897,11 +1045,16 @@ func (c *Client) reauth(tok *models.UserToken) error {
 // appropriate test stanzas, which will allow the server to detect and
 // reject conflicting changes from different sources.
 func (c *Client) PatchModel(prefix, key string, patch jsonpatch2.Patch) (models.Model, error) {
+	return c.PatchModelCtx(context.Background(), prefix, key, patch)
+}
+
+// PatchModelCtx is PatchModel using ctx.
+func (c *Client) PatchModelCtx(ctx context.Context, prefix, key string, patch jsonpatch2.Patch) (models.Model, error) {
 	new, err := models.New(prefix)
 	if err != nil {
 		return nil, err
 	}
-	err = c.Req().Patch(patch).UrlFor(prefix, key).Do(&new)
+	err = c.Req().Context(ctx).Patch(patch).UrlFor(prefix, key).Do(&new)
 	return new, err
 }
 
@@ -918,18 +1071,32 @@ func (c *Client) PatchToFull(old models.Model, new models.Model, paranoid bool)
 // allow the server to detect and reject conflicting changes from
 // multiple sources.
 func (c *Client) PutModel(obj models.Model) error {
-	return c.Req().Put(obj).UrlForM(obj).Do(&obj)
+	return c.PutModelCtx(context.Background(), obj)
+}
+
+// PutModelCtx is PutModel using ctx.
+func (c *Client) PutModelCtx(ctx context.Context, obj models.Model) error {
+	return c.Req().Context(ctx).Put(obj).UrlForM(obj).Do(&obj)
 }
 
 func (c *Client) Websocket(at string) (*websocket.Conn, error) {
-	ep, err := url.ParseRequestURI(c.endpoint + path.Join(APIPATH, at))
+	return c.WebsocketCtx(context.Background(), at)
+}
+
+// WebsocketCtx is Websocket using ctx to dial the server.  Once the
+// connection is made, ctx no longer has any effect on it.
+func (c *Client) WebsocketCtx(ctx context.Context, at string) (*websocket.Conn, error) {
+	c.mux.Lock()
+	endpoint, tlsConfig := c.endpoint, c.tlsConfig
+	c.mux.Unlock()
+	ep, err := url.ParseRequestURI(endpoint + path.Join(APIPATH, at))
 	if err != nil {
 		return nil, err
 	}
 	ep.Scheme = "wss"
 	dialer := &websocket.Dialer{
 		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig: tlsConfig,
 	}
 	header := http.Header{}
 	// If we have a token use it, otherwise basic auth
@@ -939,7 +1106,7 @@ func (c *Client) Websocket(at string) (*websocket.Conn, error) {
 		basicAuth := base64.StdEncoding.EncodeToString([]byte(c.username + ":" + c.password))
 		header.Set("Authorization", "Basic "+basicAuth)
 	}
-	res, _, err := dialer.Dial(ep.String(), header)
+	res, _, err := dialer.DialContext(ctx, ep.String(), header)
 	return res, err
 }
 
@@ -947,7 +1114,7 @@ var weAreTheProxy bool
 var localProxyMux = &sync.Mutex{}
 
 func (c *Client) makeProxy(socketPath string) (*http.Server, net.Listener, error) {
-	src, err := url.Parse(c.endpoint)
+	src, err := url.Parse(c.Endpoint())
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1007,7 +1174,7 @@ func (c *Client) MakeProxy(socketPath string) error {
 		}
 	}()
 	os.Setenv("RS_LOCAL_PROXY", socketPath)
-	c.Client.Transport = transport()
+	c.Client.Transport = transport(c.tlsConfig)
 	return nil
 }
 
@@ -1020,7 +1187,7 @@ func locallyProxied() string {
 	return ""
 }
 
-func transport() *http.Transport {
+func transport(tlsConfig *tls.Config) *http.Transport {
 	dialer := &net.Dialer{
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
@@ -1030,7 +1197,7 @@ func transport() *http.Transport {
 	if lp == "" {
 		tr = &http.Transport{
 			Proxy:                 http.ProxyFromEnvironment,
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+			TLSClientConfig:       tlsConfig,
 			MaxIdleConns:          10,
 			IdleConnTimeout:       90 * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
@@ -1055,15 +1222,33 @@ func transport() *http.Transport {
 
 // TokenSession creates a new api.Client that will use the passed-in Token for authentication.
 // It should be used whenever the API is not acting on behalf of a user.
+// The server certificate is checked as directed by TLSOptionsFromEnv.
 func TokenSession(endpoint, token string) (*Client, error) {
-	tr := transport()
+	return TokenSessionTLS(endpoint, token, nil)
+}
+
+// TokenSessionTLS is TokenSession using opts to set up TLS.  If opts
+// is nil, TLSOptionsFromEnv is used.
+func TokenSessionTLS(endpoint, token string, opts *TLSOptions) (*Client, error) {
+	tlsConfig, err := tlsConfigFor(endpoint, opts)
+	if err != nil {
+		return nil, err
+	}
+	tr := newEndpointTransport(transport(tlsConfig))
 	c := &Client{
-		mux:      &sync.Mutex{},
-		endpoint: endpoint,
-		Client:   &http.Client{Transport: tr},
-		closer:   make(chan struct{}, 0),
-		token:    &models.UserToken{Token: token},
-		iMux:     &sync.Mutex{},
+		mux:       &sync.Mutex{},
+		endpoint:  endpoint,
+		Client:    &http.Client{Transport: tr},
+		closer:    make(chan struct{}, 0),
+		token:     &models.UserToken{Token: token},
+		iMux:      &sync.Mutex{},
+		retry:     DefaultRetryPolicy,
+		tlsConfig: tlsConfig,
+		tlsOpts:   opts,
+		endpoints: []string{endpoint},
+		foMux:     &sync.Mutex{},
+		streams:   map[*EventStream]struct{}{},
+		rt:        tr,
 	}
 	go func() {
 		<-c.closer
@@ -1072,28 +1257,89 @@ func TokenSession(endpoint, token string) (*Client, error) {
 	return c, nil
 }
 
+// CredentialSession creates a new api.Client that gets its
+// credentials from creds, and asks it for new ones shortly before the
+// current ones expire.  The server certificate is checked as directed
+// by TLSOptionsFromEnv.
+func CredentialSession(endpoint string, creds CredentialProvider) (*Client, error) {
+	return CredentialSessionTLS(endpoint, creds, nil)
+}
+
+// CredentialSessionTLS is CredentialSession using opts to set up TLS.
+// If opts is nil, TLSOptionsFromEnv is used.
+func CredentialSessionTLS(endpoint string, creds CredentialProvider, opts *TLSOptions) (*Client, error) {
+	tlsConfig, err := tlsConfigFor(endpoint, opts)
+	if err != nil {
+		return nil, err
+	}
+	tr := newEndpointTransport(transport(tlsConfig))
+	c := &Client{
+		mux:       &sync.Mutex{},
+		endpoint:  endpoint,
+		Client:    &http.Client{Transport: tr},
+		closer:    make(chan struct{}, 0),
+		iMux:      &sync.Mutex{},
+		retry:     DefaultRetryPolicy,
+		tlsConfig: tlsConfig,
+		tlsOpts:   opts,
+		endpoints: []string{endpoint},
+		foMux:     &sync.Mutex{},
+		streams:   map[*EventStream]struct{}{},
+		rt:        tr,
+		creds:     creds,
+	}
+	expires, err := c.refreshCredential(context.Background(), DefaultRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-c.closer
+		tr.CloseIdleConnections()
+	}()
+	go c.refreshCredentials(expires)
+	return c, nil
+}
+
 // UserSession creates a new api.Client that can act on behalf of a
 // user.  It will perform a single request using basic authentication
 // to get a token that expires 600 seconds from the time the session
 // is crated, and every 300 seconds it will refresh that token.
 //
 // UserSession does not currently attempt to cache tokens to
-// persistent storage, although that may change in the future.
+// persistent storage, although that may change in the future.  The
+// server certificate is checked as directed by TLSOptionsFromEnv.
 func UserSession(endpoint, username, password string) (*Client, error) {
 	return UserSessionToken(endpoint, username, password, true)
 }
 
 // UserSessionToken allows for the token conversion turned off.
 func UserSessionToken(endpoint, username, password string, usetoken bool) (*Client, error) {
-	tr := transport()
+	return UserSessionTokenTLS(endpoint, username, password, usetoken, nil)
+}
+
+// UserSessionTokenTLS is UserSessionToken using opts to set up TLS.
+// If opts is nil, TLSOptionsFromEnv is used.
+func UserSessionTokenTLS(endpoint, username, password string, usetoken bool, opts *TLSOptions) (*Client, error) {
+	tlsConfig, err := tlsConfigFor(endpoint, opts)
+	if err != nil {
+		return nil, err
+	}
+	tr := newEndpointTransport(transport(tlsConfig))
 	c := &Client{
-		mux:      &sync.Mutex{},
-		endpoint: endpoint,
-		username: username,
-		password: password,
-		Client:   &http.Client{Transport: tr},
-		closer:   make(chan struct{}, 0),
-		iMux:     &sync.Mutex{},
+		mux:       &sync.Mutex{},
+		endpoint:  endpoint,
+		username:  username,
+		password:  password,
+		Client:    &http.Client{Transport: tr},
+		closer:    make(chan struct{}, 0),
+		iMux:      &sync.Mutex{},
+		retry:     DefaultRetryPolicy,
+		tlsConfig: tlsConfig,
+		tlsOpts:   opts,
+		endpoints: []string{endpoint},
+		foMux:     &sync.Mutex{},
+		streams:   map[*EventStream]struct{}{},
+		rt:        tr,
 	}
 	basicAuth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
 	token := &models.UserToken{}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := session.ListModelCtx(ctx, "machines"); err == nil {
+		t.Errorf("ListModelCtx with a cancelled context did not fail")
+	}
+	info := &models.Info{}
+	start := time.Now()
+	if err := session.Req().Context(ctx).UrlFor("info").Do(info); err == nil {
+		t.Errorf("Request with a cancelled context did not fail")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Request with a cancelled context was retried")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	es, err := session.EventsCtx(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create EventStream: %v", err)
+	}
+	_, ch, err := es.Register("machines.*.*")
+	if err != nil {
+		t.Fatalf("Failed to register for events: %v", err)
+	}
+	cancel()
+	select {
+	case evt := <-ch:
+		if evt.Err == nil {
+			t.Errorf("Expected an error event after cancelling the stream, got %v", evt.E)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("EventStream was not shut down when its context was cancelled")
+	}
+
+	es, err = session.Events()
+	if err != nil {
+		t.Fatalf("Failed to create EventStream: %v", err)
+	}
+	defer es.Close()
+	m := &models.Machine{Name: "ctx-wait"}
+	m.Fill()
+	if err := session.CreateModel(m); err != nil {
+		t.Fatalf("Failed to create machine: %v", err)
+	}
+	defer session.DeleteModel("machines", m.Key())
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	res, err := es.WaitForCtx(ctx, m, EqualItem("Name", "never-matches"), time.Minute)
+	if res != "interrupt" || err != context.DeadlineExceeded {
+		t.Errorf("Expected WaitForCtx to be interrupted, got %s: %v", res, err)
+	}
+}
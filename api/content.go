@@ -84,6 +84,18 @@ func (c *Client) BundleContent(src string, dst store.Store, params map[string]st
 		dm.SetMetaData(meta)
 	}
 
+	txn, err := store.Begin(dst)
+	if err != nil {
+		return err
+	}
+	if err := bundleInto(src, txn); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+func bundleInto(src string, dst store.Txn) error {
 	// for each valid content type, load it
 	files, _ := ioutil.ReadDir(src)
 	for _, f := range files {
@@ -110,24 +122,20 @@ func (c *Client) BundleContent(src string, dst store.Store, params map[string]st
 			if err != nil {
 				return fmt.Errorf("Cannot read item %s: %v", path.Join(prefix, itemName), err)
 			}
-			switch path.Ext(itemName) {
-			case ".yaml", ".yml":
-				if err := store.YamlCodec.Decode(buf, item); err != nil {
-					return fmt.Errorf("Cannot parse item %s: %v", path.Join(prefix, itemName), err)
-				}
-			case ".json":
-				if err := store.JsonCodec.Decode(buf, item); err != nil {
+			if codec, _, err := store.CodecByExt(itemName); err == nil {
+				if err := codec.Decode(buf, item); err != nil {
 					return fmt.Errorf("Cannot parse item %s: %v", path.Join(prefix, itemName), err)
 				}
-			default:
-				if tmpl, ok := item.(*models.Template); ok && prefix == "templates" {
-					tmpl.ID = itemName
-					tmpl.Contents = string(buf)
-				} else {
-					return fmt.Errorf("No idea how to decode %s into %s", itemName, item.Prefix())
-				}
+			} else if tmpl, ok := item.(*models.Template); ok && prefix == "templates" {
+				tmpl.ID = itemName
+				tmpl.Contents = string(buf)
+			} else {
+				return fmt.Errorf("No idea how to decode %s into %s", itemName, item.Prefix())
 			}
 			if err := dst.Save(prefix, item.Key(), item); err != nil {
+				if _, ok := err.(*models.Error); ok {
+					return err
+				}
 				return fmt.Errorf("Failed to save %s:%s: %v", item.Prefix(), item.Key(), err)
 			}
 		}
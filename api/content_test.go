@@ -0,0 +1,57 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/digitalrebar/provision/v4/store"
+)
+
+func TestBundleCodecs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "api-bundle-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	c := &Client{}
+	for _, codec := range []string{"json.gz", "cbor", "msgpack"} {
+		src, err := store.Open("memory:///?codec=" + codec)
+		if err != nil {
+			t.Fatalf("Failed to open %s store: %v", codec, err)
+		}
+		profile := &models.Profile{Name: "p1", Description: codec, Params: map[string]interface{}{"a": "b"}}
+		if err := src.Save("profiles", profile.Key(), profile); err != nil {
+			t.Fatalf("Failed to save profile: %v", err)
+		}
+		tmpl := &models.Template{ID: "t1.tmpl", Contents: "{{ .Machine.Name }}"}
+		if err := src.Save("templates", tmpl.Key(), tmpl); err != nil {
+			t.Fatalf("Failed to save template: %v", err)
+		}
+		dir := path.Join(tmp, codec)
+		if err := c.UnbundleContent(src, dir); err != nil {
+			t.Fatalf("Failed to unbundle %s store: %v", codec, err)
+		}
+		if _, err := os.Stat(path.Join(dir, "profiles", "p1."+codec)); err != nil {
+			t.Errorf("Expected profile to be written as p1.%s: %v", codec, err)
+		}
+		dst, _ := store.Open("memory:///")
+		if err := c.BundleContent(dir, dst, map[string]string{"Name": codec}); err != nil {
+			t.Errorf("Failed to bundle %s directory: %v", codec, err)
+			continue
+		}
+		gotProfile := &models.Profile{}
+		if err := dst.Load("profiles", "p1", gotProfile); err != nil {
+			t.Errorf("Failed to load bundled profile: %v", err)
+		} else if gotProfile.Description != codec || !reflect.DeepEqual(gotProfile.Params, profile.Params) {
+			t.Errorf("Expected profile %#v, got %#v", profile, gotProfile)
+		}
+		gotTmpl := &models.Template{}
+		if err := dst.Load("templates", "t1.tmpl", gotTmpl); err != nil || gotTmpl.Contents != tmpl.Contents {
+			t.Errorf("Expected template %#v, got %#v: %v", tmpl, gotTmpl, err)
+		}
+	}
+}
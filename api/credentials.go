@@ -0,0 +1,184 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// DefaultCredentialRefresh is how often a Client asks its
+// CredentialProvider for fresh credentials when it does not know when
+// the current ones expire.
+var DefaultCredentialRefresh = 5 * time.Minute
+
+// Credential is what a CredentialProvider hands out.  If Token is
+// empty, Username and Password are used to get a token from
+// dr-provision.
+type Credential struct {
+	Token    string
+	Username string
+	Password string
+	// Expires is when Token stops working.  If it is zero, the
+	// Client will ask for new credentials every
+	// DefaultCredentialRefresh.
+	Expires time.Time
+}
+
+// CredentialProvider hands out the credentials a Client uses to talk
+// to endpoint.  A Client created with CredentialSession will call
+// Credential again shortly before the credentials expire.
+type CredentialProvider interface {
+	Credential(ctx context.Context, endpoint string) (*Credential, error)
+}
+
+// parseCredential handles the formats that EnvCredentials,
+// FileCredentials, and ExecCredentials accept: a JSON encoded
+// Credential or a bare token.  A username and password have to be
+// passed as JSON, since tokens can have colons in them too.
+func parseCredential(buf []byte) (*Credential, error) {
+	buf = bytes.TrimSpace(buf)
+	res := &Credential{}
+	switch {
+	case len(buf) == 0:
+		return nil, fmt.Errorf("No credentials found")
+	case buf[0] == '{':
+		if err := json.Unmarshal(buf, res); err != nil {
+			return nil, fmt.Errorf("Invalid credentials: %v", err)
+		}
+	default:
+		res.Token = string(buf)
+	}
+	if res.Token == "" && (res.Username == "" || res.Password == "") {
+		return nil, fmt.Errorf("Credentials need either a Token or a Username and Password")
+	}
+	return res, nil
+}
+
+// EnvCredentials is a CredentialProvider that reads credentials from
+// the named environment variable each time it is asked.  The
+// variable can hold a token, or a JSON encoded Credential such as
+// {"Username": "rocketskates", "Password": "r0cketsk8ts"}.
+type EnvCredentials string
+
+func (e EnvCredentials) Credential(ctx context.Context, endpoint string) (*Credential, error) {
+	res, err := parseCredential([]byte(os.Getenv(string(e))))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", string(e), err)
+	}
+	return res, nil
+}
+
+// FileCredentials is a CredentialProvider that reads credentials from
+// the named file each time it is asked, so that something else can
+// keep the file up to date.  The file holds the same things
+// EnvCredentials accepts.
+type FileCredentials string
+
+func (f FileCredentials) Credential(ctx context.Context, endpoint string) (*Credential, error) {
+	buf, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	res, err := parseCredential(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", string(f), err)
+	}
+	return res, nil
+}
+
+// ExecCredentials is a CredentialProvider that runs a helper program
+// to get credentials, in the same spirit as git and docker credential
+// helpers.  The helper is passed the endpoint on stdin and in the
+// RS_ENDPOINT environment variable, and must write the same things
+// EnvCredentials accepts to stdout.
+type ExecCredentials struct {
+	Command string
+	Args    []string
+}
+
+func (e *ExecCredentials) Credential(ctx context.Context, endpoint string) (*Credential, error) {
+	cmd := exec.CommandContext(ctx, e.Command, e.Args...)
+	cmd.Env = append(os.Environ(), "RS_ENDPOINT="+endpoint)
+	cmd.Stdin = strings.NewReader(endpoint + "\n")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Credential helper %s failed: %v: %s", e.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	res, err := parseCredential(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Credential helper %s: %v", e.Command, err)
+	}
+	return res, nil
+}
+
+// refreshCredential gets new credentials from the Client's
+// CredentialProvider and starts using them.  It returns when they
+// expire.  If a token needs to be fetched, retry controls how hard we
+// try.
+func (c *Client) refreshCredential(ctx context.Context, retry RetryPolicy) (time.Time, error) {
+	cred, err := c.creds.Credential(ctx, c.Endpoint())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if cred.Token == "" {
+		basicAuth := base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password))
+		token := &models.UserToken{}
+		if err := c.Req().Context(ctx).Retry(retry).
+			UrlFor("users", cred.Username, "token").
+			Params("ttl", "600").
+			Headers("Authorization", "Basic "+basicAuth).
+			Do(&token); err != nil {
+			return time.Time{}, err
+		}
+		cred.Token = token.Token
+		cred.Expires = time.Now().Add(600 * time.Second)
+	}
+	c.mux.Lock()
+	c.token = &models.UserToken{Token: cred.Token}
+	if cred.Username != "" {
+		c.username = cred.Username
+	}
+	c.mux.Unlock()
+	return cred.Expires, nil
+}
+
+// refreshCredentials keeps the Client's credentials fresh until it
+// is closed.
+func (c *Client) refreshCredentials(expires time.Time) {
+	for {
+		wait := DefaultCredentialRefresh
+		if !expires.IsZero() {
+			// Leave plenty of time to get new credentials before the
+			// old ones stop working.
+			wait = time.Until(expires) * 4 / 5
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.closer:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		next, err := c.refreshCredential(context.Background(), c.retryPolicy())
+		if err != nil {
+			log.Printf("Error refreshing credentials, will try again: %v", err)
+			next = time.Now().Add(10 * time.Second)
+		}
+		expires = next
+	}
+}
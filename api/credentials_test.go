@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCredentialProviders(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "api-creds-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	ctx := context.Background()
+
+	os.Setenv("RS_TEST_CREDS", `{"Username": "user", "Password": "pass"}`)
+	defer os.Unsetenv("RS_TEST_CREDS")
+	cred, err := EnvCredentials("RS_TEST_CREDS").Credential(ctx, "https://127.0.0.1:8092")
+	if err != nil || cred.Username != "user" || cred.Password != "pass" || cred.Token != "" {
+		t.Errorf("Unexpected env credentials %#v: %v", cred, err)
+	}
+	os.Setenv("RS_TEST_CREDS", "opaque:token")
+	cred, err = EnvCredentials("RS_TEST_CREDS").Credential(ctx, "https://127.0.0.1:8092")
+	if err != nil || cred.Token != "opaque:token" || cred.Username != "" {
+		t.Errorf("Expected a token with a colon to stay a token, got %#v: %v", cred, err)
+	}
+	os.Setenv("RS_TEST_CREDS", "")
+	if _, err := EnvCredentials("RS_TEST_CREDS").Credential(ctx, ""); err == nil {
+		t.Errorf("Expected empty env credentials to fail")
+	}
+
+	credFile := path.Join(tmp, "token")
+	ioutil.WriteFile(credFile, []byte("a-token\n"), 0600)
+	cred, err = FileCredentials(credFile).Credential(ctx, "")
+	if err != nil || cred.Token != "a-token" {
+		t.Errorf("Unexpected file credentials %#v: %v", cred, err)
+	}
+
+	helper := &ExecCredentials{
+		Command: "sh",
+		Args:    []string{"-c", `read ep; echo "{\"Token\": \"$ep $RS_ENDPOINT\"}"`},
+	}
+	cred, err = helper.Credential(ctx, "https://drp:8092")
+	if err != nil || cred.Token != "https://drp:8092 https://drp:8092" {
+		t.Errorf("Unexpected helper credentials %#v: %v", cred, err)
+	}
+	if _, err := (&ExecCredentials{Command: "false"}).Credential(ctx, ""); err == nil {
+		t.Errorf("Expected a failing helper to fail")
+	}
+
+	write := func(token string, expires time.Time) {
+		buf, _ := json.Marshal(&Credential{Token: token, Expires: expires})
+		ioutil.WriteFile(credFile, buf, 0600)
+	}
+	write("first", time.Now().Add(time.Second))
+	c, err := CredentialSessionTLS("https://127.0.0.1:8092", FileCredentials(credFile), &TLSOptions{Insecure: true})
+	if err != nil {
+		t.Fatalf("Failed to create CredentialSession: %v", err)
+	}
+	defer c.Close()
+	if c.Token() != "first" {
+		t.Errorf("Expected token first, got %s", c.Token())
+	}
+	write("second", time.Now().Add(time.Hour))
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Token() != "second" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if c.Token() != "second" {
+		t.Errorf("Credentials were not refreshed before they expired")
+	}
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -83,8 +84,8 @@ func EqualItem(field string, value interface{}) TestFunc {
 	}
 }
 
-func (c *Client) ws() (*websocket.Conn, error) {
-	return c.Websocket("ws")
+func (c *Client) ws(ctx context.Context) (*websocket.Conn, error) {
+	return c.WebsocketCtx(ctx, "ws")
 }
 
 // RecievedEvent contains an event received from the digitalrebar
@@ -105,6 +106,19 @@ func (r *RecievedEvent) matches(registration string) bool {
 		(tak[2] == r.E.Key || tak[2] == "*")
 }
 
+// EventStreamKeepalive is how often an EventStream pings the server.
+// If nothing at all is heard from the server for twice this long,
+// the connection is treated as lost.  Zero turns keepalives off.
+var EventStreamKeepalive = 30 * time.Second
+
+// IsResync returns whether r is the synthetic event an EventStream
+// sends to every receiver after it reconnects to the server.  Events
+// may have been missed while the EventStream was disconnected, so
+// anything that tracks the state of objects should refetch them.
+func (r *RecievedEvent) IsResync() bool {
+	return r.E.Type == "websocket" && r.E.Action == "resync"
+}
+
 // EventStream receives events from the digitalrebar provider.  You
 // can read received events by reading from its Events channel.
 type EventStream struct {
@@ -116,16 +130,244 @@ type EventStream struct {
 	mux           *sync.Mutex
 	kill          chan struct{}
 	rchan         chan RecievedEvent
+	done          chan struct{}
+	ctx           context.Context
+	cancel        context.CancelFunc
+	endpoint      string
+	closing       bool
+	// unacked holds the register and deregister commands sent for
+	// Register, Subscribe, and Deregister calls that the server has
+	// not acked yet.
+	unacked []string
+}
+
+// moved makes the EventStream reconnect if its Client has failed
+// over to another endpoint.
+func (es *EventStream) moved() {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+	if es.endpoint != es.client.Endpoint() {
+		es.conn.Close()
+	}
+}
+
+// keepalive pings the server over conn every EventStreamKeepalive,
+// and makes reads from conn fail if the server stops answering.
+func (es *EventStream) keepalive(conn *websocket.Conn) {
+	interval := EventStreamKeepalive
+	if interval <= 0 {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * interval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * interval))
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-es.done:
+				return
+			case <-ticker.C:
+			}
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// DefaultResumeTimeout is how long an EventStream waits for the
+// server to ack its registrations after reconnecting when
+// EventStreamKeepalive is turned off.
+var DefaultResumeTimeout = 30 * time.Second
+
+// read reads the next event from conn.
+func read(conn *websocket.Conn) (RecievedEvent, error) {
+	evt := RecievedEvent{}
+	_, msg, err := conn.NextReader()
+	if err != nil {
+		return evt, err
+	}
+	evt.Err = json.NewDecoder(msg).Decode(&evt.E)
+	return evt, nil
+}
+
+// acked takes the command evt acks out of es.unacked, and returns
+// whether it was there.  It must be called with es.mux held.
+func (es *EventStream) acked(evt *RecievedEvent) bool {
+	if evt.Err != nil || evt.E.Type != "websocket" {
+		return false
+	}
+	cmd := evt.E.Action + " " + evt.E.Key
+	for i := range es.unacked {
+		if es.unacked[i] == cmd {
+			es.unacked = append(es.unacked[:i], es.unacked[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// resume switches the EventStream over to conn, registers for
+// everything we were registered for before, and lets every receiver
+// know that it may have missed events.
+//
+// It waits for the server to ack every registration before letting
+// go of es.mux, so nothing else can be registered or dispatched in
+// the meantime, and the resync event only goes out once we are
+// getting every event again.  Events that arrive while waiting are
+// dispatched after the resync event.  Commands for Register,
+// Subscribe, and Deregister calls that were sent on the old
+// connection and never acked are acked here, so their callers do not
+// wait forever.
+func (es *EventStream) resume(conn *websocket.Conn) error {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+	if es.closing || es.ctx.Err() != nil {
+		conn.Close()
+		return fmt.Errorf("EventStream closed")
+	}
+	pending := map[string]bool{}
+	for evt := range es.subscriptions {
+		if evt == "websocket.*.*" {
+			continue
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("register "+evt)); err != nil {
+			conn.Close()
+			return err
+		}
+		pending[evt] = true
+	}
+	timeout := 2 * EventStreamKeepalive
+	if timeout <= 0 {
+		timeout = DefaultResumeTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	held := []RecievedEvent{}
+	for len(pending) > 0 {
+		evt, err := read(conn)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if evt.Err == nil && evt.E.Type == "websocket" && evt.E.Action == "register" && pending[evt.E.Key] {
+			delete(pending, evt.E.Key)
+			// Only pass the ack on if a Register call is waiting
+			// for it.
+			if !es.acked(&evt) {
+				continue
+			}
+		}
+		held = append(held, evt)
+	}
+	conn.SetReadDeadline(time.Time{})
+	for _, cmd := range es.unacked {
+		parts := strings.SplitN(cmd, " ", 2)
+		held = append(held, RecievedEvent{E: models.Event{Time: time.Now(), Type: "websocket", Action: parts[0], Key: parts[1]}})
+	}
+	es.unacked = nil
+	es.conn.Close()
+	es.conn = conn
+	es.endpoint = es.client.Endpoint()
+	es.keepalive(conn)
+	resync := RecievedEvent{E: models.Event{Time: time.Now(), Type: "websocket", Action: "resync"}}
+	for _, receiver := range es.receivers {
+		if receiver == nil || receiver == es.rchan {
+			continue
+		}
+		select {
+		case receiver <- resync:
+		default:
+			fmt.Printf("Failed to send an event\n")
+		}
+	}
+	for i := range held {
+		es.dispatch(held[i])
+	}
+	return nil
+}
+
+// dispatch hands evt to every receiver subscribed to it.  It must be
+// called with es.mux held.
+func (es *EventStream) dispatch(evt RecievedEvent) {
+	toSend := map[int64]chan RecievedEvent{}
+	for reg, handles := range es.subscriptions {
+		if !evt.matches(reg) {
+			continue
+		}
+		for _, i := range handles {
+			if toSend[i] == nil {
+				toSend[i] = es.receivers[i]
+			}
+		}
+	}
+	for i := range toSend {
+		select {
+		case toSend[i] <- evt:
+		default:
+			fmt.Printf("Failed to send an event\n")
+		}
+	}
+}
+
+// reconnect tries to get a new connection to the server after ours
+// was lost, failing over to another endpoint if the Client has one
+// and ours cannot be reached.  It keeps trying, backing off as the
+// Client's RetryPolicy says, until it succeeds or the EventStream is
+// shut down.  It returns false in the latter case.
+func (es *EventStream) reconnect() bool {
+	for attempt := 1; ; attempt++ {
+		es.mux.Lock()
+		closing, endpoint := es.closing, es.endpoint
+		es.mux.Unlock()
+		if closing || es.ctx.Err() != nil {
+			return false
+		}
+		conn, err := es.client.ws(es.ctx)
+		if err != nil && es.client.failover(es.ctx, endpoint) == nil {
+			conn, err = es.client.ws(es.ctx)
+		}
+		if err == nil {
+			if err = es.resume(conn); err == nil {
+				return true
+			}
+		}
+		policy := es.client.retryPolicy()
+		if len(policy.Backoff) == 0 {
+			policy = DefaultRetryPolicy
+		}
+		if sleepCtx(es.ctx, policy.wait(attempt)) != nil {
+			return false
+		}
+	}
 }
 
 func (es *EventStream) processEvents(running chan struct{}) {
 	close(running)
+	defer close(es.done)
+	defer es.cancel()
+	defer func() {
+		es.client.mux.Lock()
+		delete(es.client.streams, es)
+		es.client.mux.Unlock()
+	}()
 	for {
-		_, msg, err := es.conn.NextReader()
+		es.mux.Lock()
+		conn := es.conn
+		es.mux.Unlock()
+		evt, err := read(conn)
 		if err != nil {
-			es.conn.Close()
+			conn.Close()
+			if es.reconnect() {
+				continue
+			}
 			es.mux.Lock()
 			for h, receiver := range es.receivers {
+				if receiver == nil {
+					continue
+				}
 				receiver <- RecievedEvent{Err: err}
 				close(receiver)
 				es.receivers[h] = nil
@@ -133,37 +375,37 @@ func (es *EventStream) processEvents(running chan struct{}) {
 			es.mux.Unlock()
 			return
 		}
-		evt := RecievedEvent{}
-		evt.Err = json.NewDecoder(msg).Decode(&evt.E)
-		toSend := map[int64]chan RecievedEvent{}
-		es.mux.Lock()
-		for reg, handles := range es.subscriptions {
-			if !evt.matches(reg) {
-				continue
-			}
-			for _, i := range handles {
-				if toSend[i] == nil {
-					toSend[i] = es.receivers[i]
-				}
-			}
-		}
-		for i := range toSend {
-			select {
-			case toSend[i] <- evt:
-			default:
-				fmt.Printf("Failed to send an event\n")
-			}
+		if interval := EventStreamKeepalive; interval > 0 {
+			conn.SetReadDeadline(time.Now().Add(2 * interval))
 		}
+		es.mux.Lock()
+		es.acked(&evt)
+		es.dispatch(evt)
 		es.mux.Unlock()
 	}
 }
 
 // Events creates a new EventStream from the client.
 func (c *Client) Events() (*EventStream, error) {
-	conn, err := c.ws()
+	return c.EventsCtx(context.Background())
+}
+
+// EventsCtx creates a new EventStream from the client that will be
+// shut down when ctx is done.  Once that happens, every receiver gets
+// a RecievedEvent with a non-nil Err and is closed.
+//
+// If the connection to the server is lost, the EventStream keeps
+// trying to reconnect, following the Client to another endpoint if it
+// fails over.  Once it is back, it registers for the same events as
+// before, and once the server has acked them it sends every receiver
+// an event for which IsResync returns true, as any events that
+// happened while it was disconnected are lost.
+func (c *Client) EventsCtx(ctx context.Context) (*EventStream, error) {
+	conn, err := c.ws(ctx)
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel := context.WithCancel(ctx)
 	res := &EventStream{
 		client:        c,
 		conn:          conn,
@@ -171,14 +413,33 @@ func (c *Client) Events() (*EventStream, error) {
 		receivers:     map[int64]chan RecievedEvent{},
 		mux:           &sync.Mutex{},
 		kill:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		ctx:           ctx,
+		cancel:        cancel,
+		endpoint:      c.Endpoint(),
 	}
+	c.mux.Lock()
+	c.streams[res] = struct{}{}
+	c.mux.Unlock()
 	newID := atomic.AddInt64(&res.handleId, 1)
 	res.rchan = make(chan RecievedEvent, 100)
 	res.subscriptions["websocket.*.*"] = []int64{newID}
 	res.receivers[newID] = res.rchan
+	res.keepalive(conn)
 	running := make(chan struct{})
 	go res.processEvents(running)
 	<-running
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Closing the connection makes the pending read in
+			// processEvents fail.
+			res.mux.Lock()
+			res.conn.Close()
+			res.mux.Unlock()
+		case <-res.done:
+		}
+	}()
 	return res, nil
 }
 
@@ -186,8 +447,19 @@ func (c *Client) Events() (*EventStream, error) {
 // until you read a RecievedEvent that has an empty E and a non-nil
 // Err
 func (es *EventStream) Close() error {
-	return es.conn.WriteMessage(websocket.CloseMessage,
+	es.mux.Lock()
+	defer es.mux.Unlock()
+	if es.closing {
+		return nil
+	}
+	es.closing = true
+	err := es.conn.WriteMessage(websocket.CloseMessage,
 		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		// We are most likely trying to reconnect, so make that stop.
+		es.cancel()
+	}
+	return err
 }
 
 func (es *EventStream) subscribe(handle int64, events ...string) (int, error) {
@@ -214,6 +486,7 @@ func (es *EventStream) subscribe(handle int64, events ...string) (int, error) {
 			if err := es.conn.WriteMessage(websocket.TextMessage, []byte("register "+evt)); err != nil {
 				return count, err
 			}
+			es.unacked = append(es.unacked, "register "+evt)
 			count += 1
 		}
 		es.subscriptions[evt] = handles
@@ -267,6 +540,104 @@ func (es *EventStream) Register(events ...string) (int64, <-chan RecievedEvent,
 	return newID, ch, err
 }
 
+// TypedEvent is a RecievedEvent with the object it is about decoded
+// into the right models.Model.
+type TypedEvent struct {
+	RecievedEvent
+	// Object is the object the event is about.
+	Object models.Model
+	// Original is what the object looked like before an update or
+	// save, if the server sent it along.
+	Original models.Model
+}
+
+// decode fills in Object and Original from the event.
+func (t *TypedEvent) decode(prefix string) error {
+	var err error
+	if t.E.Object != nil {
+		if t.Object, err = models.New(prefix); err != nil {
+			return err
+		}
+		if err = models.Remarshal(t.E.Object, t.Object); err != nil {
+			return err
+		}
+	}
+	if t.E.Original != nil {
+		if t.Original, err = models.New(prefix); err != nil {
+			return err
+		}
+		err = models.Remarshal(t.E.Original, t.Original)
+	}
+	return err
+}
+
+// RegisterTyped is Register for every event about objects of type
+// prefix, decoding the objects the events carry into the models.Model
+// for prefix.  Types that models does not know about are decoded into
+// a RawModel.  If test is not nil, only events where either the
+// object or its original pass test are delivered, so consumers can
+// see objects leave the set as well as enter it.  Events that cannot
+// be decoded or tested are delivered with Err set, and resync events
+// are delivered as they are.  The returned handle is passed to
+// Deregister as usual.
+func (es *EventStream) RegisterTyped(prefix string, test TestFunc) (int64, <-chan TypedEvent, error) {
+	ref, err := models.New(prefix)
+	if err != nil {
+		return 0, nil, err
+	}
+	prefix = ref.Prefix()
+	handle, raw, err := es.Register(prefix + ".*.*")
+	if err != nil {
+		return handle, nil, err
+	}
+	ch := make(chan TypedEvent, 100)
+	go func() {
+		defer close(ch)
+		for evt := range raw {
+			res := TypedEvent{RecievedEvent: evt}
+			if evt.Err == nil && !evt.IsResync() {
+				res.Err = res.decode(prefix)
+				if res.Err == nil && test != nil {
+					var ok bool
+					ok, res.Err = matchEither(test, res.Object, res.Original)
+					if !ok && res.Err == nil {
+						continue
+					}
+				}
+			}
+			select {
+			case ch <- res:
+			default:
+				fmt.Printf("Failed to send an event\n")
+			}
+		}
+	}()
+	return handle, ch, nil
+}
+
+// RegisterWhere is RegisterTyped using the filter expression where
+// as the test.  See CompileFilter for what where can contain.
+func (es *EventStream) RegisterWhere(prefix, where string) (int64, <-chan TypedEvent, error) {
+	test, err := CompileFilter(where)
+	if err != nil {
+		return 0, nil, err
+	}
+	return es.RegisterTyped(prefix, test)
+}
+
+// matchEither returns whether any of objs passes test.
+func matchEither(test TestFunc, objs ...models.Model) (bool, error) {
+	for _, obj := range objs {
+		if obj == nil {
+			continue
+		}
+		if ok, err := test(obj); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
 func (es *EventStream) deregister(handle int64) (int, error) {
 	ch, ok := es.receivers[handle]
 	if !ok {
@@ -285,6 +656,7 @@ func (es *EventStream) deregister(handle int64) (int, error) {
 		if len(handles) == 0 {
 			count += 1
 			es.conn.WriteMessage(websocket.TextMessage, []byte("deregister "+evt))
+			es.unacked = append(es.unacked, "deregister "+evt)
 			delete(es.subscriptions, evt)
 		}
 	}
@@ -325,15 +697,40 @@ func (es *EventStream) WaitFor(
 	item models.Model,
 	test TestFunc,
 	timeout time.Duration) (string, error) {
-	// Make some basic vars
-	prefix := item.Prefix()
-	id := item.Key()
 	interrupt := make(chan os.Signal, 1)
-	evts := []string{prefix + ".update." + id, prefix + ".save." + id}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Handle interrupt signal while selecting
+	// Handle interrupt signal while waiting
 	signal.Notify(interrupt, os.Interrupt)
 	defer signal.Reset(os.Interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	res, err := es.WaitForCtx(ctx, item, test, timeout)
+	if res == "interrupt" {
+		err = nil
+	}
+	return res, err
+}
+
+// WaitForCtx is WaitFor using ctx.  It does not handle any signals.
+// If ctx is done before item matches test, it returns "interrupt"
+// along with ctx.Err().
+func (es *EventStream) WaitForCtx(
+	ctx context.Context,
+	item models.Model,
+	test TestFunc,
+	timeout time.Duration) (string, error) {
+	// Make some basic vars
+	prefix := item.Prefix()
+	id := item.Key()
+	evts := []string{prefix + ".update." + id, prefix + ".save." + id}
 
 	// Register for events
 	handle, ch, err := es.Register(evts...)
@@ -344,14 +741,13 @@ func (es *EventStream) WaitFor(
 
 	// Setup the timer
 	timer := time.NewTimer(timeout)
-	defer func() {
-		if timer != nil && !timer.Stop() {
-			<-timer.C
-		}
-	}()
+	defer timer.Stop()
 
 	for {
-		if err := es.client.FillModel(item, id); err != nil {
+		if err := es.client.FillModelCtx(ctx, item, id); err != nil {
+			if ctx.Err() != nil {
+				return "interrupt", ctx.Err()
+			}
 			return fmt.Sprintf("fill: %v", err), err
 		}
 		found, err := test(item)
@@ -366,17 +762,162 @@ func (es *EventStream) WaitFor(
 			return "interrupt", nil
 		case evt := <-ch:
 			if evt.Err != nil {
-				return fmt.Sprintf("read: %v", err), err
-			}
-			if err != nil {
-				return fmt.Sprintf("read: %v", err), err
+				return fmt.Sprintf("read: %v", evt.Err), evt.Err
 			}
-		case <-interrupt:
-			return "interrupt", nil
+		case <-ctx.Done():
+			return "interrupt", ctx.Err()
 		case <-timer.C:
-			timer.Stop()
-			timer = nil
 			return "timeout", nil
 		}
 	}
 }
+
+// WaitResult is how waiting for one item in WaitForAll turned out.
+type WaitResult struct {
+	Item models.Model
+	// Status is "complete", "timeout", "interrupt", or "error", in
+	// which case Err says what went wrong.
+	Status string
+	Err    error
+}
+
+// WaitForAll waits for every one of items to match test, checking at
+// most concurrency of them against the server at a time.  All the
+// items share a single registration on the EventStream, so it can be
+// used to follow hundreds of machines at once.  Each item is filled
+// in place as it is checked, just as with WaitFor.
+//
+// Each item gets timeout to match.  If ctx is done first, the items
+// still being waited on end up with the "interrupt" status.  Unlike
+// WaitFor, no signals are handled; that is left to the caller.
+//
+// If progress is not nil, every result is sent to it as soon as it
+// is known, and it is closed before WaitForAll returns.  The returned
+// results are in the same order as items.  An error is only returned
+// if the wait could not be set up at all.
+func (es *EventStream) WaitForAll(
+	ctx context.Context,
+	items []models.Model,
+	test TestFunc,
+	timeout time.Duration,
+	concurrency int,
+	progress chan<- WaitResult) ([]WaitResult, error) {
+	if progress != nil {
+		defer close(progress)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// Register once for every type of item.
+	evts := []string{}
+	seen := map[string]struct{}{}
+	pokes := map[string][]chan struct{}{}
+	itemPokes := make([]chan struct{}, len(items))
+	for i, item := range items {
+		prefix := item.Prefix()
+		if _, ok := seen[prefix]; !ok {
+			seen[prefix] = struct{}{}
+			evts = append(evts, prefix+".update.*", prefix+".save.*")
+		}
+		itemPokes[i] = make(chan struct{}, 1)
+		k := prefix + "." + item.Key()
+		pokes[k] = append(pokes[k], itemPokes[i])
+	}
+	handle, ch, err := es.Register(evts...)
+	if err != nil {
+		return nil, err
+	}
+	defer es.Deregister(handle)
+
+	// Route events to the items they are about.
+	lost := make(chan struct{})
+	var lostErr error
+	go func() {
+		poke := func(chs []chan struct{}) {
+			for _, c := range chs {
+				select {
+				case c <- struct{}{}:
+				default:
+				}
+			}
+		}
+		for evt := range ch {
+			switch {
+			case evt.Err != nil:
+				lostErr = evt.Err
+				close(lost)
+				return
+			case evt.IsResync():
+				poke(itemPokes)
+			default:
+				poke(pokes[evt.E.Type+"."+evt.E.Key])
+			}
+		}
+	}()
+
+	sem := make(chan struct{}, concurrency)
+	res := make([]WaitResult, len(items))
+	wg := &sync.WaitGroup{}
+	wait := func(i int) {
+		item := items[i]
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		res[i] = WaitResult{Item: item}
+		for {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				res[i].Status, res[i].Err = "interrupt", ctx.Err()
+				return
+			}
+			err := es.client.FillModelCtx(ctx, item, item.Key())
+			found := false
+			if err == nil {
+				found, err = test(item)
+			}
+			<-sem
+			switch {
+			case err != nil && ctx.Err() != nil:
+				res[i].Status, res[i].Err = "interrupt", ctx.Err()
+				return
+			case err != nil:
+				res[i].Status, res[i].Err = "error", err
+				return
+			case found:
+				res[i].Status = "complete"
+				return
+			}
+			select {
+			case <-itemPokes[i]:
+			case <-lost:
+				res[i].Status, res[i].Err = "error", lostErr
+				return
+			case <-ctx.Done():
+				res[i].Status, res[i].Err = "interrupt", ctx.Err()
+				return
+			case <-timer.C:
+				res[i].Status = "timeout"
+				return
+			}
+		}
+	}
+	done := make(chan int, len(items))
+	for i := range items {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			wait(i)
+			done <- i
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for i := range done {
+		if progress != nil {
+			progress <- res[i]
+		}
+	}
+	return res, nil
+}
@@ -1,9 +1,18 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/digitalrebar/provision/v4/models"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 )
 
 func testFunc(t *testing.T, m interface{}, fn TestFunc, result, haveError bool) {
@@ -59,3 +68,351 @@ func TestEqualItem(t *testing.T) {
 	testFunc(t, machine, fnOr, true, false)
 	testFunc(t, machine, fnAnd, false, false)
 }
+
+// fakeEvents is just enough of the dr-provision websocket to test
+// reconnecting against.
+type fakeEvents struct {
+	mux        *sync.Mutex
+	conns      []*websocket.Conn
+	noPong     bool
+	registered chan string
+	// hold, if set, holds up acks until it is closed.
+	hold chan struct{}
+}
+
+func (f *fakeEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	up := &websocket.Upgrader{}
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	f.mux.Lock()
+	f.conns = append(f.conns, conn)
+	if f.noPong {
+		conn.SetPingHandler(func(string) error { return nil })
+	}
+	f.mux.Unlock()
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		parts := strings.SplitN(string(msg), " ", 2)
+		f.mux.Lock()
+		hold := f.hold
+		f.mux.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		f.mux.Lock()
+		conn.WriteJSON(&models.Event{Type: "websocket", Action: parts[0], Key: parts[1]})
+		f.mux.Unlock()
+		f.registered <- parts[1]
+	}
+}
+
+func (f *fakeEvents) send(evt *models.Event) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.conns[len(f.conns)-1].WriteJSON(evt)
+}
+
+func (f *fakeEvents) drop() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func TestEventStreamReconnect(t *testing.T) {
+	oldKeepalive := EventStreamKeepalive
+	EventStreamKeepalive = 100 * time.Millisecond
+	defer func() { EventStreamKeepalive = oldKeepalive }()
+	f := &fakeEvents{mux: &sync.Mutex{}, registered: make(chan string, 100)}
+	srv := httptest.NewTLSServer(f)
+	defer srv.Close()
+	c, err := TokenSessionTLS(srv.URL, "token", &TLSOptions{Insecure: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer c.Close()
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, Backoff: []time.Duration{10 * time.Millisecond}})
+	es, err := c.Events()
+	if err != nil {
+		t.Fatalf("Failed to create EventStream: %v", err)
+	}
+	_, ch, err := es.Register("machines.*.*")
+	if err != nil {
+		t.Fatalf("Failed to register: %v", err)
+	}
+	waitReg := func(what string) {
+		t.Helper()
+		select {
+		case reg := <-f.registered:
+			if reg != "machines.*.*" {
+				t.Errorf("Unexpected registration %s", reg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No registration %s", what)
+		}
+	}
+	waitEvt := func(what string) RecievedEvent {
+		t.Helper()
+		select {
+		case evt := <-ch:
+			return evt
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No event %s", what)
+		}
+		return RecievedEvent{}
+	}
+	waitReg("at first")
+	// Pongs should keep the connection going well past the keepalive.
+	time.Sleep(500 * time.Millisecond)
+	f.send(&models.Event{Type: "machines", Action: "update", Key: "a"})
+	if evt := waitEvt("before the drop"); evt.Err != nil || evt.E.Key != "a" {
+		t.Errorf("Unexpected event %#v", evt)
+	}
+	select {
+	case <-f.registered:
+		t.Errorf("Reconnected even though the server answered pings")
+	default:
+	}
+
+	f.drop()
+	waitReg("after the drop")
+	if evt := waitEvt("after the drop"); !evt.IsResync() {
+		t.Errorf("Expected a resync event, got %#v", evt)
+	}
+	f.send(&models.Event{Type: "machines", Action: "update", Key: "b"})
+	if evt := waitEvt("after reconnecting"); evt.Err != nil || evt.E.Key != "b" {
+		t.Errorf("Unexpected event %#v", evt)
+	}
+
+	f.mux.Lock()
+	f.noPong = true
+	f.mux.Unlock()
+	f.drop()
+	waitReg("after the second drop")
+	waitReg("after pongs stopped")
+	f.mux.Lock()
+	f.noPong = false
+	f.mux.Unlock()
+
+	es.Close()
+	for {
+		evt, ok := <-ch
+		if !ok {
+			t.Fatalf("Receiver closed without an error event")
+		}
+		if evt.Err != nil {
+			break
+		}
+		if !evt.IsResync() {
+			t.Errorf("Unexpected event %#v", evt)
+		}
+	}
+}
+
+func TestEventStreamResumeAcks(t *testing.T) {
+	f := &fakeEvents{mux: &sync.Mutex{}, registered: make(chan string, 100)}
+	srv := httptest.NewTLSServer(f)
+	defer srv.Close()
+	c, err := TokenSessionTLS(srv.URL, "token", &TLSOptions{Insecure: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer c.Close()
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, Backoff: []time.Duration{10 * time.Millisecond}})
+	es, err := c.Events()
+	if err != nil {
+		t.Fatalf("Failed to create EventStream: %v", err)
+	}
+	defer es.Close()
+	_, ch, err := es.Register("machines.*.*")
+	if err != nil {
+		t.Fatalf("Failed to register: %v", err)
+	}
+	<-f.registered
+	release := make(chan struct{})
+	f.mux.Lock()
+	f.hold = release
+	f.mux.Unlock()
+	f.drop()
+	// Register while the EventStream is waiting for its own
+	// registration to be acked.
+	done := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _, err := es.Register("profiles.*.*")
+		done <- err
+	}()
+	select {
+	case evt := <-ch:
+		t.Fatalf("Got %#v before the registration was acked", evt)
+	case <-time.After(300 * time.Millisecond):
+	}
+	f.mux.Lock()
+	f.hold = nil
+	f.mux.Unlock()
+	close(release)
+	select {
+	case evt := <-ch:
+		if !evt.IsResync() {
+			t.Errorf("Expected a resync event, got %#v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No resync event")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Failed to register while reconnecting: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Register did not get its ack")
+	}
+	f.send(&models.Event{Type: "machines", Action: "update", Key: "a"})
+	select {
+	case evt := <-ch:
+		if evt.Err != nil || evt.E.Key != "a" {
+			t.Errorf("Unexpected event %#v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event after reconnecting")
+	}
+}
+
+func TestRegisterTyped(t *testing.T) {
+	f := &fakeEvents{mux: &sync.Mutex{}, registered: make(chan string, 100)}
+	srv := httptest.NewTLSServer(f)
+	defer srv.Close()
+	c, err := TokenSessionTLS(srv.URL, "token", &TLSOptions{Insecure: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer c.Close()
+	es, err := c.Events()
+	if err != nil {
+		t.Fatalf("Failed to create EventStream: %v", err)
+	}
+	defer es.Close()
+	handle, ch, err := es.RegisterTyped("machine", EqualItem("Runnable", true))
+	if err != nil {
+		t.Fatalf("Failed to register: %v", err)
+	}
+	if reg := <-f.registered; reg != "machines.*.*" {
+		t.Errorf("Unexpected registration %s", reg)
+	}
+	runnable := &models.Machine{Name: "runnable", Runnable: true}
+	idle := &models.Machine{Name: "idle"}
+	f.send(&models.Event{Type: "machines", Action: "create", Key: "idle", Object: idle})
+	f.send(&models.Event{Type: "machines", Action: "create", Key: "runnable", Object: runnable})
+	f.send(&models.Event{Type: "machines", Action: "update", Key: "runnable", Object: idle, Original: runnable})
+	f.send(&models.Event{Type: "machines", Action: "update", Key: "runnable", Object: "garbage"})
+	next := func() TypedEvent {
+		t.Helper()
+		select {
+		case evt := <-ch:
+			return evt
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No event")
+		}
+		return TypedEvent{}
+	}
+	evt := next()
+	if m, ok := evt.Object.(*models.Machine); evt.Err != nil || !ok || m.Name != "runnable" || evt.Original != nil {
+		t.Errorf("Unexpected create event %#v", evt)
+	}
+	evt = next()
+	if m, ok := evt.Object.(*models.Machine); evt.Err != nil || !ok || m.Runnable {
+		t.Errorf("Unexpected update event %#v", evt)
+	}
+	if m, ok := evt.Original.(*models.Machine); !ok || !m.Runnable {
+		t.Errorf("Update event is missing the original %#v", evt)
+	}
+	if evt = next(); evt.Err == nil {
+		t.Errorf("Expected an event that could not be decoded to have an error")
+	}
+	if err := es.Deregister(handle); err != nil {
+		t.Errorf("Failed to deregister: %v", err)
+	}
+	if _, ok := <-ch; ok {
+		t.Errorf("Channel was not closed by Deregister")
+	}
+}
+
+func TestWaitForAll(t *testing.T) {
+	f := &fakeEvents{mux: &sync.Mutex{}, registered: make(chan string, 100)}
+	machines := map[string]*models.Machine{}
+	items := []models.Model{}
+	for _, name := range []string{"ready", "later", "never"} {
+		m := &models.Machine{Name: name, Uuid: uuid.NewRandom(), Runnable: name == "ready"}
+		m.Fill()
+		machines[m.Key()] = m
+		items = append(items, &models.Machine{Uuid: m.Uuid})
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/v3/ws", f)
+	mux.HandleFunc("/api/v3/machines/", func(w http.ResponseWriter, r *http.Request) {
+		f.mux.Lock()
+		m := machines[strings.TrimPrefix(r.URL.Path, "/api/v3/machines/")]
+		buf, _ := json.Marshal(m)
+		f.mux.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf)
+	})
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+	c, err := TokenSessionTLS(srv.URL, "token", &TLSOptions{Insecure: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer c.Close()
+	es, err := c.Events()
+	if err != nil {
+		t.Fatalf("Failed to create EventStream: %v", err)
+	}
+	defer es.Close()
+	later := items[1].Key()
+	go func() {
+		// Wait for the registrations, then make later runnable.
+		<-f.registered
+		<-f.registered
+		time.Sleep(100 * time.Millisecond)
+		f.mux.Lock()
+		m := machines[later]
+		m.Runnable = true
+		f.mux.Unlock()
+		f.send(&models.Event{Type: "machines", Action: "update", Key: m.Key(), Object: m})
+	}()
+	progress := make(chan WaitResult, 10)
+	res, err := es.WaitForAll(context.Background(), items, EqualItem("Runnable", true), time.Second, 2, progress)
+	if err != nil {
+		t.Fatalf("WaitForAll failed: %v", err)
+	}
+	for i, expect := range []string{"complete", "complete", "timeout"} {
+		if res[i].Status != expect || res[i].Err != nil {
+			t.Errorf("Expected %s to be %s, got %s: %v", machines[items[i].Key()].Name, expect, res[i].Status, res[i].Err)
+		}
+	}
+	if items[1].(*models.Machine).Name != "later" {
+		t.Errorf("Items were not filled in")
+	}
+	order := []string{}
+	for r := range progress {
+		order = append(order, r.Item.(*models.Machine).Name)
+	}
+	if strings.Join(order, ",") != "ready,later,never" {
+		t.Errorf("Unexpected progress %v", order)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err = es.WaitForAll(ctx, items[2:], EqualItem("Runnable", true), time.Minute, 1, nil)
+	if err != nil || res[0].Status != "interrupt" || res[0].Err != context.Canceled {
+		t.Errorf("Expected an interrupt, got %v: %v", res, err)
+	}
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// Endpoints returns the endpoints the Client can fail over between,
+// in the order it will try them.
+func (c *Client) Endpoints() []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	res := make([]string, len(c.endpoints))
+	copy(res, c.endpoints)
+	return res
+}
+
+// SetEndpoints sets the endpoints the Client can fail over between.
+// The Client keeps using its current endpoint until a request to it
+// fails to connect, at which point it tries each of the other
+// endpoints in turn, starting with the one after the current one.
+// The first endpoint that we can authenticate against and get Info
+// from becomes the new current endpoint, and any EventStreams the
+// Client has are reconnected to it.
+//
+// Failover is not possible while the Client is using a local proxy.
+func (c *Client) SetEndpoints(endpoints ...string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.endpoints = make([]string, len(endpoints))
+	copy(c.endpoints, endpoints)
+}
+
+// endpointTransport is the http.RoundTripper a Client makes its
+// requests with.  Certificate checks can depend on the endpoint, so
+// failing over means switching to a new http.Transport, and this lets
+// that happen while other requests are in flight.
+type endpointTransport struct {
+	mux *sync.RWMutex
+	tr  *http.Transport
+}
+
+func newEndpointTransport(tr *http.Transport) *endpointTransport {
+	return &endpointTransport{mux: &sync.RWMutex{}, tr: tr}
+}
+
+func (e *endpointTransport) current() *http.Transport {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.tr
+}
+
+func (e *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return e.current().RoundTrip(req)
+}
+
+func (e *endpointTransport) CloseIdleConnections() {
+	e.current().CloseIdleConnections()
+}
+
+// swap starts using tr, and returns the transport it replaced.
+func (e *endpointTransport) swap(tr *http.Transport) *http.Transport {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	old := e.tr
+	e.tr = tr
+	return old
+}
+
+// probe returns a Client that authenticates the same way c does, but
+// talks only to endpoint over a transport of its own.  That lets
+// endpoint be checked without sending any of c's requests to it.
+func (c *Client) probe(endpoint string) (*Client, *http.Transport, error) {
+	tlsConfig, err := tlsConfigFor(endpoint, c.tlsOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := transport(tlsConfig)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return &Client{
+		Client:     &http.Client{Transport: tr},
+		mux:        &sync.Mutex{},
+		endpoint:   endpoint,
+		username:   c.username,
+		password:   c.password,
+		token:      c.token,
+		closer:     make(chan struct{}, 0),
+		traceLvl:   c.traceLvl,
+		traceToken: c.traceToken,
+		iMux:       &sync.Mutex{},
+		retry:      FailFastPolicy,
+		tlsConfig:  tlsConfig,
+		tlsOpts:    c.tlsOpts,
+		creds:      c.creds,
+		endpoints:  []string{endpoint},
+		foMux:      &sync.Mutex{},
+		streams:    map[*EventStream]struct{}{},
+	}, tr, nil
+}
+
+// checkEndpoint authenticates against the current endpoint again if
+// the Client knows how to, and makes sure it answers Info requests.
+func (c *Client) checkEndpoint(ctx context.Context) error {
+	c.mux.Lock()
+	username, password, hasToken := c.username, c.password, c.token != nil
+	c.mux.Unlock()
+	switch {
+	case c.creds != nil:
+		if _, err := c.refreshCredential(ctx, FailFastPolicy); err != nil {
+			return err
+		}
+	case password != "" && hasToken:
+		basicAuth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		token := &models.UserToken{}
+		if err := c.Req().Context(ctx).FailFast().
+			UrlFor("users", username, "token").
+			Params("ttl", "600").
+			Headers("Authorization", "Basic "+basicAuth).
+			Do(&token); err != nil {
+			return err
+		}
+		c.mux.Lock()
+		c.token = token
+		c.mux.Unlock()
+	}
+	info := &models.Info{}
+	if err := c.Req().Context(ctx).FailFast().UrlFor("info").Do(info); err != nil {
+		return err
+	}
+	c.iMux.Lock()
+	c.info = info
+	c.iMux.Unlock()
+	return nil
+}
+
+// takeOver makes c use the endpoint, transport, credentials, and Info
+// of p, which passed checkEndpoint.
+func (c *Client) takeOver(p *Client, tr *http.Transport) {
+	p.mux.Lock()
+	token, username := p.token, p.username
+	p.mux.Unlock()
+	p.iMux.Lock()
+	info := p.info
+	p.iMux.Unlock()
+	c.mux.Lock()
+	c.endpoint = p.endpoint
+	c.tlsConfig = p.tlsConfig
+	c.token = token
+	c.username = username
+	old := c.rt.swap(tr)
+	c.mux.Unlock()
+	old.CloseIdleConnections()
+	c.iMux.Lock()
+	c.info = info
+	c.iMux.Unlock()
+}
+
+// failover moves the Client off of failed, which could not be
+// reached, and onto the next endpoint that passes checkEndpoint.
+// Each candidate is checked with a probe Client, and the Client only
+// switches once one of them passes, so requests made in the meantime
+// keep going to failed.  If the Client has already moved off of
+// failed, it does nothing.
+func (c *Client) failover(ctx context.Context, failed string) error {
+	c.foMux.Lock()
+	defer c.foMux.Unlock()
+	c.mux.Lock()
+	current, endpoints := c.endpoint, c.endpoints
+	c.mux.Unlock()
+	if current != failed {
+		return nil
+	}
+	if len(endpoints) < 2 || c.rt == nil || locallyProxied() != "" {
+		return fmt.Errorf("No other endpoints to fail over to")
+	}
+	start := -1
+	for i := range endpoints {
+		if endpoints[i] == current {
+			start = i
+			break
+		}
+	}
+	var err error
+	for i := 1; i <= len(endpoints); i++ {
+		candidate := endpoints[(start+i)%len(endpoints)]
+		if candidate == failed {
+			continue
+		}
+		var p *Client
+		var tr *http.Transport
+		if p, tr, err = c.probe(candidate); err != nil {
+			continue
+		}
+		if err = p.checkEndpoint(ctx); err != nil {
+			tr.CloseIdleConnections()
+			continue
+		}
+		c.takeOver(p, tr)
+		c.mux.Lock()
+		streams := make([]*EventStream, 0, len(c.streams))
+		for es := range c.streams {
+			streams = append(streams, es)
+		}
+		c.mux.Unlock()
+		for _, es := range streams {
+			es.moved()
+		}
+		return nil
+	}
+	return fmt.Errorf("Failed to fail over from %s: %v", failed, err)
+}
+
+// rebase points r at the current endpoint of its Client.
+func (r *R) rebase() error {
+	ep, err := url.Parse(r.c.realEndpoint())
+	if err != nil {
+		return err
+	}
+	r.uri.Scheme = ep.Scheme
+	r.uri.Host = ep.Host
+	return nil
+}
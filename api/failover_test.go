@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestFailover(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	})
+	first := httptest.NewTLSServer(handler)
+	second := httptest.NewTLSServer(handler)
+	defer second.Close()
+	c, err := TokenSessionTLS(first.URL, "token", &TLSOptions{Insecure: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer c.Close()
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, Backoff: []time.Duration{10 * time.Millisecond}})
+	info := &models.Info{}
+	if err := c.Req().UrlFor("info").Do(info); err != nil {
+		t.Fatalf("Failed to get info from %s: %v", first.URL, err)
+	}
+	first.Close()
+	if err := c.Req().UrlFor("info").Do(info); err == nil {
+		t.Errorf("Expected request with only one endpoint to fail")
+	}
+	if c.Endpoint() != first.URL {
+		t.Errorf("Endpoint changed to %s without anywhere to fail over to", c.Endpoint())
+	}
+	c.SetEndpoints(first.URL, second.URL)
+	if eps := c.Endpoints(); len(eps) != 2 || eps[1] != second.URL {
+		t.Errorf("Unexpected endpoints %v", eps)
+	}
+	if err := c.Req().UrlFor("info").Do(info); err != nil {
+		t.Errorf("Expected request to fail over to %s: %v", second.URL, err)
+	}
+	if c.Endpoint() != second.URL {
+		t.Errorf("Expected endpoint to be %s, not %s", second.URL, c.Endpoint())
+	}
+	second.Close()
+	if err := c.Req().UrlFor("info").Do(info); err == nil {
+		t.Errorf("Expected request to fail with every endpoint down")
+	}
+	if c.Endpoint() != second.URL {
+		t.Errorf("Failed failover moved the endpoint to %s", c.Endpoint())
+	}
+}
+
+func TestFailoverConcurrent(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	})
+	first := httptest.NewTLSServer(handler)
+	defer first.Close()
+	second := httptest.NewTLSServer(handler)
+	defer second.Close()
+	// bad answers slowly and fails Info, so nothing but the check
+	// should ever be sent to it.
+	var leaked int32
+	bad := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/info" {
+			atomic.AddInt32(&leaked, 1)
+		}
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+	c, err := TokenSessionTLS(first.URL, "token", &TLSOptions{Insecure: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer c.Close()
+	c.SetEndpoints(first.URL, bad.URL, second.URL)
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	var failed int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				res := map[string]interface{}{}
+				if err := c.Req().UrlFor("profiles").Do(&res); err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	// Fail over while the requests are going, as if first had
+	// just stopped answering one of them.
+	time.Sleep(20 * time.Millisecond)
+	if err := c.failover(context.Background(), first.URL); err != nil {
+		t.Errorf("Failover failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	if failed != 0 {
+		t.Errorf("%d requests failed during failover", failed)
+	}
+	if leaked != 0 {
+		t.Errorf("%d requests were sent to an endpoint that failed its check", leaked)
+	}
+	if c.Endpoint() != second.URL {
+		t.Errorf("Expected endpoint to be %s, not %s", second.URL, c.Endpoint())
+	}
+}
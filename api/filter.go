@@ -0,0 +1,749 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/VictorLowther/jsonpatch2/utils"
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// CompileFilter compiles a filter expression into a TestFunc.  The
+// expression is evaluated against the JSON form of whatever the
+// TestFunc is passed, so field names are the ones you see in the
+// output of drpcli.  For example:
+//
+//    Params["gohai-inventory"].CPUs > 8 && Runnable && Stage in ["a", "b"]
+//
+// The language has:
+//
+//   - Fields, which are names like Runnable.  Nested values are
+//     reached with .Name or ["name"], and list elements with [0].
+//     Fields that do not exist are null.
+//   - Literals: numbers, "double quoted" strings with the usual
+//     escapes, 'single quoted' strings without them, true, false,
+//     null, and lists like [1, "a"].
+//   - Comparisons: == and != work on anything; <, <=, >, and >= work
+//     on numbers and strings, and are false when the types differ;
+//     =~ matches a string against a regular expression; in tests
+//     whether the left side is an element of a list, a key of an
+//     object, or a substring of a string.
+//   - !, && and || with the usual precedence, and parentheses.
+//
+// A value on its own is true unless it is null, false, 0, or an
+// empty string, list, or object.
+func CompileFilter(expr string) (TestFunc, error) {
+	p := &filterParser{src: expr}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, p.errorf("unexpected %s", p.toks[p.pos].val)
+	}
+	return func(ref interface{}) (bool, error) {
+		var obj interface{}
+		if err := utils.Remarshal(ref, &obj); err != nil {
+			return false, err
+		}
+		res, err := n.eval(obj)
+		if err != nil {
+			return false, err
+		}
+		return truthy(res), nil
+	}, nil
+}
+
+// MustCompileFilter is CompileFilter that panics if expr is invalid.
+func MustCompileFilter(expr string) TestFunc {
+	res, err := CompileFilter(expr)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+const (
+	tokIdent = iota
+	tokNumber
+	tokString
+	tokOp
+)
+
+type filterTok struct {
+	kind int
+	val  string
+	pos  int
+}
+
+type filterParser struct {
+	src  string
+	toks []filterTok
+	pos  int
+}
+
+func (p *filterParser) errorf(f string, args ...interface{}) error {
+	at := len(p.src)
+	if p.pos < len(p.toks) {
+		at = p.toks[p.pos].pos
+	}
+	return fmt.Errorf("Invalid filter at offset %d: %s", at, fmt.Sprintf(f, args...))
+}
+
+var filterOps = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+func (p *filterParser) lex() error {
+	src := p.src
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			p.toks = append(p.toks, filterTok{kind: tokIdent, val: src[start:i], pos: start})
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1]))):
+			start := i
+			i++
+			for i < len(src) && strings.ContainsRune("0123456789.eE+-", rune(src[i])) {
+				if (src[i] == '+' || src[i] == '-') && src[i-1] != 'e' && src[i-1] != 'E' {
+					break
+				}
+				i++
+			}
+			p.toks = append(p.toks, filterTok{kind: tokNumber, val: src[start:i], pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			for i < len(src) && rune(src[i]) != c {
+				if c == '"' && src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return fmt.Errorf("Invalid filter at offset %d: unterminated string", start)
+			}
+			i++
+			val := src[start+1 : i-1]
+			if c == '"' {
+				var err error
+				if val, err = strconv.Unquote(src[start:i]); err != nil {
+					return fmt.Errorf("Invalid filter at offset %d: bad string %s", start, src[start:i])
+				}
+			}
+			p.toks = append(p.toks, filterTok{kind: tokString, val: val, pos: start})
+		default:
+			found := false
+			for _, op := range filterOps {
+				if strings.HasPrefix(src[i:], op) {
+					p.toks = append(p.toks, filterTok{kind: tokOp, val: op, pos: i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("Invalid filter at offset %d: unexpected %q", i, c)
+			}
+		}
+	}
+	return nil
+}
+
+// accept consumes the next token if it is the operator or keyword val.
+func (p *filterParser) accept(val string) bool {
+	if p.pos < len(p.toks) && p.toks[p.pos].val == val && p.toks[p.pos].kind != tokString {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(val string) error {
+	if !p.accept(val) {
+		if p.pos == len(p.toks) {
+			return p.errorf("expected %s, got end of filter", val)
+		}
+		return p.errorf("expected %s, got %s", val, p.toks[p.pos].val)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogic{and: false, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogic{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.accept("!") {
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{n}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *filterParser) parseCmp() (filterNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "=~", "in"} {
+		if !p.accept(op) {
+			continue
+		}
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		res := &filterCmp{op: op, left: left, right: right}
+		if op == "=~" {
+			if lit, ok := right.(filterLit); ok {
+				s, ok := lit.val.(string)
+				if !ok {
+					return nil, p.errorf("=~ needs a string regular expression")
+				}
+				if res.re, err = regexp.Compile(s); err != nil {
+					return nil, p.errorf("bad regular expression: %v", err)
+				}
+			}
+		}
+		return res, nil
+	}
+	return left, nil
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	if p.pos == len(p.toks) {
+		return nil, p.errorf("unexpected end of filter")
+	}
+	tok := p.toks[p.pos]
+	switch tok.kind {
+	case tokNumber:
+		p.pos++
+		f, err := strconv.ParseFloat(tok.val, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %s", tok.val)
+		}
+		return filterLit{f}, nil
+	case tokString:
+		p.pos++
+		return filterLit{tok.val}, nil
+	case tokIdent:
+		p.pos++
+		switch tok.val {
+		case "true":
+			return filterLit{true}, nil
+		case "false":
+			return filterLit{false}, nil
+		case "null":
+			return filterLit{nil}, nil
+		case "in":
+			return nil, p.errorf("unexpected in")
+		}
+		return p.parsePath(&filterPath{elems: []filterNode{filterLit{tok.val}}})
+	}
+	switch {
+	case p.accept("("):
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case p.accept("["):
+		res := filterList{}
+		if p.accept("]") {
+			return res, nil
+		}
+		for {
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, n)
+			if p.accept("]") {
+				return res, nil
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, p.errorf("unexpected %s", tok.val)
+}
+
+func (p *filterParser) parsePath(res *filterPath) (filterNode, error) {
+	for {
+		switch {
+		case p.accept("."):
+			if p.pos == len(p.toks) || p.toks[p.pos].kind != tokIdent {
+				return nil, p.errorf("expected a field name after .")
+			}
+			res.elems = append(res.elems, filterLit{p.toks[p.pos].val})
+			p.pos++
+		case p.accept("["):
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			res.elems = append(res.elems, n)
+		default:
+			return res, nil
+		}
+	}
+}
+
+type filterNode interface {
+	eval(obj interface{}) (interface{}, error)
+}
+
+type filterLit struct {
+	val interface{}
+}
+
+func (l filterLit) eval(interface{}) (interface{}, error) {
+	return l.val, nil
+}
+
+type filterList []filterNode
+
+func (l filterList) eval(obj interface{}) (interface{}, error) {
+	res := make([]interface{}, len(l))
+	for i := range l {
+		v, err := l[i].eval(obj)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = v
+	}
+	return res, nil
+}
+
+type filterPath struct {
+	elems []filterNode
+}
+
+func (f *filterPath) eval(obj interface{}) (interface{}, error) {
+	cur := obj
+	for _, elem := range f.elems {
+		idx, err := elem.eval(obj)
+		if err != nil {
+			return nil, err
+		}
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			s, ok := idx.(string)
+			if !ok {
+				return nil, nil
+			}
+			cur = v[s]
+		case []interface{}:
+			n, ok := idx.(float64)
+			if !ok || n < 0 || int(n) >= len(v) || float64(int(n)) != n {
+				return nil, nil
+			}
+			cur = v[int(n)]
+		default:
+			return nil, nil
+		}
+	}
+	return cur, nil
+}
+
+type filterNot struct {
+	n filterNode
+}
+
+func (f *filterNot) eval(obj interface{}) (interface{}, error) {
+	v, err := f.n.eval(obj)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(v), nil
+}
+
+type filterLogic struct {
+	and         bool
+	left, right filterNode
+}
+
+func (f *filterLogic) eval(obj interface{}) (interface{}, error) {
+	l, err := f.left.eval(obj)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(l) != f.and {
+		// false && x, or true || x
+		return !f.and, nil
+	}
+	r, err := f.right.eval(obj)
+	if err != nil {
+		return nil, err
+	}
+	return truthy(r), nil
+}
+
+type filterCmp struct {
+	op          string
+	left, right filterNode
+	re          *regexp.Regexp
+}
+
+func (f *filterCmp) eval(obj interface{}) (interface{}, error) {
+	l, err := f.left.eval(obj)
+	if err != nil {
+		return nil, err
+	}
+	r, err := f.right.eval(obj)
+	if err != nil {
+		return nil, err
+	}
+	switch f.op {
+	case "==":
+		return reflect.DeepEqual(l, r), nil
+	case "!=":
+		return !reflect.DeepEqual(l, r), nil
+	case "=~":
+		s, ok := l.(string)
+		if !ok {
+			return false, nil
+		}
+		re := f.re
+		if re == nil {
+			pat, ok := r.(string)
+			if !ok {
+				return nil, fmt.Errorf("=~ needs a string regular expression, not %v", r)
+			}
+			if re, err = regexp.Compile(pat); err != nil {
+				return nil, err
+			}
+		}
+		return re.MatchString(s), nil
+	case "in":
+		switch v := r.(type) {
+		case []interface{}:
+			for i := range v {
+				if reflect.DeepEqual(l, v[i]) {
+					return true, nil
+				}
+			}
+		case map[string]interface{}:
+			if s, ok := l.(string); ok {
+				_, found := v[s]
+				return found, nil
+			}
+		case string:
+			if s, ok := l.(string); ok {
+				return strings.Contains(v, s), nil
+			}
+		}
+		return false, nil
+	}
+	var cmp int
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return false, nil
+		}
+		switch {
+		case lv < rv:
+			cmp = -1
+		case lv > rv:
+			cmp = 1
+		}
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return false, nil
+		}
+		cmp = strings.Compare(lv, rv)
+	default:
+		return false, nil
+	}
+	switch f.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+func truthy(v interface{}) bool {
+	switch val := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return val
+	case float64:
+		return val != 0
+	case string:
+		return val != ""
+	case []interface{}:
+		return len(val) > 0
+	case map[string]interface{}:
+		return len(val) > 0
+	}
+	return true
+}
+
+var listFilterOp = regexp.MustCompile(`^(Eq|Lt|Lte|Gt|Gte|Ne|In|Nin|Re|Between|Except)\((.*)\)$`)
+
+// errNotLocal is returned when an index filter cannot be checked
+// without asking the server.
+var errNotLocal = errors.New("filter cannot be checked locally")
+
+// indexField returns the value that index has for obj, as it would
+// look decoded from JSON.  Fields are looked up on the object itself
+// rather than in its JSON so that ones left out by omitempty still
+// have their zero value, just like they do on the server.  Filters
+// that are not on a field are on the param with the same name, if
+// known says the server does not have an index by that name.  Indexes
+// that are not named after a field cannot be checked locally.
+func indexField(obj interface{}, index string, known bool) (interface{}, error) {
+	var val interface{}
+	if m, ok := obj.(models.Model); ok && index == "Key" {
+		val = m.Key()
+	} else if v := reflect.Indirect(reflect.ValueOf(obj)); v.Kind() == reflect.Struct {
+		if f := v.FieldByName(index); f.IsValid() && f.CanInterface() {
+			val = f.Interface()
+		} else if p, ok := obj.(models.Paramer); ok && !known {
+			val = p.GetParams()[index]
+		} else {
+			return nil, errNotLocal
+		}
+	} else {
+		fields := map[string]interface{}{}
+		if err := utils.Remarshal(obj, &fields); err != nil {
+			return nil, err
+		}
+		val = fields[index]
+		if params, ok := fields["Params"].(map[string]interface{}); ok && val == nil {
+			val = params[index]
+		}
+	}
+	var res interface{}
+	return res, utils.Remarshal(val, &res)
+}
+
+// indexType guesses the type of an index the server did not tell us
+// about from the value it has.
+func indexType(field interface{}) string {
+	switch field.(type) {
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "string"
+}
+
+// compareIndex compares the value of a field to s the way the server
+// compares values for an index of type typ, and returns -1, 0, or 1.
+func compareIndex(typ string, field interface{}, s string) (int, error) {
+	str, _ := field.(string)
+	switch typ {
+	case "string":
+		return strings.Compare(str, s), nil
+	case "UUID string":
+		return strings.Compare(strings.ToLower(str), strings.ToLower(s)), nil
+	case "boolean":
+		b, _ := field.(bool)
+		want, err := strconv.ParseBool(s)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case b == want:
+			return 0, nil
+		case want:
+			return -1, nil
+		}
+		return 1, nil
+	case "number":
+		f, _ := field.(float64)
+		want, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case f < want:
+			return -1, nil
+		case f > want:
+			return 1, nil
+		}
+		return 0, nil
+	case "IP Address":
+		want := net.ParseIP(s)
+		if want == nil {
+			return 0, fmt.Errorf("Invalid IP address %s", s)
+		}
+		return bytes.Compare(net.ParseIP(str).To16(), want.To16()), nil
+	case "dateTime", "Date/Time string":
+		want, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return 0, err
+		}
+		t, _ := time.Parse(time.RFC3339, str)
+		switch {
+		case t.Before(want):
+			return -1, nil
+		case t.After(want):
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, errNotLocal
+}
+
+// compileListFilters compiles the index filters that ListModel takes
+// as params into a TestFunc, so that objects can be checked against
+// them without asking the server.  indexes are the indexes the server
+// has for the objects, and are used to compare values the same way
+// the server does.  Filters on params and on indexes that are not in
+// indexes are compared based on the value they are checked against.
+//
+// Params that only change what the server sends back, like slim or
+// sort, are ignored.  limit and offset depend on the rest of the
+// objects, so they cannot be checked and are an error.  Filters on
+// list and CIDR indexes, or on indexes that are not named after a
+// field, are not evaluated locally, and the TestFunc returns
+// errNotLocal for objects they have to be checked against.
+func compileListFilters(indexes map[string]models.Index, params ...string) (TestFunc, error) {
+	if len(params)%2 != 0 {
+		return nil, fmt.Errorf("List filters must be index and value pairs")
+	}
+	tests := []func(interface{}) (bool, error){}
+	for i := 0; i < len(params); i += 2 {
+		index, val := params[i], params[i+1]
+		switch index {
+		case "slim", "params", "sort", "reverse", "decode", "aggregate":
+			continue
+		case "limit", "offset":
+			return nil, fmt.Errorf("%s cannot be checked locally", index)
+		}
+		op, arg := "Eq", val
+		if m := listFilterOp.FindStringSubmatch(val); m != nil {
+			op, arg = m[1], m[2]
+		}
+		var re *regexp.Regexp
+		if op == "Re" {
+			var err error
+			if re, err = regexp.Compile(arg); err != nil {
+				return nil, fmt.Errorf("Invalid regular expression for %s: %v", index, err)
+			}
+		}
+		args := strings.Split(arg, ",")
+		if (op == "Between" || op == "Except") && len(args) != 2 {
+			return nil, fmt.Errorf("%s for %s needs 2 values", op, index)
+		}
+		idx, known := indexes[index]
+		tests = append(tests, func(obj interface{}) (bool, error) {
+			field, err := indexField(obj, index, known)
+			if err != nil {
+				return false, err
+			}
+			typ := idx.Type
+			if !known {
+				typ = indexType(field)
+			}
+			if op == "Re" {
+				if _, err := compareIndex(typ, field, ""); err == errNotLocal {
+					return false, err
+				}
+				s, ok := field.(string)
+				return ok && re.MatchString(s), nil
+			}
+			cmps := make([]int, len(args))
+			for i := range args {
+				if cmps[i], err = compareIndex(typ, field, args[i]); err != nil {
+					return false, err
+				}
+			}
+			switch op {
+			case "Eq":
+				return cmps[0] == 0, nil
+			case "Ne":
+				return cmps[0] != 0, nil
+			case "Lt":
+				return cmps[0] < 0, nil
+			case "Lte":
+				return cmps[0] <= 0, nil
+			case "Gt":
+				return cmps[0] > 0, nil
+			case "Gte":
+				return cmps[0] >= 0, nil
+			case "Between":
+				return cmps[0] >= 0 && cmps[1] <= 0, nil
+			case "Except":
+				return !(cmps[0] >= 0 && cmps[1] <= 0), nil
+			}
+			found := false
+			for _, cmp := range cmps {
+				if cmp == 0 {
+					found = true
+					break
+				}
+			}
+			return found == (op == "In"), nil
+		})
+	}
+	return func(ref interface{}) (bool, error) {
+		for _, test := range tests {
+			if ok, err := test(ref); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}, nil
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"net"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/pborman/uuid"
+)
+
+func TestCompileFilter(t *testing.T) {
+	machine := &models.Machine{
+		Name:     "m1",
+		Runnable: true,
+		Stage:    "a",
+		Tasks:    []string{"t1", "t2"},
+		Params: map[string]interface{}{
+			"gohai-inventory": map[string]interface{}{"CPUs": 16},
+			"tags":            []string{"x", "y"},
+		},
+	}
+	for _, tc := range []struct {
+		expr   string
+		result bool
+	}{
+		{`Runnable`, true},
+		{`!Runnable`, false},
+		{`Name == "m1"`, true},
+		{`Name != 'm1'`, false},
+		{`Params["gohai-inventory"].CPUs > 8`, true},
+		{`Params["gohai-inventory"].CPUs <= 8`, false},
+		{`Params["gohai-inventory"].CPUs > 8 && Runnable && Stage in ["a", "b"]`, true},
+		{`Stage in ["b", "c"] || Tasks[1] == "t2"`, true},
+		{`Stage in ["b", "c"] || (Tasks[0] == "t2" && Runnable)`, false},
+		{`"t1" in Tasks && "tags" in Params && "1" in Name`, true},
+		{`Params.tags[5]`, false},
+		{`Params.missing == null`, true},
+		{`Params.missing.deeper`, false},
+		{`Name =~ "^m[0-9]+$"`, true},
+		{`Name =~ Stage`, false},
+		{`Name < "n" && Name >= "m1"`, true},
+		{`Name > 3`, false},
+		{`CurrentTask == -1 || CurrentTask == 0`, true},
+		{`Tasks == ["t1", "t2"]`, true},
+		{`Tasks && !Params.missing`, true},
+	} {
+		fn, err := CompileFilter(tc.expr)
+		if err != nil {
+			t.Errorf("Failed to compile %s: %v", tc.expr, err)
+			continue
+		}
+		testFunc(t, machine, fn, tc.result, false)
+		if t.Failed() {
+			t.Logf("Filter was %s", tc.expr)
+			return
+		}
+	}
+	for _, bad := range []string{
+		``,
+		`Name ==`,
+		`Name == "unterminated`,
+		`(Runnable`,
+		`Stage in ["a",]`,
+		`Name =~ "("`,
+		`Name =~ 3`,
+		`Runnable Name`,
+		`Name.`,
+		`Name # 3`,
+	} {
+		if _, err := CompileFilter(bad); err == nil {
+			t.Errorf("Expected %q to fail to compile", bad)
+		}
+	}
+}
+
+func TestCompileListFilters(t *testing.T) {
+	machine := &models.Machine{
+		Name:        "m1",
+		Runnable:    true,
+		Stage:       "a",
+		CurrentTask: 3,
+		Address:     net.ParseIP("192.168.1.10"),
+		Uuid:        uuid.Parse("3f8d2a50-1c2b-4e5f-9a7b-6c5d4e3f2a1b"),
+		Profiles:    []string{"p1"},
+		Params: map[string]interface{}{
+			"rack": "r12",
+		},
+	}
+	indexes := map[string]models.Index{
+		"Name":        {Type: "string"},
+		"Description": {Type: "string"},
+		"Runnable":    {Type: "boolean"},
+		"Locked":      {Type: "boolean"},
+		"Address":     {Type: "IP Address"},
+		"Uuid":        {Type: "UUID string"},
+		"Profiles":    {Type: "list"},
+	}
+	for _, tc := range []struct {
+		filters []string
+		result  bool
+	}{
+		{nil, true},
+		{[]string{"Name", "m1"}, true},
+		{[]string{"Name", "m2"}, false},
+		{[]string{"Name", "Eq(m1)", "Runnable", "true"}, true},
+		{[]string{"Name", "m1", "Runnable", "false"}, false},
+		{[]string{"Name", "Ne(m1)"}, false},
+		{[]string{"CurrentTask", "Gt(2)"}, true},
+		{[]string{"CurrentTask", "Lte(2)"}, false},
+		{[]string{"CurrentTask", "Between(1,3)"}, true},
+		{[]string{"CurrentTask", "Except(1,3)"}, false},
+		{[]string{"Stage", "In(a,b)"}, true},
+		{[]string{"Stage", "Nin(a,b)"}, false},
+		{[]string{"Name", "Re(^m[0-9]+$)"}, true},
+		{[]string{"rack", "r12"}, true},
+		{[]string{"rack", "Gte(r2)"}, false},
+		{[]string{"Name", "m1", "slim", "Params", "sort", "Name"}, true},
+		{[]string{"Description", ""}, true},
+		{[]string{"Locked", "false"}, true},
+		{[]string{"Locked", "Ne(false)"}, false},
+		{[]string{"Address", "192.168.1.10"}, true},
+		{[]string{"Address", "Gt(192.168.1.9)"}, true},
+		{[]string{"Address", "Between(192.168.1.2,192.168.1.100)"}, true},
+		{[]string{"Address", "Lt(192.168.1.9)"}, false},
+		{[]string{"Uuid", "3F8D2A50-1C2B-4E5F-9A7B-6C5D4E3F2A1B"}, true},
+		{[]string{"Key", "3f8d2a50-1c2b-4e5f-9a7b-6c5d4e3f2a1b"}, true},
+	} {
+		fn, err := compileListFilters(indexes, tc.filters...)
+		if err != nil {
+			t.Errorf("Failed to compile %v: %v", tc.filters, err)
+			continue
+		}
+		testFunc(t, machine, fn, tc.result, false)
+		if t.Failed() {
+			t.Logf("Filters were %v", tc.filters)
+			return
+		}
+	}
+	for _, bad := range [][]string{
+		{"Name"},
+		{"limit", "10"},
+		{"offset", "10"},
+		{"Name", "Re(()"},
+		{"CurrentTask", "Between(1)"},
+	} {
+		if _, err := compileListFilters(nil, bad...); err == nil {
+			t.Errorf("Expected %v to fail to compile", bad)
+		}
+	}
+	fn, _ := compileListFilters(indexes, "Profiles", "p1")
+	if _, err := fn(machine); err != errNotLocal {
+		t.Errorf("Expected a list index to need the server, got %v", err)
+	}
+	fn, _ = compileListFilters(indexes, "Address", "not-an-ip")
+	testFunc(t, machine, fn, false, true)
+}
@@ -0,0 +1,446 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+// DefaultInformerResync is how often an Informer lists everything
+// again to catch anything its EventStream missed.
+var DefaultInformerResync = 10 * time.Minute
+
+// IndexFunc returns the values an object should be found under in an
+// Informer index.
+type IndexFunc func(models.Model) []string
+
+// Informer keeps a local copy of every object of one type that
+// matches a set of filters.  It lists the objects once, and then
+// keeps the copy up to date by watching for events about them,
+// listing everything again every Resync to catch anything the events
+// missed.
+//
+// Objects handed out by an Informer are shared with its cache and
+// with every handler, and must not be modified.  Clone them first if
+// you need to change them.
+type Informer struct {
+	// Resync is how often to list everything again.  It defaults to
+	// DefaultInformerResync, and 0 turns resyncing off.
+	Resync   time.Duration
+	client   *Client
+	prefix   string
+	filters  []string
+	test     TestFunc
+	testErr  error
+	mux      *sync.RWMutex
+	items    map[string]models.Model
+	indexers map[string]IndexFunc
+	indexes  map[string]map[string]map[string]struct{}
+	onAdd    []func(models.Model)
+	onUpdate []func(old, new models.Model)
+	onDelete []func(models.Model)
+	synced   chan struct{}
+	syncOnce *sync.Once
+}
+
+// Informer creates an Informer for the objects of type prefix that
+// match filters.  The filters are the same index filters ListModel
+// takes.  The server applies them when listing, and objects from
+// events are checked against them locally, using the index types the
+// server reports.  Filters on list and CIDR indexes, and on indexes
+// not named after a field, cannot be checked that way, so events for
+// objects they have to be checked against are checked by the server.  limit and offset cannot be checked at
+// all, and make Start fail.  Nothing happens until Start is called.
+func (c *Client) Informer(prefix string, filters ...string) *Informer {
+	res := &Informer{
+		Resync:   DefaultInformerResync,
+		client:   c,
+		prefix:   prefix,
+		filters:  make([]string, len(filters)),
+		mux:      &sync.RWMutex{},
+		items:    map[string]models.Model{},
+		indexers: map[string]IndexFunc{},
+		indexes:  map[string]map[string]map[string]struct{}{},
+		synced:   make(chan struct{}),
+		syncOnce: &sync.Once{},
+	}
+	copy(res.filters, filters)
+	res.test, res.testErr = compileListFilters(nil, res.filters...)
+	return res
+}
+
+// OnAdd arranges for f to be called with every object that shows up
+// in the Informer, including the ones found when it starts.
+func (i *Informer) OnAdd(f func(models.Model)) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	i.onAdd = append(i.onAdd, f)
+}
+
+// OnUpdate arranges for f to be called whenever an object in the
+// Informer changes.
+func (i *Informer) OnUpdate(f func(old, new models.Model)) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	i.onUpdate = append(i.onUpdate, f)
+}
+
+// OnDelete arranges for f to be called with the last known copy of
+// every object that goes away or stops matching the filters.
+func (i *Informer) OnDelete(f func(models.Model)) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	i.onDelete = append(i.onDelete, f)
+}
+
+// AddIndex adds an index named name that files every object under
+// the values f returns for it.  Objects already in the Informer are
+// indexed right away.
+func (i *Informer) AddIndex(name string, f IndexFunc) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	if _, ok := i.indexers[name]; ok {
+		return fmt.Errorf("Index %s already exists", name)
+	}
+	i.indexers[name] = f
+	i.indexes[name] = map[string]map[string]struct{}{}
+	for key, obj := range i.items {
+		i.index(name, key, obj)
+	}
+	return nil
+}
+
+func (i *Informer) index(name, key string, obj models.Model) {
+	idx := i.indexes[name]
+	for _, val := range i.indexers[name](obj) {
+		if idx[val] == nil {
+			idx[val] = map[string]struct{}{}
+		}
+		idx[val][key] = struct{}{}
+	}
+}
+
+func (i *Informer) unindex(name, key string, obj models.Model) {
+	idx := i.indexes[name]
+	for _, val := range i.indexers[name](obj) {
+		delete(idx[val], key)
+		if len(idx[val]) == 0 {
+			delete(idx, val)
+		}
+	}
+}
+
+// Get returns the object with key, if the Informer has it.
+func (i *Informer) Get(key string) (models.Model, bool) {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	res, ok := i.items[key]
+	return res, ok
+}
+
+// sorted returns the objects with keys, sorted by key.
+func (i *Informer) sorted(keys []string) []models.Model {
+	sort.Strings(keys)
+	res := make([]models.Model, len(keys))
+	for idx, key := range keys {
+		res[idx] = i.items[key]
+	}
+	return res
+}
+
+// List returns every object in the Informer, sorted by key.
+func (i *Informer) List() []models.Model {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	keys := make([]string, 0, len(i.items))
+	for key := range i.items {
+		keys = append(keys, key)
+	}
+	return i.sorted(keys)
+}
+
+// ByIndex returns the objects filed under val in the index named
+// name, sorted by key.
+func (i *Informer) ByIndex(name, val string) ([]models.Model, error) {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	idx, ok := i.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("No such index %s", name)
+	}
+	keys := make([]string, 0, len(idx[val]))
+	for key := range idx[val] {
+		keys = append(keys, key)
+	}
+	return i.sorted(keys), nil
+}
+
+// IndexValues returns every value in the index named name, sorted.
+func (i *Informer) IndexValues(name string) ([]string, error) {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	idx, ok := i.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("No such index %s", name)
+	}
+	res := make([]string, 0, len(idx))
+	for val := range idx {
+		res = append(res, val)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Synced returns a channel that is closed once the Informer has
+// finished its first list.
+func (i *Informer) Synced() <-chan struct{} {
+	return i.synced
+}
+
+// store puts obj in the cache and calls the handlers for whatever
+// changed.
+func (i *Informer) store(obj models.Model) {
+	key := obj.Key()
+	i.mux.Lock()
+	old, ok := i.items[key]
+	if ok && reflect.DeepEqual(old, obj) {
+		i.mux.Unlock()
+		return
+	}
+	for name := range i.indexers {
+		if ok {
+			i.unindex(name, key, old)
+		}
+		i.index(name, key, obj)
+	}
+	i.items[key] = obj
+	onAdd, onUpdate := i.onAdd, i.onUpdate
+	i.mux.Unlock()
+	if !ok {
+		for _, f := range onAdd {
+			f(obj)
+		}
+		return
+	}
+	for _, f := range onUpdate {
+		f(old, obj)
+	}
+}
+
+// remove takes the object with key out of the cache.
+func (i *Informer) remove(key string) {
+	i.mux.Lock()
+	old, ok := i.items[key]
+	if !ok {
+		i.mux.Unlock()
+		return
+	}
+	for name := range i.indexers {
+		i.unindex(name, key, old)
+	}
+	delete(i.items, key)
+	onDelete := i.onDelete
+	i.mux.Unlock()
+	for _, f := range onDelete {
+		f(old)
+	}
+}
+
+// resync lists everything and brings the cache in line with it.
+func (i *Informer) resync(ctx context.Context) error {
+	objs, err := i.client.ListModelCtx(ctx, i.prefix, i.filters...)
+	if err != nil {
+		return err
+	}
+	seen := map[string]struct{}{}
+	for _, obj := range objs {
+		seen[obj.Key()] = struct{}{}
+		i.store(obj)
+	}
+	i.mux.RLock()
+	gone := []string{}
+	for key := range i.items {
+		if _, ok := seen[key]; !ok {
+			gone = append(gone, key)
+		}
+	}
+	i.mux.RUnlock()
+	for _, key := range gone {
+		i.remove(key)
+	}
+	i.syncOnce.Do(func() { close(i.synced) })
+	return nil
+}
+
+// compile fetches the indexes for the Informer's objects and
+// compiles the filters using them.
+func (i *Informer) compile(ctx context.Context) error {
+	if len(i.filters) == 0 {
+		return nil
+	}
+	indexes := map[string]models.Index{}
+	if err := i.client.Req().Context(ctx).UrlFor("indexes", i.prefix).Do(&indexes); err != nil {
+		return err
+	}
+	test, err := compileListFilters(indexes, i.filters...)
+	if err != nil {
+		return err
+	}
+	i.mux.Lock()
+	i.test = test
+	i.mux.Unlock()
+	return nil
+}
+
+// matches returns whether obj passes the filters.  They are checked
+// locally if possible, and by the server if not.
+func (i *Informer) matches(ctx context.Context, obj models.Model) (bool, error) {
+	i.mux.RLock()
+	test := i.test
+	i.mux.RUnlock()
+	ok, err := test(obj)
+	if err != errNotLocal {
+		return ok, err
+	}
+	params := append(append([]string{}, i.filters...), obj.KeyName(), obj.Key())
+	objs, err := i.client.ListModelCtx(ctx, i.prefix, params...)
+	if err != nil {
+		return false, err
+	}
+	return len(objs) > 0, nil
+}
+
+// handle applies an event to the cache.  If it cannot tell whether
+// the object still matches the filters, it is dropped from the cache
+// so that nothing stale is handed out, and it comes back with the
+// next resync if it should be there.
+func (i *Informer) handle(ctx context.Context, evt *models.Event) error {
+	switch evt.Action {
+	case "delete":
+		i.remove(evt.Key)
+		return nil
+	case "create", "save", "update":
+	default:
+		return nil
+	}
+	obj, err := evt.Model()
+	if err != nil {
+		return err
+	}
+	ok, err := i.matches(ctx, obj)
+	if err != nil {
+		i.remove(obj.Key())
+		return err
+	}
+	if ok {
+		i.store(obj)
+	} else {
+		i.remove(obj.Key())
+	}
+	return nil
+}
+
+// watch lists everything and then follows events until ctx is done
+// or the EventStream fails.
+func (i *Informer) watch(ctx context.Context) error {
+	es, err := i.client.EventsCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer es.Close()
+	// Register before listing so that nothing can change unseen in
+	// between.
+	handle, ch, err := es.Register(i.prefix + ".*.*")
+	if err != nil {
+		return err
+	}
+	defer es.Deregister(handle)
+	if err := i.compile(ctx); err != nil {
+		return err
+	}
+	if err := i.resync(ctx); err != nil {
+		return err
+	}
+	var tick <-chan time.Time
+	if i.Resync > 0 {
+		ticker := time.NewTicker(i.Resync)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick:
+			if err := i.resync(ctx); err != nil {
+				return err
+			}
+		case evt, ok := <-ch:
+			if !ok {
+				return fmt.Errorf("EventStream closed")
+			}
+			if evt.Err != nil {
+				return evt.Err
+			}
+			if evt.IsResync() {
+				if err := i.resync(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := i.handle(ctx, &evt.E); err != nil {
+				log.Printf("Informer for %s failed to handle %s.%s.%s: %v",
+					i.prefix, evt.E.Type, evt.E.Action, evt.E.Key, err)
+			}
+		}
+	}
+}
+
+// Start fills the Informer and keeps it up to date in the background
+// until ctx is done.  It returns once the first list has finished,
+// or with an error if it could not be done.  If the connection to the
+// server is lost later on, the Informer keeps trying to get it back
+// and resyncs once it does.
+func (i *Informer) Start(ctx context.Context) error {
+	if i.testErr != nil {
+		return i.testErr
+	}
+	firstErr := make(chan error, 1)
+	go func() {
+		first := true
+		for attempt := 1; ; attempt++ {
+			err := i.watch(ctx)
+			if ctx.Err() != nil {
+				if first {
+					firstErr <- ctx.Err()
+				}
+				return
+			}
+			if first {
+				select {
+				case <-i.synced:
+					first = false
+				default:
+					firstErr <- err
+					return
+				}
+			}
+			log.Printf("Informer for %s lost its EventStream: %v", i.prefix, err)
+			if sleepCtx(ctx, DefaultRetryPolicy.wait(attempt)) != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-i.synced:
+		return nil
+	case err := <-firstErr:
+		return err
+	}
+}
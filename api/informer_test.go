@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/v4/models"
+	"github.com/pborman/uuid"
+)
+
+func TestInformer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inf := session.Informer("users")
+	if err := inf.AddIndex("Description", func(m models.Model) []string {
+		return []string{m.(*models.User).Description}
+	}); err != nil {
+		t.Fatalf("Failed to add index: %v", err)
+	}
+	added := make(chan string, 10)
+	updated := make(chan string, 10)
+	deleted := make(chan string, 10)
+	inf.OnAdd(func(m models.Model) { added <- m.Key() })
+	inf.OnUpdate(func(old, m models.Model) { updated <- m.Key() })
+	inf.OnDelete(func(m models.Model) { deleted <- m.Key() })
+	if err := inf.Start(ctx); err != nil {
+		t.Fatalf("Failed to start Informer: %v", err)
+	}
+	if _, ok := inf.Get("rocketskates"); !ok {
+		t.Errorf("Informer did not list rocketskates")
+	}
+	wait := func(ch chan string, key, what string) {
+		t.Helper()
+		for {
+			select {
+			case got := <-ch:
+				if got == key {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Informer did not see %s %s", key, what)
+			}
+		}
+	}
+	wait(added, "rocketskates", "added")
+
+	user := &models.User{Name: "informer"}
+	user.Fill()
+	user.Description = "before"
+	if err := session.CreateModel(user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	wait(added, "informer", "added")
+	if got, err := inf.ByIndex("Description", "before"); err != nil || len(got) != 1 || got[0].Key() != "informer" {
+		t.Errorf("Expected to find informer by Description, got %v: %v", got, err)
+	}
+	if _, err := inf.ByIndex("Missing", ""); err == nil {
+		t.Errorf("Expected a missing index to fail")
+	}
+	patched := models.Clone(user).(*models.User)
+	patched.Description = "after"
+	if _, err := session.PatchTo(user, patched); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	wait(updated, "informer", "updated")
+	if got, _ := inf.ByIndex("Description", "before"); len(got) != 0 {
+		t.Errorf("Old index value was not removed: %v", got)
+	}
+	if got, _ := inf.ByIndex("Description", "after"); len(got) != 1 {
+		t.Errorf("New index value was not added: %v", got)
+	}
+	if _, err := session.DeleteModel("users", "informer"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+	wait(deleted, "informer", "deleted")
+	if _, ok := inf.Get("informer"); ok {
+		t.Errorf("Deleted user is still in the Informer")
+	}
+	for _, m := range inf.List() {
+		if m.Key() == "informer" {
+			t.Errorf("Deleted user is still listed")
+		}
+	}
+}
+
+func TestInformerFilters(t *testing.T) {
+	// The Client has nowhere to send requests, so events can only be
+	// handled if the filters are checked locally.
+	inf := (&Client{}).Informer("machines", "Stage", "In(a,b)")
+	uuids := map[string]uuid.UUID{}
+	event := func(action, name, stage string) *models.Event {
+		if uuids[name] == nil {
+			uuids[name] = uuid.NewRandom()
+		}
+		m := &models.Machine{Name: name, Uuid: uuids[name], Stage: stage}
+		m.Fill()
+		return models.EventFor(m, action)
+	}
+	for _, evt := range []*models.Event{
+		event("create", "m1", "a"),
+		event("create", "m2", "c"),
+		event("create", "m3", "b"),
+		event("update", "m3", "c"),
+	} {
+		if err := inf.handle(context.Background(), evt); err != nil {
+			t.Fatalf("Failed to handle %s %s: %v", evt.Action, evt.Key, err)
+		}
+	}
+	got := inf.List()
+	if len(got) != 1 || got[0].(*models.Machine).Name != "m1" {
+		t.Errorf("Expected only m1 in the Informer, got %v", got)
+	}
+	if err := (&Client{}).Informer("machines", "limit", "10").Start(context.Background()); err == nil {
+		t.Errorf("Expected an Informer with a limit to fail to start")
+	}
+}
+
+// TestInformerFiltersMatchServer makes sure filters checked locally
+// pick the same objects the server does.
+func TestInformerFiltersMatchServer(t *testing.T) {
+	indexes, err := session.Indexes("reservations")
+	if err != nil {
+		t.Fatalf("Failed to get indexes: %v", err)
+	}
+	for i, desc := range []string{"", "with description", ""} {
+		r := &models.Reservation{
+			Addr:     net.IPv4(192, 168, 124, byte(10+i*10)),
+			Token:    fmt.Sprintf("00:00:00:00:00:%02x", i),
+			Strategy: "MAC",
+		}
+		r.Fill()
+		r.Description = desc
+		if i == 1 {
+			r.NextServer = net.IPv4(192, 168, 124, 1)
+		}
+		if err := session.CreateModel(r); err != nil {
+			t.Fatalf("Failed to create reservation: %v", err)
+		}
+		defer session.DeleteModel("reservations", r.Key())
+	}
+	all, err := session.ListModel("reservations")
+	if err != nil {
+		t.Fatalf("Failed to list reservations: %v", err)
+	}
+	for _, filters := range [][]string{
+		{"Description", ""},
+		{"Description", "Ne()"},
+		{"Available", "true"},
+		{"Available", "false"},
+		{"ReadOnly", "false"},
+		{"Addr", "192.168.124.20"},
+		{"Addr", "Gt(192.168.124.9)"},
+		{"Addr", "Between(192.168.124.15,192.168.124.100)"},
+		{"NextServer", "192.168.124.1"},
+		{"NextServer", "Ne(192.168.124.1)"},
+	} {
+		test, err := compileListFilters(indexes, filters...)
+		if err != nil {
+			t.Errorf("Failed to compile %v: %v", filters, err)
+			continue
+		}
+		want, err := session.ListModel("reservations", filters...)
+		if err != nil {
+			t.Errorf("Failed to list reservations with %v: %v", filters, err)
+			continue
+		}
+		wanted := map[string]bool{}
+		for _, obj := range want {
+			wanted[obj.Key()] = true
+		}
+		for _, obj := range all {
+			ok, err := test(obj)
+			if err != nil {
+				t.Errorf("Failed to check %s against %v: %v", obj.Key(), filters, err)
+			} else if ok != wanted[obj.Key()] {
+				t.Errorf("%v: server says %s matches is %v, locally it is %v", filters, obj.Key(), wanted[obj.Key()], ok)
+			}
+		}
+	}
+}
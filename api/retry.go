@@ -0,0 +1,149 @@
+package api
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how an R retries requests that fail.  A
+// request is retried when it could not be sent at all or when the
+// server answers with one of the RetryStatus codes.
+//
+// Requests using methods that are not idempotent (POST and PATCH)
+// are only retried when the connection to the server could not be
+// made or the server answered with 429 Too Many Requests, as those
+// are the only cases where we know the server did not act on them.
+// Set RetryNonIdempotent to retry them like everything else.
+type RetryPolicy struct {
+	// MaxAttempts is the most times a request will be tried,
+	// including the first.  Anything less than 2 means never retry.
+	MaxAttempts int
+	// Backoff is how long to wait before each retry.  If there are
+	// more retries than entries, the last entry is used for the rest.
+	Backoff []time.Duration
+	// Jitter randomly spreads each wait by up to this fraction of it
+	// in either direction, so that many clients do not all retry at
+	// the same time.
+	Jitter float64
+	// RetryStatus lists the HTTP status codes that will be retried.
+	// If the response has a Retry-After header, it is used instead of
+	// Backoff.
+	RetryStatus []int
+	// MaxRetryAfter caps how long a Retry-After header can make us
+	// wait.  Zero means no cap.
+	MaxRetryAfter time.Duration
+	// RetryNonIdempotent allows POST and PATCH requests to be retried
+	// whenever anything else would be.
+	RetryNonIdempotent bool
+}
+
+var (
+	// DefaultRetryPolicy is the RetryPolicy Clients start out with.
+	// It uses fibonacci based backoff.
+	DefaultRetryPolicy = RetryPolicy{
+		MaxAttempts: 6,
+		Backoff: []time.Duration{
+			time.Second,
+			time.Second,
+			2 * time.Second,
+			3 * time.Second,
+			5 * time.Second,
+		},
+		Jitter:        0.1,
+		RetryStatus:   []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		MaxRetryAfter: time.Minute,
+	}
+	// FailFastPolicy never retries anything.
+	FailFastPolicy = RetryPolicy{MaxAttempts: 1}
+)
+
+func idempotent(method string) bool {
+	switch method {
+	case "POST", "PATCH":
+		return false
+	}
+	return true
+}
+
+// notSent returns whether err means that the request never made it
+// to the server.
+func notSent(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	oe, ok := err.(*net.OpError)
+	return ok && oe.Op == "dial"
+}
+
+// wait returns how long to wait before retrying after the attempt'th
+// try.
+func (p *RetryPolicy) wait(attempt int) time.Duration {
+	if len(p.Backoff) == 0 {
+		return 0
+	}
+	idx := attempt - 1
+	if idx >= len(p.Backoff) {
+		idx = len(p.Backoff) - 1
+	}
+	res := p.Backoff[idx]
+	if p.Jitter > 0 {
+		res += time.Duration(float64(res) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return res
+}
+
+// retryAfter parses the Retry-After header of resp, which can hold
+// either a number of seconds or an HTTP date.
+func (p *RetryPolicy) retryAfter(resp *http.Response) (time.Duration, bool) {
+	val := resp.Header.Get("Retry-After")
+	if val == "" {
+		return 0, false
+	}
+	var res time.Duration
+	if secs, err := strconv.Atoi(val); err == nil {
+		res = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(val); err == nil {
+		res = time.Until(at)
+	} else {
+		return 0, false
+	}
+	if res < 0 {
+		res = 0
+	}
+	if p.MaxRetryAfter > 0 && res > p.MaxRetryAfter {
+		res = p.MaxRetryAfter
+	}
+	return res, true
+}
+
+// retry decides whether the attempt'th try of a request should be
+// retried, and if so how long to wait first.
+func (p *RetryPolicy) retry(method string, attempt int, resp *http.Response, err error) (bool, time.Duration) {
+	if attempt >= p.MaxAttempts {
+		return false, 0
+	}
+	anyway := p.RetryNonIdempotent || idempotent(method)
+	if err != nil {
+		return anyway || notSent(err), p.wait(attempt)
+	}
+	if resp == nil {
+		return false, 0
+	}
+	for _, code := range p.RetryStatus {
+		if code != resp.StatusCode {
+			continue
+		}
+		if !anyway && code != http.StatusTooManyRequests {
+			return false, 0
+		}
+		if d, ok := p.retryAfter(resp); ok {
+			return true, d
+		}
+		return true, p.wait(attempt)
+	}
+	return false, 0
+}
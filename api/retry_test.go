@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var hits int32
+	var failures int32
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	c, _ := TokenSession(srv.URL, "token")
+	defer c.Close()
+	c.Client = srv.Client()
+	c.SetRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     []time.Duration{10 * time.Millisecond},
+		RetryStatus: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+	})
+	req := func(r *R) error {
+		r.uri, _ = url.Parse(srv.URL + "/api/v3/info")
+		res := map[string]interface{}{}
+		return r.Do(&res)
+	}
+	for _, tt := range []struct {
+		name     string
+		r        *R
+		status   int
+		failures int32
+		hits     int32
+		fail     bool
+	}{
+		{"GET retried", c.Req(), http.StatusServiceUnavailable, 2, 3, false},
+		{"GET gives up", c.Req(), http.StatusServiceUnavailable, 3, 3, true},
+		{"FailFast", c.Req().FailFast(), http.StatusServiceUnavailable, 1, 1, true},
+		{"POST not retried", c.Req().Post(map[string]string{}), http.StatusServiceUnavailable, 1, 1, true},
+		{"POST retried on 429", c.Req().Post(map[string]string{}), http.StatusTooManyRequests, 1, 2, false},
+		{"POST retried when allowed", c.Req().Retry(RetryPolicy{
+			MaxAttempts:        2,
+			RetryStatus:        []int{http.StatusServiceUnavailable},
+			RetryNonIdempotent: true,
+		}).Post(map[string]string{}), http.StatusServiceUnavailable, 1, 2, false},
+	} {
+		atomic.StoreInt32(&hits, 0)
+		atomic.StoreInt32(&failures, tt.failures)
+		status = tt.status
+		err := req(tt.r)
+		if got := atomic.LoadInt32(&hits); got != tt.hits {
+			t.Errorf("%s: expected %d requests, got %d", tt.name, tt.hits, got)
+		}
+		if (err != nil) != tt.fail {
+			t.Errorf("%s: unexpected error state: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TLSOptions controls how a Client checks the certificate that
+// dr-provision presents, and which certificate the Client presents
+// in return.  The zero value verifies the server certificate against
+// the system CAs.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of CA certificates to trust in place of
+	// the system ones.
+	CAFile string
+	// Fingerprint is the hex encoded SHA256 fingerprint of the server
+	// certificate.  Colons between the bytes are allowed.  If it is
+	// set, the server must present exactly that certificate, and the
+	// CAs are not consulted.
+	Fingerprint string
+	// CertFile and KeyFile hold a PEM encoded client certificate and
+	// key to present to the server for mutual TLS.
+	CertFile, KeyFile string
+	// PinFile turns on trust on first use.  The first time we see a
+	// certificate for an endpoint that does not verify against the
+	// CAs, its fingerprint is recorded in PinFile and trusted.  From
+	// then on, that endpoint must present the same certificate.
+	PinFile string
+	// OnNewPin, if set, is called whenever a fingerprint is added to
+	// PinFile.
+	OnNewPin func(host, fingerprint string)
+	// Insecure turns off all checking of the server certificate.  It
+	// should only be used for testing.
+	Insecure bool
+}
+
+// TLSOptionsFromEnv returns the TLSOptions described by the following
+// environment variables, which are also what TokenSession and
+// UserSession use:
+//
+//   - RS_TLS_CA_CERT names a CA bundle file.
+//   - RS_TLS_FINGERPRINT is the fingerprint of the server certificate.
+//   - RS_TLS_CLIENT_CERT and RS_TLS_CLIENT_KEY name the client
+//     certificate and key files.
+//   - RS_TLS_PIN_FILE names the file to record trusted fingerprints in.
+//   - RS_TLS_INSECURE, if true, turns off certificate checking.
+//
+// When a session is created without TLSOptions and none of these are
+// set, the server certificate is not checked at all, as has always
+// been the case for TokenSession and UserSession.  Set one of them,
+// or pass TLSOptions, to have it checked.
+func TLSOptionsFromEnv() (*TLSOptions, error) {
+	res := &TLSOptions{
+		CAFile:      os.Getenv("RS_TLS_CA_CERT"),
+		Fingerprint: os.Getenv("RS_TLS_FINGERPRINT"),
+		CertFile:    os.Getenv("RS_TLS_CLIENT_CERT"),
+		KeyFile:     os.Getenv("RS_TLS_CLIENT_KEY"),
+		PinFile:     os.Getenv("RS_TLS_PIN_FILE"),
+	}
+	if v := os.Getenv("RS_TLS_INSECURE"); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("RS_TLS_INSECURE should be a boolean value")
+		}
+		res.Insecure = insecure
+	}
+	return res, nil
+}
+
+// Fingerprint returns the hex encoded SHA256 fingerprint of a DER
+// encoded certificate.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeFingerprint(f string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(f), ":", "", -1))
+}
+
+var pinMux = &sync.Mutex{}
+
+// readPin returns the fingerprint pinned for host in pinFile.  Each
+// line of the file is a host:port and a fingerprint.
+func readPin(pinFile, host string) (string, error) {
+	pinMux.Lock()
+	defer pinMux.Unlock()
+	fi, err := os.Open(pinFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == host {
+			return fields[1], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+func addPin(pinFile, host, fingerprint string) error {
+	pinMux.Lock()
+	defer pinMux.Unlock()
+	if err := os.MkdirAll(filepath.Dir(pinFile), 0700); err != nil {
+		return err
+	}
+	fi, err := os.OpenFile(pinFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	_, err = fmt.Fprintf(fi, "%s %s\n", host, fingerprint)
+	return err
+}
+
+// config builds the tls.Config a Client talking to endpoint should use.
+func (o *TLSOptions) config(endpoint string) (*tls.Config, error) {
+	res := &tls.Config{}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %v", err)
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	if o.Insecure {
+		res.InsecureSkipVerify = true
+		return res, nil
+	}
+	if o.CAFile != "" {
+		buf, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA bundle: %v", err)
+		}
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", o.CAFile)
+		}
+	}
+	fingerprint := normalizeFingerprint(o.Fingerprint)
+	if fingerprint == "" && o.PinFile == "" {
+		return res, nil
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	host := ep.Host
+	if ep.Port() == "" {
+		host = net.JoinHostPort(ep.Hostname(), "443")
+	}
+	roots := res.RootCAs
+	// We do all the checking ourselves from here on out.
+	res.InsecureSkipVerify = true
+	res.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return fmt.Errorf("%s did not present a certificate", host)
+		}
+		sum := Fingerprint(raw[0])
+		if fingerprint != "" {
+			if sum != fingerprint {
+				return fmt.Errorf("Certificate for %s has fingerprint %s, expected %s", host, sum, fingerprint)
+			}
+			return nil
+		}
+		pinned, err := readPin(o.PinFile, host)
+		if err != nil {
+			return fmt.Errorf("Failed to read pinned certificates: %v", err)
+		}
+		if pinned != "" {
+			if sum != pinned {
+				return fmt.Errorf("Certificate for %s has fingerprint %s, but %s is pinned in %s.  Remove it from there if the certificate was changed on purpose",
+					host, sum, pinned, o.PinFile)
+			}
+			return nil
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i := range raw {
+			if certs[i], err = x509.ParseCertificate(raw[i]); err != nil {
+				return err
+			}
+		}
+		vo := x509.VerifyOptions{Roots: roots, DNSName: ep.Hostname(), Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			vo.Intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(vo); err == nil {
+			return nil
+		}
+		if err := addPin(o.PinFile, host, sum); err != nil {
+			return fmt.Errorf("Failed to pin certificate for %s: %v", host, err)
+		}
+		if o.OnNewPin != nil {
+			o.OnNewPin(host, sum)
+		}
+		return nil
+	}
+	return res, nil
+}
+
+// tlsConfigFor returns the tls.Config for endpoint, using the
+// environment if opts is nil.  If the environment does not ask for
+// any checking either, the server certificate is not checked.
+func tlsConfigFor(endpoint string, opts *TLSOptions) (*tls.Config, error) {
+	if opts == nil {
+		var err error
+		if opts, err = TLSOptionsFromEnv(); err != nil {
+			return nil, err
+		}
+		if os.Getenv("RS_TLS_INSECURE") == "" &&
+			opts.CAFile == "" &&
+			opts.Fingerprint == "" &&
+			opts.PinFile == "" {
+			opts.Insecure = true
+		}
+	}
+	return opts.config(endpoint)
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned makes a throwaway certificate for 127.0.0.1.
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSOptions(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	other := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	other.TLS = &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}
+	other.StartTLS()
+	defer other.Close()
+	pinDir, err := ioutil.TempDir("", "api-pins-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(pinDir)
+	fingerprint := Fingerprint(srv.Certificate().Raw)
+	colons := []string{}
+	for i := 0; i < len(fingerprint); i += 2 {
+		colons = append(colons, strings.ToUpper(fingerprint[i:i+2]))
+	}
+	get := func(opts *TLSOptions, url string) error {
+		cfg, err := opts.config(url)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	caFile := path.Join(pinDir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	pins := path.Join(pinDir, "known_hosts")
+	newPins := 0
+	onNewPin := func(host, fp string) { newPins++ }
+	for _, tt := range []struct {
+		name string
+		opts *TLSOptions
+		url  string
+		ok   bool
+	}{
+		{"default", &TLSOptions{}, srv.URL, false},
+		{"insecure", &TLSOptions{Insecure: true}, srv.URL, true},
+		{"ca", &TLSOptions{CAFile: caFile}, srv.URL, true},
+		{"wrong ca", &TLSOptions{CAFile: caFile}, other.URL, false},
+		{"fingerprint", &TLSOptions{Fingerprint: strings.Join(colons, ":")}, srv.URL, true},
+		{"wrong fingerprint", &TLSOptions{Fingerprint: fingerprint}, other.URL, false},
+		{"first use", &TLSOptions{PinFile: pins, OnNewPin: onNewPin}, srv.URL, true},
+		{"pinned", &TLSOptions{PinFile: pins, OnNewPin: onNewPin}, srv.URL, true},
+		// other listens on a different port, so it gets its own pin.
+		{"other first use", &TLSOptions{PinFile: pins, OnNewPin: onNewPin}, other.URL, true},
+	} {
+		if err := get(tt.opts, tt.url); (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected result %v", tt.name, err)
+		}
+	}
+	if newPins != 2 {
+		t.Errorf("Expected 2 certificates to be pinned, got %d", newPins)
+	}
+	// Pretend srv changed its certificate
+	buf, _ := ioutil.ReadFile(pins)
+	ioutil.WriteFile(pins, []byte(strings.Replace(string(buf), fingerprint, Fingerprint(other.Certificate().Raw), 1)), 0600)
+	if err := get(&TLSOptions{PinFile: pins}, srv.URL); err == nil || !strings.Contains(err.Error(), "pinned") {
+		t.Errorf("Expected a pin mismatch, got %v", err)
+	}
+	cfg, err := (&TLSOptions{}).config(srv.URL)
+	if err != nil || cfg.InsecureSkipVerify {
+		t.Errorf("Default TLS options must verify certificates")
+	}
+	// Sessions made without TLSOptions only check certificates if the
+	// environment asks them to.
+	defer os.Setenv("RS_TLS_INSECURE", os.Getenv("RS_TLS_INSECURE"))
+	os.Unsetenv("RS_TLS_INSECURE")
+	if cfg, err = tlsConfigFor(srv.URL, nil); err != nil || !cfg.InsecureSkipVerify {
+		t.Errorf("Sessions without TLS settings must not check certificates: %v", err)
+	}
+	os.Setenv("RS_TLS_CA_CERT", caFile)
+	defer os.Unsetenv("RS_TLS_CA_CERT")
+	if cfg, err = tlsConfigFor(srv.URL, nil); err != nil || cfg.InsecureSkipVerify {
+		t.Errorf("RS_TLS_CA_CERT must turn on certificate checking: %v", err)
+	}
+}
@@ -175,8 +175,9 @@ func (a *agentProg) Stop(s service.Service) error {
 
 func sessionOrError(token string, endpoints []string) (res *api.Client, err error) {
 	for _, endpoint := range endpoints {
-		res, err = api.TokenSession(endpoint, token)
+		res, err = api.TokenSessionTLS(endpoint, token, tlsOptions())
 		if err == nil {
+			res.SetEndpoints(endpoints...)
 			return
 		}
 	}
@@ -215,6 +216,11 @@ var agentHandler = &cobra.Command{
 			return fmt.Errorf("Unable to determine executable name: %v", err)
 		}
 		cfgFileName := path.Join(stateLoc, "agent-cfg.yml")
+		// The agent usually runs without a HOME, so keep its pinned
+		// certificates with the rest of its state.
+		if pinFile == "" {
+			pinFile = path.Join(stateLoc, "known_hosts")
+		}
 		serviceConfig := &service.Config{
 			Name:        "drp-agent",
 			DisplayName: "DigitalRebar Provision Agent",
@@ -258,6 +264,7 @@ var agentHandler = &cobra.Command{
 			prog.cmd.Env = append(os.Environ(),
 				"RS_ENDPOINTS="+options.Endpoints,
 				"RS_TOKEN="+options.Token,
+				"RS_TLS_PIN_FILE="+pinFile,
 				"RS_UUID="+options.MachineID,
 				"RS_CONTEXT="+options.Context)
 			svc, err := service.New(prog, serviceConfig)
@@ -290,7 +297,7 @@ var agentHandler = &cobra.Command{
 				agentToken := os.Getenv("RS_TOKEN")
 				if agentEndpoint != "" && agentUUID != "" && agentToken != "" {
 					log.Printf("RS_* environmment variables present, attempting agent config auto-generation")
-					Session, err = api.TokenSession(agentEndpoint, agentToken)
+					Session, err = api.TokenSessionTLS(agentEndpoint, agentToken, tlsOptions())
 					if err == nil {
 						machineToken := &models.UserToken{}
 						if err = Session.Req().UrlFor("machines", agentUUID, "token").Params("ttl", "3y").Do(machineToken); err == nil {
@@ -1,7 +1,10 @@
 package cli
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +29,7 @@ func (o *ops) commands() []*cobra.Command {
 	slim := ""
 	params := ""
 	decode := false
+	where := ""
 	cmds := []*cobra.Command{}
 	listCmd := &cobra.Command{
 		Use:   "list [filters...]",
@@ -73,6 +77,11 @@ further tweak how the results are returned using the following meta-filters:
 * 'limit' *number* to only return the first *number* items
 * 'offset' *number* to skip *number* items
 * 'sort' *index* to sort items according to *index*
+
+Finally, --where takes a filter expression that is applied to whatever
+the server returned, such as:
+
+    Params["gohai-inventory"].CPUs > 8 && Runnable && Stage in ["a", "b"]
 `, o.name, o.name),
 		Args: func(c *cobra.Command, args []string) error {
 			if len(args) == 0 {
@@ -89,6 +98,13 @@ further tweak how the results are returned using the following meta-filters:
 			return nil
 		},
 		RunE: func(c *cobra.Command, args []string) error {
+			var test api.TestFunc
+			if where != "" {
+				var err error
+				if test, err = api.CompileFilter(where); err != nil {
+					return err
+				}
+			}
 			req := Session.Req().List(o.name)
 			if len(args) > 0 && strings.Contains(args[0], "=") {
 				// Old-style structured args
@@ -139,12 +155,24 @@ further tweak how the results are returned using the following meta-filters:
 			if err != nil {
 				return generateError(err, "listing %v", o.name)
 			}
+			if test != nil {
+				matched := []interface{}{}
+				for _, item := range data {
+					if ok, err := test(item); err != nil {
+						return err
+					} else if ok {
+						matched = append(matched, item)
+					}
+				}
+				data = matched
+			}
 			return prettyPrint(data)
 		},
 	}
 	cmds = append(cmds, listCmd)
 	listCmd.Flags().IntVar(&listLimit, "limit", -1, "Maximum number of items to return")
 	listCmd.Flags().IntVar(&listOffset, "offset", -1, "Number of items to skip before starting to return data")
+	listCmd.Flags().StringVar(&where, "where", "", "A filter expression to apply to the returned items")
 	if canSlim {
 		listCmd.Flags().StringVar(&slim,
 			"slim",
@@ -379,40 +407,76 @@ empty object of that type.  For User, BootEnv, Machine, and Profile, it will be
 		})
 	}
 	if !o.noWait && o.example != nil {
-		cmds = append(cmds, &cobra.Command{
+		waitWhere := ""
+		waitSelect := ""
+		waitConcurrency := 10
+		waitCmd := &cobra.Command{
 			Use:   "wait [id] [field] [value] [timeout]",
 			Short: fmt.Sprintf("Wait for a %s's field to become a value within a number of seconds", o.singleName),
-			Long: `
+			Long: fmt.Sprintf(`
 This function waits for the value to become the new value.
+Instead of a field and a value, --where can be passed a filter
+expression to wait for, in which case only [id] and [timeout]
+are needed.
 
 Timeout is optional, defaults to 1 day, and is measured in seconds.
 
 Returns the following strings:
   complete - field is equal to value
   interrupt - user interrupted the command
-  timeout - timeout has exceeded`,
+  timeout - timeout has exceeded
+
+To wait for many %[1]s at once, pass --select a filter expression
+that picks the %[1]s to wait for, and leave out [id].  Each result
+is printed to stderr as it comes in, and once they are all done a
+map of each %[2]s to how waiting for it turned out is printed.
+At most --concurrency %[1]s are checked against the server at once.`, o.name, o.singleName),
 			Args: func(c *cobra.Command, args []string) error {
-				if len(args) < 3 {
-					return fmt.Errorf("%v requires at least 3 arguments", c.UseLine())
+				idArgs := 1
+				if waitSelect != "" {
+					idArgs = 0
+				}
+				if waitWhere != "" {
+					if len(args) < idArgs || len(args) > idArgs+1 {
+						return fmt.Errorf("%v requires %d or %d arguments with --where", c.UseLine(), idArgs, idArgs+1)
+					}
+					return nil
 				}
-				if len(args) > 4 {
-					return fmt.Errorf("%v requires at most 4 arguments", c.UseLine())
+				if len(args) < idArgs+2 {
+					return fmt.Errorf("%v requires at least %d arguments", c.UseLine(), idArgs+2)
+				}
+				if len(args) > idArgs+3 {
+					return fmt.Errorf("%v requires at most %d arguments", c.UseLine(), idArgs+3)
 				}
 				return nil
 			},
 			RunE: func(c *cobra.Command, args []string) error {
-				id := args[0]
-				field := args[1]
-				value := args[2]
+				id := ""
+				if waitSelect == "" {
+					id = args[0]
+					args = args[1:]
+				}
 				timeout := time.Hour * 24
-				if len(args) == 4 {
-					t, e := strconv.ParseInt(args[3], 10, 64)
+				var testfn api.TestFunc
+				if waitWhere != "" {
+					var err error
+					if testfn, err = api.CompileFilter(waitWhere); err != nil {
+						return err
+					}
+				} else {
+					testfn = api.EqualItem(args[0], args[1])
+					args = args[2:]
+				}
+				if len(args) == 1 {
+					t, e := strconv.ParseInt(args[0], 10, 64)
 					if e != nil {
 						return e
 					}
 					timeout = time.Second * time.Duration(t)
 				}
-				testfn := api.EqualItem(field, value)
+				if waitSelect != "" {
+					return o.waitAll(waitSelect, testfn, timeout, waitConcurrency)
+				}
 				item, err := o.refOrFill(id)
 				if err != nil {
 					return err
@@ -429,8 +493,63 @@ Returns the following strings:
 				fmt.Println(res)
 				return nil
 			},
-		})
+		}
+		waitCmd.Flags().StringVar(&waitWhere, "where", "", "A filter expression to wait for instead of a field and value")
+		waitCmd.Flags().StringVar(&waitSelect, "select", "", fmt.Sprintf("A filter expression that picks the %s to wait for", o.name))
+		waitCmd.Flags().IntVar(&waitConcurrency, "concurrency", 10, fmt.Sprintf("How many %s to check at once when using --select", o.name))
+		cmds = append(cmds, waitCmd)
 	}
 	cmds = append(cmds, o.extraCommands...)
 	return cmds
 }
+
+// waitAll waits for every object picked by the filter expression
+// sel to pass test.
+func (o *ops) waitAll(sel string, test api.TestFunc, timeout time.Duration, concurrency int) error {
+	items, err := Session.ListModelWhere(o.name, sel)
+	if err != nil {
+		return generateError(err, "listing %v", o.name)
+	}
+	es, err := Session.Events()
+	if err != nil {
+		return err
+	}
+	defer es.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	progress := make(chan api.WaitResult, len(items))
+	printed := make(chan struct{})
+	go func() {
+		defer close(printed)
+		done := 0
+		for r := range progress {
+			done++
+			fmt.Fprintf(os.Stderr, "%s: %s (%d/%d)\n", r.Item.Key(), r.Status, done, len(items))
+		}
+	}()
+	results, err := es.WaitForAll(ctx, items, test, timeout, concurrency, progress)
+	<-printed
+	if err != nil {
+		return err
+	}
+	summary := map[string]string{}
+	for _, r := range results {
+		summary[r.Item.Key()] = r.Status
+		if r.Err != nil && r.Status == "error" {
+			summary[r.Item.Key()] = fmt.Sprintf("error: %v", r.Err)
+		}
+	}
+	return prettyPrint(summary)
+}
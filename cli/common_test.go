@@ -498,6 +498,9 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 	defer os.RemoveAll(tmpDir)
+	// The test server uses a self-signed certificate, which the first
+	// session pins here.
+	os.Setenv("RS_TLS_PIN_FILE", path.Join(tmpDir, "known_hosts"))
 	if err := test.StartServer(tmpDir, 10001); err != nil {
 		log.Printf("Error starting dr-provision: %v", err)
 		os.RemoveAll(tmpDir)
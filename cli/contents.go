@@ -2,6 +2,7 @@ package cli
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -154,9 +155,51 @@ func doReplaceContent(layer *models.Content, key string) error {
 	}
 }
 
+// readContentFile loads a content bundle from src, using the file
+// extension to figure out how it was encoded.  Archived bundles laid
+// out like a directory store are read without unpacking them.
+func readContentFile(src string) (*models.Content, error) {
+	if store.IsArchive(src) {
+		s, err := store.Open("archive:" + src)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open store %s: %v", src, err)
+		}
+		defer s.Close()
+		content := &models.Content{}
+		if err := content.FromStore(s); err != nil {
+			return nil, fmt.Errorf("Failed to read store content: %v", err)
+		}
+		return content, nil
+	}
+	codec, name, err := store.CodecByExt(src)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open store %s: %v", src, err)
+	}
+	content := &models.Content{}
+	switch name {
+	case "json", "yaml":
+		err = api.DecodeYaml(buf, content)
+	default:
+		err = codec.Decode(buf, content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal store content: %v", err)
+	}
+	return content, nil
+}
+
 func replaceContent(path, key string) error {
 	layer := &models.Content{}
-	if err := into(path, layer); err != nil {
+	if store.IsArchive(path) {
+		var err error
+		if layer, err = readContentFile(path); err != nil {
+			return generateError(err, "Error parsing layer")
+		}
+	} else if err := into(path, layer); err != nil {
 		return generateError(err, "Error parsing layer")
 	}
 	return doReplaceContent(layer, key)
@@ -325,7 +368,7 @@ func registerContent(app *cobra.Command) {
 	content.AddCommand(&cobra.Command{
 		Use:   "bundle [file] [meta fields]",
 		Short: "Bundle the current directory into [file].  [meta fields] allows for the specification of the meta data.",
-		Long:  "Bundle assumes that the directories are the object types of the system.",
+		Long:  "Bundle assumes that the directories are the object types of the system.\nEach object is validated as it is bundled, and the bundle fails on the first invalid one.",
 		Args: func(c *cobra.Command, args []string) error {
 			if len(args) == 0 {
 				return fmt.Errorf("Must provide a file")
@@ -340,14 +383,13 @@ func registerContent(app *cobra.Command) {
 		RunE: func(c *cobra.Command, args []string) error {
 			target := args[0]
 			ext := path.Ext(target)
-			codec := ""
-			switch ext {
-			case ".go", ".yaml", ".yml":
-				codec = "yaml"
-			case ".json":
-				codec = "json"
-			default:
-				return fmt.Errorf("Unknown store extension %s", ext)
+			codec := "yaml"
+			if ext != ".go" {
+				_, name, err := store.CodecByExt(target)
+				if err != nil {
+					return err
+				}
+				codec = name
 			}
 			storeURI := fmt.Sprintf("file:%s.tmp?codec=%s", target, codec)
 			params := map[string]string{}
@@ -361,7 +403,7 @@ func registerContent(app *cobra.Command) {
 			}
 			defer os.Remove(target + ".tmp")
 			cc := &api.Client{}
-			if err := cc.BundleContent(".", s, params); err != nil {
+			if err := cc.BundleContent(".", models.NewValidatingStore(s), params); err != nil {
 				return fmt.Errorf("Failed to load: %v", err)
 			}
 			s.Close()
@@ -391,19 +433,9 @@ func registerContent(app *cobra.Command) {
 		},
 		RunE: func(c *cobra.Command, args []string) error {
 			src := args[0]
-			ext := path.Ext(src)
-			switch ext {
-			case ".yaml", ".yml", ".json":
-			default:
-				return fmt.Errorf("Unknown store extension %s", ext)
-			}
-			buf, err := ioutil.ReadFile(src)
+			content, err := readContentFile(src)
 			if err != nil {
-				return fmt.Errorf("Failed to open store %s: %v", src, err)
-			}
-			content := &models.Content{}
-			if err := api.DecodeYaml(buf, content); err != nil {
-				return fmt.Errorf("Failed to unmarshal store content: %v", err)
+				return err
 			}
 			s, _ := store.Open("memory:///")
 			if err := content.ToStore(s); err != nil {
@@ -436,14 +468,13 @@ func registerContent(app *cobra.Command) {
 		RunE: func(c *cobra.Command, args []string) error {
 			target := args[0]
 			ext := path.Ext(target)
-			codec := ""
-			switch ext {
-			case ".go", ".yaml", ".yml":
-				codec = "yaml"
-			case ".json":
-				codec = "json"
-			default:
-				return fmt.Errorf("Unknown store extension %s", ext)
+			codec := "yaml"
+			if ext != ".go" {
+				_, name, err := store.CodecByExt(target)
+				if err != nil {
+					return err
+				}
+				codec = name
 			}
 			params := map[string]string{}
 			objects := map[string][]string{}
@@ -580,9 +611,13 @@ func registerContent(app *cobra.Command) {
 	content.AddCommand(bundlize)
 
 	// Convert - load a yaml content as read=write objects.
-	content.AddCommand(&cobra.Command{
+	convertConcurrency := api.DefaultBulkConcurrency
+	convert := &cobra.Command{
 		Use:   "convert [file]",
 		Short: "Expand the content bundle [file or - for stdin] into DRP as read-write objects",
+		Long: `Expand the content bundle [file or - for stdin] into DRP as read-write objects.
+Every object is tried, even if some fail to be created.  The objects that
+could not be created are printed along with why, and the command fails.`,
 		Args: func(c *cobra.Command, args []string) error {
 			if len(args) != 1 {
 				return fmt.Errorf("Must provide a file or stdin")
@@ -591,41 +626,94 @@ func registerContent(app *cobra.Command) {
 		},
 		RunE: func(c *cobra.Command, args []string) error {
 			src := args[0]
-			var buf []byte
-			var err error
+			content := &models.Content{}
 			if src == "-" {
-				buf, err = ioutil.ReadAll(os.Stdin)
+				buf, err := ioutil.ReadAll(os.Stdin)
+				if err != nil {
+					return fmt.Errorf("Failed to open store %s: %v", src, err)
+				}
+				if yerr := api.DecodeYaml(buf, content); yerr != nil {
+					return fmt.Errorf("Failed to unmarshal store content: %v", yerr)
+				}
 			} else {
-				ext := path.Ext(src)
-				switch ext {
-				case ".yaml", ".yml", ".json":
-				default:
-					return fmt.Errorf("Unknown store extension %s", ext)
+				var err error
+				if content, err = readContentFile(src); err != nil {
+					return err
 				}
-				buf, err = ioutil.ReadFile(src)
-			}
-			if err != nil {
-				return fmt.Errorf("Failed to open store %s: %v", src, err)
-			}
-
-			content := &models.Content{}
-			if yerr := api.DecodeYaml(buf, content); yerr != nil {
-				return fmt.Errorf("Failed to unmarshal store content: %v", err)
 			}
 
+			items := []models.Model{}
 			for prefix, vals := range content.Sections {
 				for _, v := range vals {
 					item, _ := models.New(prefix)
 					if err := models.Remarshal(v, item); err != nil {
 						return fmt.Errorf("Failed to remarshal %s:%v: %v", prefix, v, err)
 					}
-					if err := Session.CreateModel(item); err != nil {
-						return fmt.Errorf("Failed to create %s:%v: %v", prefix, v, err)
-					}
+					items = append(items, item)
 				}
 			}
+			failed := Session.BulkCreateCtx(context.Background(), convertConcurrency, items).Failed()
+			if len(failed) == 0 {
+				return nil
+			}
+			report := map[string]string{}
+			for _, r := range failed {
+				report[r.Prefix+":"+r.Key] = r.Err.Error()
+			}
+			if err := prettyPrint(report); err != nil {
+				return err
+			}
+			return fmt.Errorf("Failed to create %d of %d objects", len(failed), len(items))
+		},
+	}
+	convert.Flags().IntVar(&convertConcurrency, "concurrency", api.DefaultBulkConcurrency, "How many objects to create at once")
+	content.AddCommand(convert)
+
+	content.AddCommand(&cobra.Command{
+		Use:   "diff [a] [b]",
+		Short: "Show how content bundle [b] differs from [a]",
+		Long: `Each of [a] and [b] can be a content bundle file or archive, or
+the name of a content layer on the server.  The differences are shown
+per section, with a JSON patch for every object that changed.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("%v requires 2 arguments", c.UseLine())
+			}
 			return nil
 		},
+		RunE: func(c *cobra.Command, args []string) error {
+			stores := make([]store.Store, 2)
+			connected := false
+			for i, src := range args {
+				var content *models.Content
+				var err error
+				if _, serr := os.Stat(src); serr == nil {
+					content, err = readContentFile(src)
+				} else {
+					// Only connect to the server once, and only if
+					// one of the bundles has to come from it.
+					if !connected {
+						err = ppr(c, args)
+						connected = err == nil
+					}
+					if err == nil {
+						content, err = Session.GetContentItem(src)
+					}
+				}
+				if err != nil {
+					return generateError(err, "Failed to load %s", src)
+				}
+				stores[i], _ = store.Open("memory:///")
+				if err := content.ToStore(stores[i]); err != nil {
+					return generateError(err, "Failed to load %s", src)
+				}
+			}
+			diff, err := store.Diff(stores[0], stores[1])
+			if err != nil {
+				return generateError(err, "Failed to compare %s and %s", args[0], args[1])
+			}
+			return prettyPrint(diff)
+		},
 	})
 
 	content.AddCommand(&cobra.Command{
@@ -639,19 +727,9 @@ func registerContent(app *cobra.Command) {
 		},
 		RunE: func(c *cobra.Command, args []string) error {
 			src := args[0]
-			ext := path.Ext(src)
-			switch ext {
-			case ".yaml", ".yml", ".json":
-			default:
-				return fmt.Errorf("Unknown store extension %s", ext)
-			}
-			buf, err := ioutil.ReadFile(src)
+			content, err := readContentFile(src)
 			if err != nil {
-				return fmt.Errorf("Failed to open store %s: %v", src, err)
-			}
-			content := &models.Content{}
-			if err := api.DecodeYaml(buf, content); err != nil {
-				return fmt.Errorf("Failed to unmarshal store content: %v", err)
+				return err
 			}
 
 			tempData := &DocData{
@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 
+	"github.com/digitalrebar/provision/v4/api"
 	"github.com/digitalrebar/provision/v4/models"
 	"github.com/spf13/cobra"
 )
@@ -33,9 +34,17 @@ func registerEvent(app *cobra.Command) {
 			return Session.PostEvent(evt)
 		},
 	})
-	res.AddCommand(&cobra.Command{
+	where := ""
+	watch := &cobra.Command{
 		Use:   "watch [filter]",
 		Short: "Watch events as they come in real time. Optional filter can be specified.",
+		Long: `Watch events as they come in real time.  The optional filter is of the
+form type.action.key, where each part can be * to match anything.
+
+--where takes a filter expression that the object each event is about
+must match, such as:
+
+    Runnable && Stage in ["a", "b"]`,
 		Args: func(c *cobra.Command, args []string) error {
 			if len(args) > 1 {
 				return fmt.Errorf("%v requires 0 or 1 argument", c.UseLine())
@@ -43,6 +52,13 @@ func registerEvent(app *cobra.Command) {
 			return nil
 		},
 		RunE: func(c *cobra.Command, args []string) error {
+			var test api.TestFunc
+			if where != "" {
+				var err error
+				if test, err = api.CompileFilter(where); err != nil {
+					return err
+				}
+			}
 			stream, err := Session.Events()
 			if err != nil {
 				return err
@@ -61,9 +77,16 @@ func registerEvent(app *cobra.Command) {
 				if evt.Err != nil {
 					return err
 				}
+				if test != nil && !evt.IsResync() {
+					if ok, err := test(evt.E.Object); err != nil || !ok {
+						continue
+					}
+				}
 				prettyPrint(evt.E)
 			}
 		},
-	})
+	}
+	watch.Flags().StringVar(&where, "where", "", "A filter expression the object each event is about must match")
+	res.AddCommand(watch)
 	app.AddCommand(res)
 }
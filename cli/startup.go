@@ -52,12 +52,98 @@ var (
 	trace         = ""
 	traceToken    = ""
 	registrations = []registerSection{}
+	// TLS settings for talking to dr-provision
+	caCert                = ""
+	defaultCaCert         = ""
+	tlsFingerprint        = ""
+	defaultTlsFingerprint = ""
+	clientCert            = ""
+	defaultClientCert     = ""
+	clientKey             = ""
+	defaultClientKey      = ""
+	insecure              = false
+	defaultInsecure       = false
+	noTofu                = false
+	defaultNoTofu         = false
+	pinFile               = ""
+	defaultPinFile        = ""
+	// Where to get credentials from other than the command line
+	tokenFile               = ""
+	defaultTokenFile        = ""
+	credentialHelper        = ""
+	defaultCredentialHelper = ""
+	credentialEnv           = ""
+	defaultCredentialEnv    = ""
 )
 
 func addRegistrar(rs registerSection) {
 	registrations = append(registrations, rs)
 }
 
+// tokenCacheDir returns the directory that cached tokens and pinned
+// server certificates are kept in.
+func tokenCacheDir() string {
+	home := os.ExpandEnv("${HOME}")
+	tPath := os.ExpandEnv("${RS_TOKEN_CACHE}")
+	if tPath == "" && home != "" {
+		tPath = path.Join(home, ".cache", "drpcli", "tokens")
+	}
+	return tPath
+}
+
+// pinStateDir is where certificates are pinned when there is no
+// token cache directory to put them in, such as when drpcli is run
+// by a service manager without a HOME.
+func pinStateDir() string {
+	if runtime.GOOS == "windows" {
+		return os.ExpandEnv("${APPDATA}/drpcli")
+	}
+	return "/var/lib/drpcli"
+}
+
+// pinFileLocation returns the file server certificates are pinned
+// in: --pin-file if it was given, otherwise known_hosts in the token
+// cache directory, otherwise known_hosts in pinStateDir.  It does not
+// depend on --noToken, which only controls caching of tokens.
+func pinFileLocation() string {
+	if pinFile != "" {
+		return pinFile
+	}
+	if tPath := tokenCacheDir(); tPath != "" {
+		return path.Join(tPath, "known_hosts")
+	}
+	return path.Join(pinStateDir(), "known_hosts")
+}
+
+// tlsOptions returns the TLS settings from the command line.  Unless
+// told otherwise, server certificates that cannot be verified are
+// trusted on first use, and pinned in pinFileLocation.
+func tlsOptions() *api.TLSOptions {
+	res := &api.TLSOptions{
+		CAFile:      caCert,
+		Fingerprint: tlsFingerprint,
+		CertFile:    clientCert,
+		KeyFile:     clientKey,
+		Insecure:    insecure,
+	}
+	if !noTofu {
+		res.PinFile = pinFileLocation()
+		res.OnNewPin = func(host, fingerprint string) {
+			fmt.Fprintf(os.Stderr, "Trusting certificate for %s with SHA256 fingerprint %s\n", host, fingerprint)
+		}
+	}
+	return res
+}
+
+// credentialHelperCmd runs helper through the shell, so that it can
+// have arguments with spaces or quotes in them.
+func credentialHelperCmd(helper string) *api.ExecCredentials {
+	if runtime.GOOS == "windows" {
+		return &api.ExecCredentials{Command: "cmd", Args: []string{"/C", helper}}
+	}
+	return &api.ExecCredentials{Command: "sh", Args: []string{"-c", helper}}
+}
+
 var ppr = func(c *cobra.Command, a []string) error {
 	c.SilenceUsage = true
 	if Session == nil {
@@ -74,20 +160,23 @@ var ppr = func(c *cobra.Command, a []string) error {
 			defaultEndpoints[0], defaultEndpoints[l] = defaultEndpoints[l], defaultEndpoints[0]
 		}
 		var sessErr error
+		tlsOpts := tlsOptions()
 		for _, endpoint = range defaultEndpoints {
-			if token != "" {
-				Session, sessErr = api.TokenSession(endpoint, token)
+			if credentialHelper != "" {
+				Session, sessErr = api.CredentialSessionTLS(endpoint, credentialHelperCmd(credentialHelper), tlsOpts)
+			} else if credentialEnv != "" {
+				Session, sessErr = api.CredentialSessionTLS(endpoint, api.EnvCredentials(credentialEnv), tlsOpts)
+			} else if tokenFile != "" {
+				Session, sessErr = api.CredentialSessionTLS(endpoint, api.FileCredentials(tokenFile), tlsOpts)
+			} else if token != "" {
+				Session, sessErr = api.TokenSessionTLS(endpoint, token, tlsOpts)
 			} else {
-				home := os.ExpandEnv("${HOME}")
-				tPath := os.ExpandEnv("${RS_TOKEN_CACHE}")
-				if tPath == "" && home != "" {
-					tPath = path.Join(home, ".cache", "drpcli", "tokens")
-				}
+				tPath := tokenCacheDir()
 				tokenFile := path.Join(tPath, "."+username+".token")
 				if !noToken && tPath != "" {
 					if err := os.MkdirAll(tPath, 0700); err == nil {
 						if tokenStr, err := ioutil.ReadFile(tokenFile); err == nil {
-							Session, sessErr = api.TokenSession(endpoint, string(tokenStr))
+							Session, sessErr = api.TokenSessionTLS(endpoint, string(tokenStr), tlsOpts)
 							if sessErr == nil {
 								if _, err := Session.Info(); err == nil {
 									Session.Trace(trace)
@@ -98,7 +187,7 @@ var ppr = func(c *cobra.Command, a []string) error {
 						}
 					}
 				}
-				Session, sessErr = api.UserSessionToken(endpoint, username, password, !noToken)
+				Session, sessErr = api.UserSessionTokenTLS(endpoint, username, password, !noToken, tlsOpts)
 				if !noToken && tPath != "" && sessErr == nil {
 					if err := os.MkdirAll(tPath, 700); err == nil {
 						tok := &models.UserToken{}
@@ -117,6 +206,7 @@ var ppr = func(c *cobra.Command, a []string) error {
 		if sessErr != nil {
 			return fmt.Errorf("Error creating Session: %v", sessErr)
 		}
+		Session.SetEndpoints(defaultEndpoints...)
 	}
 	Session.Trace(trace)
 	Session.TraceToken(traceToken)
@@ -161,6 +251,44 @@ func NewApp() *cobra.Command {
 			log.Fatal("RS_TRUNCATE_LENGTH should be an integer value")
 		}
 	}
+	if tk := os.Getenv("RS_TOKEN_FILE"); tk != "" {
+		defaultTokenFile = tk
+	}
+	if tk := os.Getenv("RS_CREDENTIAL_HELPER"); tk != "" {
+		defaultCredentialHelper = tk
+	}
+	if tk := os.Getenv("RS_CREDENTIAL_ENV"); tk != "" {
+		defaultCredentialEnv = tk
+	}
+	if tk := os.Getenv("RS_TLS_CA_CERT"); tk != "" {
+		defaultCaCert = tk
+	}
+	if tk := os.Getenv("RS_TLS_FINGERPRINT"); tk != "" {
+		defaultTlsFingerprint = tk
+	}
+	if tk := os.Getenv("RS_TLS_CLIENT_CERT"); tk != "" {
+		defaultClientCert = tk
+	}
+	if tk := os.Getenv("RS_TLS_CLIENT_KEY"); tk != "" {
+		defaultClientKey = tk
+	}
+	if tk := os.Getenv("RS_TLS_INSECURE"); tk != "" {
+		var e error
+		defaultInsecure, e = strconv.ParseBool(tk)
+		if e != nil {
+			log.Fatal("RS_TLS_INSECURE should be a boolean value")
+		}
+	}
+	if tk := os.Getenv("RS_TLS_NO_TOFU"); tk != "" {
+		var e error
+		defaultNoTofu, e = strconv.ParseBool(tk)
+		if e != nil {
+			log.Fatal("RS_TLS_NO_TOFU should be a boolean value")
+		}
+	}
+	if tk := os.Getenv("RS_TLS_PIN_FILE"); tk != "" {
+		defaultPinFile = tk
+	}
 	if kv := os.Getenv("RS_KEY"); kv != "" {
 		key := strings.SplitN(kv, ":", 2)
 		if len(key) < 2 {
@@ -206,6 +334,34 @@ func NewApp() *cobra.Command {
 				if e != nil {
 					log.Fatal("RS_TRUNCATE_LENGTH should be an integer value in drpclirc")
 				}
+			case "RS_TOKEN_FILE":
+				defaultTokenFile = parts[1]
+			case "RS_CREDENTIAL_HELPER":
+				defaultCredentialHelper = parts[1]
+			case "RS_CREDENTIAL_ENV":
+				defaultCredentialEnv = parts[1]
+			case "RS_TLS_CA_CERT":
+				defaultCaCert = parts[1]
+			case "RS_TLS_FINGERPRINT":
+				defaultTlsFingerprint = parts[1]
+			case "RS_TLS_CLIENT_CERT":
+				defaultClientCert = parts[1]
+			case "RS_TLS_CLIENT_KEY":
+				defaultClientKey = parts[1]
+			case "RS_TLS_INSECURE":
+				var e error
+				defaultInsecure, e = strconv.ParseBool(parts[1])
+				if e != nil {
+					log.Fatal("RS_TLS_INSECURE should be a boolean value in drpclirc")
+				}
+			case "RS_TLS_NO_TOFU":
+				var e error
+				defaultNoTofu, e = strconv.ParseBool(parts[1])
+				if e != nil {
+					log.Fatal("RS_TLS_NO_TOFU should be a boolean value in drpclirc")
+				}
+			case "RS_TLS_PIN_FILE":
+				defaultPinFile = parts[1]
 			case "RS_KEY":
 				key := strings.SplitN(parts[1], ":", 2)
 				if len(key) < 2 {
@@ -267,6 +423,36 @@ func NewApp() *cobra.Command {
 	app.PersistentFlags().BoolVarP(&noToken,
 		"noToken", "x", noToken,
 		"Do not use token auth or token cache")
+	app.PersistentFlags().StringVar(&tokenFile,
+		"token-file", defaultTokenFile,
+		"A file to read the token or JSON encoded Username and Password to use from.  It is reread whenever the token needs refreshing")
+	app.PersistentFlags().StringVar(&credentialHelper,
+		"credential-helper", defaultCredentialHelper,
+		"A shell command to run to get the token or JSON encoded Username and Password to use.  It is run again whenever the token needs refreshing")
+	app.PersistentFlags().StringVar(&credentialEnv,
+		"credential-env", defaultCredentialEnv,
+		"An environment variable to read the token or JSON encoded Username and Password to use from.  It is reread whenever the token needs refreshing")
+	app.PersistentFlags().StringVar(&caCert,
+		"ca-cert", defaultCaCert,
+		"A PEM file of CA certificates to verify the endpoint's certificate with")
+	app.PersistentFlags().StringVar(&tlsFingerprint,
+		"fingerprint", defaultTlsFingerprint,
+		"The SHA256 fingerprint the endpoint's certificate must have")
+	app.PersistentFlags().StringVar(&clientCert,
+		"client-cert", defaultClientCert,
+		"A PEM file with a client certificate to present to the endpoint")
+	app.PersistentFlags().StringVar(&clientKey,
+		"client-key", defaultClientKey,
+		"A PEM file with the key for --client-cert")
+	app.PersistentFlags().BoolVar(&insecure,
+		"insecure", defaultInsecure,
+		"Do not verify the endpoint's certificate at all")
+	app.PersistentFlags().BoolVar(&noTofu,
+		"no-tofu", defaultNoTofu,
+		"Do not trust and pin unverifiable endpoint certificates on first use")
+	app.PersistentFlags().StringVar(&pinFile,
+		"pin-file", defaultPinFile,
+		"The file to pin endpoint certificates in.  Defaults to known_hosts in the token cache, or in "+pinStateDir()+" without one")
 	if runtime.GOOS != "windows" {
 		app.AddCommand(&cobra.Command{
 			Use:   "proxy [socket]",
@@ -300,6 +486,7 @@ func NewApp() *cobra.Command {
 			for _, sc := range c.Commands() {
 				if !strings.HasPrefix(sc.Use, "bundle") &&
 					!strings.HasPrefix(sc.Use, "unbundle") &&
+					!strings.HasPrefix(sc.Use, "diff") &&
 					!strings.HasPrefix(sc.Use, "document") {
 					sc.PersistentPreRunE = ppr
 				}
@@ -8,6 +8,7 @@ import (
 	"strconv"
 
 	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
 	"github.com/digitalrebar/provision/v4/store"
 )
 
@@ -64,7 +65,7 @@ func main() {
 		cleanUp(filename, fmt.Sprintf("Failed to open store: %v\n", err))
 	} else {
 		client := &api.Client{}
-		if err := client.BundleContent(directory, dst, map[string]string{}); err != nil {
+		if err := client.BundleContent(directory, models.NewValidatingStore(dst), map[string]string{}); err != nil {
 			cleanUp(filename, fmt.Sprintf("Failed to load: %v\n", err))
 		}
 		dst.Close()
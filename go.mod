@@ -13,6 +13,7 @@ require (
 	github.com/digitalrebar/tftp/v3 v3.0.0
 	github.com/elithrar/simple-scrypt v1.3.0
 	github.com/fastly/go-utils v0.0.0-20180712184237-d95a45783239 // indirect
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/ghodss/yaml v1.0.0
 	github.com/go-ole/go-ole v1.2.4 // indirect
 	github.com/gofunky/semver v3.5.2+incompatible
@@ -29,6 +30,7 @@ require (
 	github.com/klauspost/cpuid v1.2.1 // indirect
 	github.com/klauspost/pgzip v1.2.1
 	github.com/krolaw/dhcp4 v0.0.0-20190531080455-7b64900047ae
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/olekukonko/tablewriter v0.0.4
 	github.com/pborman/uuid v1.2.0
 	github.com/pkg/xattr v0.4.1
@@ -39,11 +41,14 @@ require (
 	github.com/spf13/cobra v0.0.4-0.20180722215644-7c4570c3ebeb
 	github.com/spf13/pflag v1.0.3 // indirect
 	github.com/tebeka/strftime v0.1.3 // indirect
+	github.com/vmihailenco/msgpack/v4 v4.3.12
 	github.com/xeipuuv/gojsonpointer v0.0.0-20180127040702-4e3ac2762d5f // indirect
 	github.com/xeipuuv/gojsonreference v0.0.0-20180127040603-bd5ef7bd5415 // indirect
 	github.com/xeipuuv/gojsonschema v1.1.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
-	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80
-	golang.org/x/sys v0.0.0-20191120155948-bd437916bb0e
+	// msgpack/v4 needs at least this x/net, and bbolt this x/sys.
+	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
+	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5
 	gopkg.in/yaml.v2 v2.2.2
 )
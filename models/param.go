@@ -1,6 +1,11 @@
 package models
 
-import "github.com/xeipuuv/gojsonschema"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
 
 // Param represents metadata about a Parameter or a Preference.
 // Specifically, it contains a description of what the information
@@ -88,6 +93,30 @@ func (p *Param) Validate() {
 	}
 }
 
+// ValidateValue checks val against the Param's Schema.  Params
+// without a Schema accept any value.
+func (p *Param) ValidateValue(val interface{}) error {
+	if p.Schema == nil {
+		return nil
+	}
+	validator, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(p.Schema))
+	if err != nil {
+		return fmt.Errorf("Invalid schema: %v", err)
+	}
+	res, err := validator.Validate(gojsonschema.NewGoLoader(val))
+	if err != nil {
+		return fmt.Errorf("Error validating value: %v", err)
+	}
+	if res.Valid() {
+		return nil
+	}
+	msgs := []string{}
+	for _, e := range res.Errors() {
+		msgs = append(msgs, e.String())
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
 func (p *Param) SetName(s string) {
 	p.Name = s
 }
@@ -0,0 +1,182 @@
+package models
+
+import "github.com/digitalrebar/provision/v4/store"
+
+// ValidatingStore wraps a store.Store and checks every object that
+// is saved through it the same way dr-provision would before letting
+// it be written.  Each value is remarshalled into the model for its
+// prefix, the model's own Validate method is run, and any Params it
+// has are checked against the Schema of the matching Param.  Values
+// for prefixes that do not map to a known model are saved unchanged.
+//
+// Param definitions are looked up in Params, then in the params
+// prefix of the wrapped store.  Values for Params that cannot be
+// found or that are Secure are not checked.
+//
+// Anything that fails validation is rejected with an *Error whose
+// Model and Key are the prefix and key it was being saved under.
+type ValidatingStore struct {
+	store.Store
+	Params map[string]*Param
+}
+
+// NewValidatingStore wraps s in a ValidatingStore.
+func NewValidatingStore(s store.Store) *ValidatingStore {
+	return &ValidatingStore{Store: s, Params: map[string]*Param{}}
+}
+
+func validationError(prefix, key string) *Error {
+	return &Error{Model: prefix, Key: key, Type: "ValidationError", Code: 422}
+}
+
+// param finds the definition of the Param named name.
+func (v *ValidatingStore) param(name string) *Param {
+	if p, ok := v.Params[name]; ok {
+		return p
+	}
+	res := &Param{}
+	if err := v.Store.Load("params", name, res); err != nil {
+		return nil
+	}
+	return res
+}
+
+// validate decodes val into the model for prefix and runs everything
+// but the Param checks on it.  It returns a nil Model when prefix
+// does not map to a known model.
+func (v *ValidatingStore) validate(prefix, key string, val interface{}) (Model, error) {
+	obj, _ := New(prefix)
+	if _, ok := obj.(*RawModel); ok {
+		return nil, nil
+	}
+	e := validationError(prefix, key)
+	if err := Remarshal(val, obj); err != nil {
+		e.Errorf("Cannot decode %s: %v", obj.Prefix(), err)
+		return nil, e
+	}
+	if obj.Key() != key {
+		e.Errorf("Key %s does not match %s %s", key, obj.KeyName(), obj.Key())
+	}
+	if vo, ok := obj.(Validator); ok {
+		vo.ClearValidation()
+		vo.Validate()
+		e.AddError(vo.HasError())
+	}
+	return obj, e.HasError()
+}
+
+// checkParams checks the Params of obj against their Schemas.
+func checkParams(prefix, key string, obj Model, lookup func(string) *Param) error {
+	po, ok := obj.(Paramer)
+	if !ok {
+		return nil
+	}
+	e := validationError(prefix, key)
+	for name, val := range po.GetParams() {
+		p := lookup(name)
+		if p == nil || p.Secure {
+			continue
+		}
+		if err := p.ValidateValue(val); err != nil {
+			e.Errorf("Param %s: %v", name, err)
+		}
+	}
+	return e.HasError()
+}
+
+// Validate checks val the same way Save would without saving it.
+func (v *ValidatingStore) Validate(prefix, key string, val interface{}) error {
+	obj, err := v.validate(prefix, key, val)
+	if err != nil || obj == nil {
+		return err
+	}
+	return checkParams(prefix, key, obj, v.param)
+}
+
+func (v *ValidatingStore) Save(prefix, key string, val interface{}) error {
+	if err := v.Validate(prefix, key, val); err != nil {
+		return err
+	}
+	return v.Store.Save(prefix, key, val)
+}
+
+func (v *ValidatingStore) MetaData() map[string]string {
+	if ms, ok := v.Store.(store.MetaSaver); ok {
+		return ms.MetaData()
+	}
+	return map[string]string{}
+}
+
+func (v *ValidatingStore) SetMetaData(vals map[string]string) error {
+	if ms, ok := v.Store.(store.MetaSaver); ok {
+		return ms.SetMetaData(vals)
+	}
+	return nil
+}
+
+// Begin starts a transaction against the wrapped store.  Objects are
+// validated as they are saved, but Param checks wait until Commit so
+// that Params defined in the same transaction can be used.
+func (v *ValidatingStore) Begin() (store.Txn, error) {
+	t, err := store.Begin(v.Store)
+	if err != nil {
+		return nil, err
+	}
+	return &validatingTxn{Txn: t, v: v, params: map[string]*Param{}}, nil
+}
+
+type pendingCheck struct {
+	prefix, key string
+	obj         Model
+}
+
+type validatingTxn struct {
+	store.Txn
+	v       *ValidatingStore
+	params  map[string]*Param
+	pending []pendingCheck
+}
+
+func (t *validatingTxn) param(name string) *Param {
+	if p, ok := t.params[name]; ok {
+		return p
+	}
+	return t.v.param(name)
+}
+
+func (t *validatingTxn) Save(prefix, key string, val interface{}) error {
+	obj, err := t.v.validate(prefix, key, val)
+	if err != nil {
+		return err
+	}
+	if err := t.Txn.Save(prefix, key, val); err != nil {
+		return err
+	}
+	if p, ok := obj.(*Param); ok {
+		t.params[key] = p
+	}
+	if obj != nil {
+		t.pending = append(t.pending, pendingCheck{prefix: prefix, key: key, obj: obj})
+	}
+	return nil
+}
+
+func (t *validatingTxn) Remove(prefix, key string) error {
+	if err := t.Txn.Remove(prefix, key); err != nil {
+		return err
+	}
+	if prefix == "params" {
+		t.params[key] = nil
+	}
+	return nil
+}
+
+func (t *validatingTxn) Commit() error {
+	for _, pc := range t.pending {
+		if err := checkParams(pc.prefix, pc.key, pc.obj, t.param); err != nil {
+			t.Txn.Rollback()
+			return err
+		}
+	}
+	return t.Txn.Commit()
+}
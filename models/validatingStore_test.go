@@ -0,0 +1,51 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/store"
+)
+
+func TestValidatingStore(t *testing.T) {
+	mem, _ := store.Open("memory:///")
+	vs := NewValidatingStore(mem)
+	param := &Param{Name: "count", Schema: map[string]interface{}{"type": "integer"}}
+	if err := vs.Save("params", "count", param); err != nil {
+		t.Fatalf("Failed to save param: %v", err)
+	}
+	if err := vs.Save("profiles", "good", &Profile{Name: "good", Params: map[string]interface{}{"count": 3}}); err != nil {
+		t.Errorf("Expected valid profile to save, got %v", err)
+	}
+	err := vs.Save("profiles", "bad", &Profile{Name: "bad", Params: map[string]interface{}{"count": "three"}})
+	if e, ok := err.(*Error); !ok || e.Model != "profiles" || e.Key != "bad" || len(e.Messages) != 1 {
+		t.Errorf("Expected a models.Error for profiles/bad, got %#v", err)
+	}
+	if mem.Exists("profiles", "bad") {
+		t.Errorf("Invalid profile was saved")
+	}
+	err = vs.Save("profiles", "other", &Profile{Name: "mismatched"})
+	if e, ok := err.(*Error); !ok || e.Key != "other" {
+		t.Errorf("Expected a key mismatch error for profiles/other, got %#v", err)
+	}
+	err = vs.Save("stages", "0bad", &Stage{Name: "0bad"})
+	if e, ok := err.(*Error); !ok || e.Model != "stages" {
+		t.Errorf("Expected an invalid name error for stages/0bad, got %#v", err)
+	}
+	if err := vs.Save("widgets", "anything", map[string]interface{}{"Name": "0"}); err != nil {
+		t.Errorf("Unknown prefixes should not be validated, got %v", err)
+	}
+
+	txn, err := store.Begin(vs)
+	if err != nil {
+		t.Fatalf("Failed to start transaction: %v", err)
+	}
+	txn.Save("profiles", "later", &Profile{Name: "later", Params: map[string]interface{}{"flag": 1}})
+	txn.Save("params", "flag", &Param{Name: "flag", Schema: map[string]interface{}{"type": "boolean"}})
+	err = txn.Commit()
+	if e, ok := err.(*Error); !ok || e.Key != "later" {
+		t.Errorf("Expected commit to fail on profiles/later, got %#v", err)
+	}
+	if mem.Exists("params", "flag") || mem.Exists("profiles", "later") {
+		t.Errorf("Failed transaction was not rolled back")
+	}
+}
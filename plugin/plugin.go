@@ -64,6 +64,12 @@
 //    RS_FILESERVER will be a URL to the static file server
 //    RS_WEBROOT will be the filesystem path to static file server space
 //
+//    dr-provision may also set RS_TLS_CA_CERT or RS_TLS_FINGERPRINT to tell
+//    the plugin provider how to check the certificate RS_ENDPOINT presents.
+//    If it sets neither, the certificate is trusted the first time it is
+//    seen and pinned in RS_TLS_PIN_FILE, or in tls-pins in the scratch
+//    directory if that is not set either.
+//
 //    The plugin provider will be executed with its current directory set
 //    to a scratch directory it can use to hold temporary files.
 //
@@ -130,6 +136,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/digitalrebar/logger"
@@ -373,6 +380,25 @@ func stopHandler(w http.ResponseWriter, r *http.Request, ps PluginStop) {
 	os.Exit(0)
 }
 
+// tlsOptions returns how the API session should check the certificate
+// that dr-provision presents.  dr-provision serves a self-signed
+// certificate by default, so unless we were told what CA or
+// certificate to expect, we pin the one we see first.
+func tlsOptions() (*api.TLSOptions, error) {
+	opts, err := api.TLSOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if opts.CAFile == "" && opts.Fingerprint == "" && opts.PinFile == "" && !opts.Insecure {
+		dir, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		opts.PinFile = filepath.Join(dir, "tls-pins")
+	}
+	return opts, nil
+}
+
 func buildSession() (*api.Client, error) {
 	defaultEndpoint := "https://127.0.0.1:8092"
 	if ep := os.Getenv("RS_ENDPOINT"); ep != "" {
@@ -386,7 +412,10 @@ func buildSession() (*api.Client, error) {
 	var session *api.Client
 	var err2 error
 	if defaultToken != "" {
-		session, err2 = api.TokenSession(defaultEndpoint, defaultToken)
+		var opts *api.TLSOptions
+		if opts, err2 = tlsOptions(); err2 == nil {
+			session, err2 = api.TokenSessionTLS(defaultEndpoint, defaultToken, opts)
+		}
 	} else {
 		err2 = fmt.Errorf("Must have a token specified")
 	}
@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/v4/api"
+	"github.com/digitalrebar/provision/v4/models"
+)
+
+func TestBuildSessionSelfSigned(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Id": "test"}`))
+	}))
+	defer srv.Close()
+	scratch, err := ioutil.TempDir("", "plugin-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(scratch)
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	if err := os.Chdir(scratch); err != nil {
+		t.Fatalf("Failed to chdir to %s: %v", scratch, err)
+	}
+	for _, env := range []string{"RS_TLS_INSECURE", "RS_TLS_CA_CERT", "RS_TLS_FINGERPRINT", "RS_TLS_PIN_FILE"} {
+		os.Unsetenv(env)
+	}
+	os.Setenv("RS_ENDPOINT", srv.URL)
+	os.Setenv("RS_TOKEN", "token")
+	defer os.Unsetenv("RS_ENDPOINT")
+	defer os.Unsetenv("RS_TOKEN")
+
+	session, err := buildSession()
+	if err != nil {
+		t.Fatalf("Failed to build session: %v", err)
+	}
+	info := &models.Info{}
+	if err := session.Req().UrlFor("info").Do(info); err != nil {
+		t.Fatalf("Failed to talk to self-signed server: %v", err)
+	}
+	session.Close()
+	pins, err := ioutil.ReadFile(filepath.Join(scratch, "tls-pins"))
+	if err != nil || !strings.Contains(string(pins), srv.Listener.Addr().String()) {
+		t.Errorf("Expected the server certificate to be pinned, got %q: %v", pins, err)
+	}
+
+	// A different certificate for the same endpoint must be refused.
+	u, _ := url.Parse(srv.URL)
+	ioutil.WriteFile(filepath.Join(scratch, "tls-pins"), []byte(u.Host+" 00\n"), 0600)
+	session, err = buildSession()
+	if err != nil {
+		t.Fatalf("Failed to build session: %v", err)
+	}
+	defer session.Close()
+	session.SetRetryPolicy(api.RetryPolicy{})
+	if err := session.Req().UrlFor("info").Do(info); err == nil {
+		t.Errorf("Expected a certificate that does not match the pin to be refused")
+	}
+}
@@ -0,0 +1,464 @@
+package store
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IsArchive returns whether name looks like an archive that an
+// Archive store can read, going by its extension.
+func IsArchive(name string) bool {
+	return archiveFormat(name) != ""
+}
+
+func archiveFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tgz"
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	}
+	return ""
+}
+
+type archiveItem struct {
+	codec Codec
+	buf   []byte
+}
+
+// Archive implements a Store that is backed by a tar, gzipped tar, or
+// zip file laid out the same way a Directory store is: metadata in
+// ._Key.meta files at the top level, and one subdirectory per
+// prefix.  If every entry is inside a single top-level directory, it
+// is skipped over.  The archive is read into memory when the store
+// is opened.  Each value is decoded using the codec that matches its
+// file extension, so one archive can mix json and yaml files.
+//
+// Archive stores are read-only unless Writable is set, in which case
+// changes are written back out to Path by Flush or Close, using the
+// codec the store was opened with.
+type Archive struct {
+	storeBase
+	Path     string
+	Writable bool
+	items    map[string]map[string]*archiveItem
+	meta     map[string]string
+	dirty    bool
+}
+
+func (a *Archive) Type() string {
+	return "archive"
+}
+
+func (a *Archive) Open(codec Codec) error {
+	if a.Path == "" {
+		return fmt.Errorf("Cannot store data at ''")
+	}
+	format := archiveFormat(a.Path)
+	if format == "" {
+		return fmt.Errorf("Unknown archive type for %s.  Try .tar, .tar.gz, .tgz, or .zip", a.Path)
+	}
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	a.Codec = codec
+	a.items = map[string]map[string]*archiveItem{}
+	a.meta = map[string]string{}
+	files, err := readArchive(a.Path, format)
+	if os.IsNotExist(err) && a.Writable {
+		files, err = map[string][]byte{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := a.load(files); err != nil {
+		return err
+	}
+	a.readOnly = !a.Writable
+	a.closer = func() {
+		a.flush()
+	}
+	a.opened = true
+	if n, ok := a.meta["Name"]; ok {
+		a.name = n
+	}
+	return nil
+}
+
+// readArchive returns the contents of every regular file in the
+// archive at name.
+func readArchive(name, format string) (map[string][]byte, error) {
+	res := map[string][]byte{}
+	if format == "zip" {
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			buf, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Error reading %s from %s: %v", f.Name, name, err)
+			}
+			res[f.Name] = buf
+		}
+		return res, nil
+	}
+	fi, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	var rd io.Reader = fi
+	if format == "tgz" {
+		gz, err := gzip.NewReader(fi)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %v", name, err)
+		}
+		defer gz.Close()
+		rd = gz
+	}
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %v", name, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		buf, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s from %s: %v", hdr.Name, name, err)
+		}
+		res[hdr.Name] = buf
+	}
+}
+
+// load sorts the files from an archive into metadata and values.
+func (a *Archive) load(files map[string][]byte) error {
+	names := map[string][]string{}
+	tops := map[string]bool{}
+	deep := false
+	for name := range files {
+		parts := strings.Split(strings.Trim(path.Clean(name), "/"), "/")
+		names[name] = parts
+		tops[parts[0]] = true
+		if len(parts) == 3 {
+			deep = true
+		}
+	}
+	strip := deep && len(tops) == 1
+	for name, parts := range names {
+		if strip {
+			parts = parts[1:]
+		}
+		switch len(parts) {
+		case 1:
+			if !(strings.HasPrefix(parts[0], "._") && strings.HasSuffix(parts[0], ".meta")) {
+				continue
+			}
+			val := strings.TrimSpace(string(files[name]))
+			if val != "" {
+				a.meta[strings.TrimSuffix(strings.TrimPrefix(parts[0], "._"), ".meta")] = val
+			}
+		case 2:
+			if strings.HasPrefix(parts[0], ".") || strings.HasPrefix(parts[1], ".") {
+				continue
+			}
+			codec, _, err := CodecByExt(parts[1])
+			if err != nil {
+				continue
+			}
+			prefix, err := url.QueryUnescape(parts[0])
+			if err != nil {
+				return err
+			}
+			key, err := url.QueryUnescape(strings.TrimSuffix(parts[1], codec.Ext()))
+			if err != nil {
+				return err
+			}
+			if _, ok := a.items[prefix]; !ok {
+				a.items[prefix] = map[string]*archiveItem{}
+			}
+			a.items[prefix][key] = &archiveItem{codec: codec, buf: files[name]}
+		}
+	}
+	return nil
+}
+
+func (a *Archive) MetaData() map[string]string {
+	a.RLock()
+	defer a.RUnlock()
+	res := map[string]string{}
+	for k, v := range a.meta {
+		res[k] = v
+	}
+	return res
+}
+
+func (a *Archive) SetMetaData(vals map[string]string) error {
+	a.Lock()
+	defer a.Unlock()
+	if a.readOnly {
+		return UnWritable("metadata")
+	}
+	a.meta = map[string]string{}
+	for k, v := range vals {
+		a.meta[k] = v
+	}
+	if n, ok := vals["Name"]; ok {
+		a.name = n
+	}
+	a.dirty = true
+	return nil
+}
+
+func (a *Archive) Prefixes() ([]string, error) {
+	a.RLock()
+	defer a.RUnlock()
+	a.panicIfClosed()
+	res := []string{}
+	for k := range a.items {
+		res = append(res, k)
+	}
+	return res, nil
+}
+
+func (a *Archive) Keys(prefix string) ([]string, error) {
+	a.RLock()
+	defer a.RUnlock()
+	a.panicIfClosed()
+	res := []string{}
+	for k := range a.items[prefix] {
+		res = append(res, k)
+	}
+	return res, nil
+}
+
+func (a *Archive) Exists(prefix, key string) bool {
+	a.RLock()
+	defer a.RUnlock()
+	a.panicIfClosed()
+	_, ok := a.items[prefix][key]
+	return ok
+}
+
+func (a *Archive) Load(prefix, key string, val interface{}) error {
+	a.RLock()
+	defer a.RUnlock()
+	a.panicIfClosed()
+	item, ok := a.items[prefix][key]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if err := item.codec.Decode(item.buf, val); err != nil {
+		return err
+	}
+	if ro, ok := val.(ReadOnlySetter); ok {
+		ro.SetReadOnly(a.readOnly)
+	}
+	if bb, ok := val.(BundleSetter); ok {
+		n := a.Name()
+		if n != "" {
+			bb.SetBundle(n)
+		}
+	}
+	return nil
+}
+
+func (a *Archive) Save(prefix, key string, val interface{}) error {
+	a.Lock()
+	defer a.Unlock()
+	a.panicIfClosed()
+	if a.readOnly {
+		return UnWritable(key)
+	}
+	buf, err := a.Encode(val)
+	if err != nil {
+		return err
+	}
+	if _, ok := a.items[prefix]; !ok {
+		a.items[prefix] = map[string]*archiveItem{}
+	}
+	a.items[prefix][key] = &archiveItem{codec: a.Codec, buf: buf}
+	a.dirty = true
+	a.watchers.notify(prefix, key, WatchSave)
+	return nil
+}
+
+func (a *Archive) Remove(prefix, key string) error {
+	a.Lock()
+	defer a.Unlock()
+	a.panicIfClosed()
+	if _, ok := a.items[prefix][key]; !ok {
+		return os.ErrNotExist
+	}
+	if a.readOnly {
+		return UnWritable(key)
+	}
+	delete(a.items[prefix], key)
+	a.dirty = true
+	a.watchers.notify(prefix, key, WatchRemove)
+	return nil
+}
+
+// Begin starts a transaction against the Archive store.
+func (a *Archive) Begin() (Txn, error) {
+	a.panicIfClosed()
+	return &txn{codec: a.Codec, readOnly: a.ReadOnly, commit: a.commit}, nil
+}
+
+func (a *Archive) commit(ops []txnOp) error {
+	a.Lock()
+	defer a.Unlock()
+	a.panicIfClosed()
+	if a.readOnly {
+		return UnWritable(ops[0].key)
+	}
+	if err := checkOps(ops, func(prefix, key string) bool {
+		_, ok := a.items[prefix][key]
+		return ok
+	}); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.remove {
+			delete(a.items[op.prefix], op.key)
+			continue
+		}
+		if _, ok := a.items[op.prefix]; !ok {
+			a.items[op.prefix] = map[string]*archiveItem{}
+		}
+		a.items[op.prefix][op.key] = &archiveItem{codec: a.Codec, buf: op.buf}
+	}
+	a.dirty = true
+	a.notifyOps(ops)
+	return nil
+}
+
+// Flush writes any changes made to a Writable Archive out to Path.
+// Close also writes changes out, but it cannot report errors.
+func (a *Archive) Flush() error {
+	a.Lock()
+	defer a.Unlock()
+	a.panicIfClosed()
+	return a.flush()
+}
+
+func (a *Archive) flush() error {
+	if !a.dirty {
+		return nil
+	}
+	files := map[string][]byte{}
+	for k, v := range a.meta {
+		files["._"+k+".meta"] = []byte(v)
+	}
+	for prefix, items := range a.items {
+		for key, item := range items {
+			files[url.QueryEscape(prefix)+"/"+url.QueryEscape(key)+item.codec.Ext()] = item.buf
+		}
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := &bytes.Buffer{}
+	if err := writeArchive(out, archiveFormat(a.Path), names, files); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.Path), 0755); err != nil {
+		return err
+	}
+	if err := safeReplace(a.Path, out.Bytes()); err != nil {
+		return err
+	}
+	a.dirty = false
+	return nil
+}
+
+func writeArchive(out io.Writer, format string, names []string, files map[string][]byte) error {
+	now := time.Now()
+	if format == "zip" {
+		zw := zip.NewWriter(out)
+		for _, name := range names {
+			hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+			hdr.SetModTime(now)
+			hdr.SetMode(0644)
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(files[name]); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
+	var gz *gzip.Writer
+	if format == "tgz" {
+		gz = gzip.NewWriter(out)
+		out = gz
+	}
+	tw := tar.NewWriter(out)
+	dirs := map[string]bool{}
+	for _, name := range names {
+		if dir := path.Dir(name); dir != "." && !dirs[dir] {
+			dirs[dir] = true
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     dir + "/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  now,
+			}); err != nil {
+				return err
+			}
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			ModTime:  now,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt implements a Store that is backed by a bbolt database.  All
+// data is kept in a single top-level bucket.  Each prefix gets its
+// own nested bucket, and metadata is kept as plain keys in the
+// top-level bucket.
+type Bolt struct {
+	storeBase
+	Path   string
+	Bucket []byte
+	db     *bolt.DB
+}
+
+func (b *Bolt) Type() string {
+	return "bolt"
+}
+
+func (b *Bolt) dbName() string {
+	return filepath.Join(b.Path, "bolt.db")
+}
+
+func (b *Bolt) Open(codec Codec) error {
+	if b.Path == "" {
+		return fmt.Errorf("Cannot store data at ''")
+	}
+	fullPath, err := filepath.Abs(filepath.Clean(b.Path))
+	if err != nil {
+		return err
+	}
+	b.Path = fullPath
+	if err := os.MkdirAll(b.Path, 0755); err != nil {
+		return err
+	}
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	b.Codec = codec
+	if len(b.Bucket) == 0 {
+		b.Bucket = []byte("Store")
+	}
+	db, err := bolt.Open(b.dbName(), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(b.Bucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return err
+	}
+	b.db = db
+	b.closer = func() {
+		b.db.Close()
+	}
+	b.opened = true
+	md := b.MetaData()
+	if n, ok := md["Name"]; ok {
+		b.name = n
+	}
+	return nil
+}
+
+func (b *Bolt) view(fn func(*bolt.Bucket) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(b.Bucket))
+	})
+}
+
+func (b *Bolt) update(fn func(*bolt.Bucket) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(b.Bucket))
+	})
+}
+
+func (b *Bolt) MetaData() map[string]string {
+	b.RLock()
+	defer b.RUnlock()
+	res := map[string]string{}
+	b.view(func(bucket *bolt.Bucket) error {
+		return bucket.ForEach(func(k, v []byte) error {
+			// Nested buckets have nil values, and hold our prefixes.
+			if v != nil {
+				res[string(k)] = string(v)
+			}
+			return nil
+		})
+	})
+	return res
+}
+
+func (b *Bolt) SetMetaData(vals map[string]string) error {
+	b.Lock()
+	defer b.Unlock()
+	err := b.update(func(bucket *bolt.Bucket) error {
+		toRemove := [][]byte{}
+		if err := bucket.ForEach(func(k, v []byte) error {
+			if v != nil {
+				toRemove = append(toRemove, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range toRemove {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		for k, v := range vals {
+			if err := bucket.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if n, ok := vals["Name"]; ok {
+		b.name = n
+	}
+	return nil
+}
+
+func (b *Bolt) Prefixes() ([]string, error) {
+	b.RLock()
+	defer b.RUnlock()
+	b.panicIfClosed()
+	res := []string{}
+	err := b.view(func(bucket *bolt.Bucket) error {
+		return bucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				res = append(res, string(k))
+			}
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (b *Bolt) Keys(prefix string) ([]string, error) {
+	b.RLock()
+	defer b.RUnlock()
+	b.panicIfClosed()
+	res := []string{}
+	err := b.view(func(bucket *bolt.Bucket) error {
+		sub := bucket.Bucket([]byte(prefix))
+		if sub == nil {
+			return nil
+		}
+		return sub.ForEach(func(k, v []byte) error {
+			res = append(res, string(k))
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (b *Bolt) Exists(prefix, key string) bool {
+	b.RLock()
+	defer b.RUnlock()
+	b.panicIfClosed()
+	found := false
+	b.view(func(bucket *bolt.Bucket) error {
+		if sub := bucket.Bucket([]byte(prefix)); sub != nil {
+			found = sub.Get([]byte(key)) != nil
+		}
+		return nil
+	})
+	return found
+}
+
+// LoadRaw returns the encoded value of key without decoding it.
+func (b *Bolt) LoadRaw(prefix, key string) ([]byte, error) {
+	b.RLock()
+	defer b.RUnlock()
+	b.panicIfClosed()
+	return b.loadRaw(prefix, key)
+}
+
+// loadRaw must be called with b locked.
+func (b *Bolt) loadRaw(prefix, key string) ([]byte, error) {
+	var buf []byte
+	err := b.view(func(bucket *bolt.Bucket) error {
+		sub := bucket.Bucket([]byte(prefix))
+		if sub == nil {
+			return os.ErrNotExist
+		}
+		v := sub.Get([]byte(key))
+		if v == nil {
+			return os.ErrNotExist
+		}
+		// Values returned by Get are only valid for the life of the transaction.
+		buf = make([]byte, len(v))
+		copy(buf, v)
+		return nil
+	})
+	return buf, err
+}
+
+func (b *Bolt) Load(prefix, key string, val interface{}) error {
+	b.RLock()
+	defer b.RUnlock()
+	b.panicIfClosed()
+	buf, err := b.loadRaw(prefix, key)
+	if err != nil {
+		return err
+	}
+	if err := b.Decode(buf, val); err != nil {
+		return err
+	}
+	if ro, ok := val.(ReadOnlySetter); ok {
+		ro.SetReadOnly(b.readOnly)
+	}
+	if bb, ok := val.(BundleSetter); ok {
+		n := b.Name()
+		if n != "" {
+			bb.SetBundle(n)
+		}
+	}
+	return nil
+}
+
+func (b *Bolt) Save(prefix, key string, val interface{}) error {
+	b.Lock()
+	defer b.Unlock()
+	b.panicIfClosed()
+	if b.readOnly {
+		return UnWritable(key)
+	}
+	buf, err := b.Encode(val)
+	if err != nil {
+		return err
+	}
+	err = b.update(func(bucket *bolt.Bucket) error {
+		sub, err := bucket.CreateBucketIfNotExists([]byte(prefix))
+		if err != nil {
+			return err
+		}
+		return sub.Put([]byte(key), buf)
+	})
+	if err == nil {
+		b.watchers.notify(prefix, key, WatchSave)
+	}
+	return err
+}
+
+func (b *Bolt) Remove(prefix, key string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.panicIfClosed()
+	if b.readOnly {
+		return UnWritable(key)
+	}
+	err := b.update(func(bucket *bolt.Bucket) error {
+		sub := bucket.Bucket([]byte(prefix))
+		if sub == nil || sub.Get([]byte(key)) == nil {
+			return os.ErrNotExist
+		}
+		return sub.Delete([]byte(key))
+	})
+	if err == nil {
+		b.watchers.notify(prefix, key, WatchRemove)
+	}
+	return err
+}
+
+// Begin starts a transaction against the Bolt store.  All of the
+// operations are applied in a single bbolt update transaction.
+func (b *Bolt) Begin() (Txn, error) {
+	b.panicIfClosed()
+	return &txn{codec: b.Codec, readOnly: b.ReadOnly, commit: b.commit}, nil
+}
+
+func (b *Bolt) commit(ops []txnOp) error {
+	b.Lock()
+	defer b.Unlock()
+	b.panicIfClosed()
+	if b.readOnly {
+		return UnWritable(ops[0].key)
+	}
+	err := b.update(func(bucket *bolt.Bucket) error {
+		if err := checkOps(ops, func(prefix, key string) bool {
+			sub := bucket.Bucket([]byte(prefix))
+			return sub != nil && sub.Get([]byte(key)) != nil
+		}); err != nil {
+			return err
+		}
+		for _, op := range ops {
+			sub, err := bucket.CreateBucketIfNotExists([]byte(op.prefix))
+			if err != nil {
+				return err
+			}
+			if op.remove {
+				err = sub.Delete([]byte(op.key))
+			} else {
+				err = sub.Put([]byte(op.key), op.buf)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		b.notifyOps(ops)
+	}
+	return err
+}
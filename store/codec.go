@@ -1,9 +1,17 @@
 package store
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/ghodss/yaml"
+	"github.com/vmihailenco/msgpack/v4"
 )
 
 type codec struct {
@@ -54,4 +62,148 @@ var YamlCodec = &codec{
 	ext: ".yaml",
 }
 
+func gzipCodec(inner *codec) *codec {
+	return &codec{
+		enc: func(i interface{}) ([]byte, error) {
+			buf, err := inner.enc(i)
+			if err != nil {
+				return nil, err
+			}
+			res := &bytes.Buffer{}
+			zw := gzip.NewWriter(res)
+			if _, err := zw.Write(buf); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			return res.Bytes(), nil
+		},
+		dec: func(buf []byte, i interface{}) error {
+			zr, err := gzip.NewReader(bytes.NewReader(buf))
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			plain, err := ioutil.ReadAll(zr)
+			if err != nil {
+				return err
+			}
+			return inner.dec(plain, i)
+		},
+		ext: inner.ext + ".gz",
+	}
+}
+
+// JsonGzCodec implements a Codec for encoding/decoding to gzip
+// compressed JSON.
+var JsonGzCodec = gzipCodec(JsonCodec)
+
+// YamlGzCodec implements a Codec for encoding/decoding to gzip
+// compressed YAML.
+var YamlGzCodec = gzipCodec(YamlCodec)
+
+// stringKeys converts any map[interface{}]interface{} that a binary
+// decoder hands back into a map[string]interface{} that encoding/json
+// can handle.
+func stringKeys(i interface{}) interface{} {
+	switch v := i.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			res[fmt.Sprintf("%v", k)] = stringKeys(val)
+		}
+		return res
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = stringKeys(val)
+		}
+		return v
+	case []interface{}:
+		for idx, val := range v {
+			v[idx] = stringKeys(val)
+		}
+		return v
+	default:
+		return i
+	}
+}
+
+// binaryCodec builds a Codec around a binary serialization format.
+// Values are run through JSON first, so that objects wind up with the
+// same field names and custom marshalling that JsonCodec gives them.
+func binaryCodec(marshal func(interface{}) ([]byte, error),
+	unmarshal func([]byte, interface{}) error,
+	ext string) *codec {
+	return &codec{
+		enc: func(i interface{}) ([]byte, error) {
+			var generic interface{}
+			if err := remarshal(i, &generic); err != nil {
+				return nil, err
+			}
+			return marshal(generic)
+		},
+		dec: func(buf []byte, i interface{}) error {
+			var generic interface{}
+			if err := unmarshal(buf, &generic); err != nil {
+				return err
+			}
+			return remarshal(stringKeys(generic), i)
+		},
+		ext: ext,
+	}
+}
+
+// CborCodec implements a Codec for encoding/decoding to CBOR.
+var CborCodec = binaryCodec(cbor.Marshal, cbor.Unmarshal, ".cbor")
+
+// MsgpackCodec implements a Codec for encoding/decoding to MessagePack.
+var MsgpackCodec = binaryCodec(msgpack.Marshal, msgpack.Unmarshal, ".msgpack")
+
 var DefaultCodec = JsonCodec
+
+var codecs = map[string]Codec{
+	"json":    JsonCodec,
+	"yaml":    YamlCodec,
+	"json.gz": JsonGzCodec,
+	"yaml.gz": YamlGzCodec,
+	"cbor":    CborCodec,
+	"msgpack": MsgpackCodec,
+}
+
+// CodecByName returns the Codec for one of the codec names that
+// store.Open accepts.
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case "", "default":
+		return DefaultCodec, nil
+	case "yml":
+		name = "yaml"
+	case "yml.gz":
+		name = "yaml.gz"
+	}
+	if c, ok := codecs[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("Unknown codec %s", name)
+}
+
+// CodecByExt returns the Codec whose extension the filename ends
+// with, along with the name of the codec.  .yml is treated as .yaml.
+func CodecByExt(filename string) (Codec, string, error) {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	// Check longer extensions first, so .json.gz wins over .gz
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	for _, name := range names {
+		c := codecs[name]
+		ext := c.Ext()
+		if strings.HasSuffix(filename, ext) ||
+			strings.HasSuffix(filename, strings.Replace(ext, ".yaml", ".yml", 1)) {
+			return c, name, nil
+		}
+	}
+	return nil, "", fmt.Errorf("Unknown store extension for %s", filename)
+}
@@ -7,24 +7,27 @@ import (
 	"os"
 	"path"
 	"sync"
+	"time"
 )
 
+func syncWrite(name string, contents []byte) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(contents); err == nil {
+		err = f.Sync()
+	}
+	return err
+}
+
 func safeReplace(name string, contents []byte) error {
 	if err := os.MkdirAll(path.Dir(name), 0700); err != nil {
 		return err
 	}
 	tmpName := path.Join(path.Dir(name), ".new."+path.Base(name))
-	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
-	if err != nil {
-		return err
-	}
-	func() {
-		defer f.Close()
-		if _, err = f.Write(contents); err == nil {
-			err = f.Sync()
-		}
-	}()
-	if err != nil {
+	if err := syncWrite(tmpName, contents); err != nil {
 		return err
 	}
 	return os.Rename(tmpName, name)
@@ -38,15 +41,36 @@ func safeReplace(name string, contents []byte) error {
 // storeType://host:port/path?codec=codecType&ro=false&option=foo for stores
 // that need to talk over the network.
 //
-// All store types take codec and ro as optional parameters
+// All store types take codec and ro as optional parameters.  codec
+// can be one of json, yaml, json.gz, yaml.gz, cbor, or msgpack.  They
+// also take keyfile or keyenv, which name a file or an environment
+// variable holding a hex or base64 encoded 32 byte key.  If either is
+// present, everything the store encodes is sealed with that key using
+// SealedCodec.
 //
 // The following storeTypes are known:
 //   * file, in which path refers to a single local file.
 //   * directory, in which path refers to a top-level directory
+//     file and directory take an optional lock=true parameter, which
+//     makes them take flock based locks on path.lock so several
+//     processes can safely share the store, and an optional
+//     locktimeout parameter saying how long to wait for the lock.
 //   * bolt, in which path refers to the directory where the Bolt database
 //     is located.  bolt also takes an optional bucket parameter to specify the
 //     top-level bucket data is stored in.
+//   * sqlite, in which path refers to a single SQLite database file.
+//     sqlite is only available in binaries built with cgo.
+//   * git, in which path refers to the top of a local git repository.
+//     Data is laid out like the directory store, and every change is
+//     committed.  git takes optional branch, author, and email parameters.
+//   * archive, in which path refers to a tar, tar.gz, tgz, or zip file
+//     laid out like the directory store.  Archives are read-only unless
+//     the write=true parameter is given, in which case changes are
+//     written back to path when the store is closed.
 //   * memory, in which path does not mean anything.
+//   * http and https, in which host:port/path is where a Store is
+//     being exposed by Serve.  Values always travel as JSON, so the
+//     codec, keyfile, and keyenv parameters are refused.
 //
 func Open(locator string) (Store, error) {
 	uri, err := url.Parse(locator)
@@ -54,18 +78,17 @@ func Open(locator string) (Store, error) {
 		return nil, err
 	}
 	params := uri.Query()
-	codec := DefaultCodec
 	readOnly := false
-	codecParam := params.Get("codec")
-	switch codecParam {
-	case "yaml":
-		codec = YamlCodec
-	case "json":
-		codec = JsonCodec
-	case "", "default":
-		codec = DefaultCodec
-	default:
-		return nil, fmt.Errorf("Unknown codec %s", codecParam)
+	codec, err := CodecByName(params.Get("codec"))
+	if err != nil {
+		return nil, err
+	}
+	if keyFile, keyEnv := params.Get("keyfile"), params.Get("keyenv"); keyFile != "" || keyEnv != "" {
+		key, err := LoadKey(keyFile, keyEnv)
+		if err != nil {
+			return nil, err
+		}
+		codec = SealedCodec(codec, key)
 	}
 	roParam := params.Get("ro")
 	switch roParam {
@@ -76,6 +99,20 @@ func Open(locator string) (Store, error) {
 	default:
 		return nil, fmt.Errorf("Unknown ro value %s. Try true or false", roParam)
 	}
+	fileLock := false
+	switch lockParam := params.Get("lock"); lockParam {
+	case "true", "yes", "1":
+		fileLock = true
+	case "false", "no", "0", "":
+	default:
+		return nil, fmt.Errorf("Unknown lock value %s. Try true or false", lockParam)
+	}
+	var lockTimeout time.Duration
+	if lt := params.Get("locktimeout"); lt != "" {
+		if lockTimeout, err = time.ParseDuration(lt); err != nil {
+			return nil, fmt.Errorf("Invalid locktimeout %s: %v", lt, err)
+		}
+	}
 	var res Store
 	path := uri.Opaque
 	if path == "" {
@@ -85,11 +122,41 @@ func Open(locator string) (Store, error) {
 	case "stack":
 		res = &StackedStore{}
 	case "file":
-		res = &File{Path: path}
+		res = &File{Path: path, FileLock: fileLock, LockTimeout: lockTimeout}
 	case "directory":
-		res = &Directory{Path: path}
+		res = &Directory{Path: path, FileLock: fileLock, LockTimeout: lockTimeout}
+	case "bolt":
+		res = &Bolt{Path: path, Bucket: []byte(params.Get("bucket"))}
+	case "sqlite":
+		res = &SQLite{Path: path}
+	case "git":
+		res = &Git{
+			Directory: Directory{Path: path},
+			Branch:    params.Get("branch"),
+			Author:    params.Get("author"),
+			Email:     params.Get("email"),
+		}
+	case "archive":
+		writable := false
+		switch writeParam := params.Get("write"); writeParam {
+		case "true", "yes", "1":
+			writable = true
+		case "false", "no", "0", "":
+		default:
+			return nil, fmt.Errorf("Unknown write value %s. Try true or false", writeParam)
+		}
+		res = &Archive{Path: path, Writable: writable}
 	case "memory":
 		res = &Memory{}
+	case "http", "https":
+		// Values always travel as JSON, so a codec or key would
+		// silently not be used.
+		for _, param := range []string{"codec", "keyfile", "keyenv"} {
+			if params.Get(param) != "" {
+				return nil, fmt.Errorf("%s stores do not take a %s parameter", uri.Scheme, param)
+			}
+		}
+		res = &Remote{URL: (&url.URL{Scheme: uri.Scheme, Host: uri.Host, Path: uri.Path}).String()}
 	}
 	if res == nil {
 		return nil, fmt.Errorf("Unknown schema type: %s", uri.Scheme)
@@ -154,6 +221,7 @@ type MetaSaver interface {
 
 // Copy copies all of the contents from src to dest, including substores and
 // metadata.  If dst starts out empty, then dst will wind up being a clone of src.
+// If dst is a Transactor, all the values are written in a single transaction.
 func Copy(dst, src Store) error {
 	src.RLock()
 	defer src.RUnlock()
@@ -168,22 +236,29 @@ func Copy(dst, src Store) error {
 	if err != nil {
 		return err
 	}
+	txn, err := Begin(dst)
+	if err != nil {
+		return err
+	}
 	for _, prefix := range prefixes {
 		keys, err := src.Keys(prefix)
 		if err != nil {
+			txn.Rollback()
 			return err
 		}
 		for _, key := range keys {
 			var val interface{}
 			if err := src.Load(prefix, key, &val); err != nil {
+				txn.Rollback()
 				return err
 			}
-			if err := dst.Save(prefix, key, val); err != nil {
+			if err := txn.Save(prefix, key, val); err != nil {
+				txn.Rollback()
 				return err
 			}
 		}
 	}
-	return nil
+	return txn.Commit()
 }
 
 type forceCloser interface {
@@ -212,6 +287,7 @@ type storeBase struct {
 	parentStore Store
 	closer      func()
 	name        string
+	watchers    watchHub
 }
 
 func (s *storeBase) Name() string {
@@ -230,6 +306,7 @@ func (s *storeBase) Close() {
 	if s.closer != nil {
 		s.closer()
 	}
+	s.watchers.closeAll()
 	s.opened = false
 }
 
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"github.com/VictorLowther/jsonpatch2"
+)
+
+// PrefixDiff describes how the keys in one prefix differ between two
+// Stores.
+type PrefixDiff struct {
+	// Added lists the keys that are only in the second Store.
+	Added []string `json:",omitempty"`
+	// Removed lists the keys that are only in the first Store.
+	Removed []string `json:",omitempty"`
+	// Changed holds a JSON patch for every key that is in both
+	// Stores with different values.  Applying the patch to the value
+	// from the first Store yields the value from the second.
+	Changed map[string]jsonpatch2.Patch `json:",omitempty"`
+}
+
+// Conflict describes a key that Merge could not reconcile.  Base,
+// Ours, and Theirs hold the value of the key in each Store, or nil
+// if the key is not there.
+type Conflict struct {
+	Prefix string
+	Key    string
+	Base   interface{}
+	Ours   interface{}
+	Theirs interface{}
+}
+
+// allKeys returns every key in s, grouped by prefix.
+func allKeys(s Store) (map[string]map[string]bool, error) {
+	res := map[string]map[string]bool{}
+	prefixes, err := s.Prefixes()
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		keys, err := s.Keys(prefix)
+		if err != nil {
+			return nil, err
+		}
+		res[prefix] = map[string]bool{}
+		for _, key := range keys {
+			res[prefix][key] = true
+		}
+	}
+	return res, nil
+}
+
+// loadJSON loads key from s and returns it as JSON, so that values
+// from Stores using different codecs can be compared.  It returns
+// nil if the key is not in s.
+func loadJSON(s Store, keys map[string]map[string]bool, prefix, key string) ([]byte, error) {
+	if !keys[prefix][key] {
+		return nil, nil
+	}
+	var val interface{}
+	if err := s.Load(prefix, key, &val); err != nil {
+		return nil, err
+	}
+	return json.Marshal(val)
+}
+
+// Diff returns how b differs from a for every prefix that has
+// differences.  Changed values are described by JSON patches built
+// the same way models.GenPatch builds them, so they include tests
+// that make sure they are only applied to the value from a.
+func Diff(a, b Store) (map[string]*PrefixDiff, error) {
+	res := map[string]*PrefixDiff{}
+	aKeys, err := allKeys(a)
+	if err != nil {
+		return nil, err
+	}
+	bKeys, err := allKeys(b)
+	if err != nil {
+		return nil, err
+	}
+	get := func(prefix string) *PrefixDiff {
+		if _, ok := res[prefix]; !ok {
+			res[prefix] = &PrefixDiff{Added: []string{}, Removed: []string{}, Changed: map[string]jsonpatch2.Patch{}}
+		}
+		return res[prefix]
+	}
+	for prefix, keys := range aKeys {
+		for key := range keys {
+			if !bKeys[prefix][key] {
+				pd := get(prefix)
+				pd.Removed = append(pd.Removed, key)
+				continue
+			}
+			aBuf, err := loadJSON(a, aKeys, prefix, key)
+			if err != nil {
+				return nil, err
+			}
+			bBuf, err := loadJSON(b, bKeys, prefix, key)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Equal(aBuf, bBuf) {
+				continue
+			}
+			patch, err := jsonpatch2.GenerateFull(aBuf, bBuf, true, false)
+			if err != nil {
+				return nil, err
+			}
+			get(prefix).Changed[key] = patch
+		}
+	}
+	for prefix, keys := range bKeys {
+		for key := range keys {
+			if !aKeys[prefix][key] {
+				pd := get(prefix)
+				pd.Added = append(pd.Added, key)
+			}
+		}
+	}
+	for _, pd := range res {
+		sort.Strings(pd.Added)
+		sort.Strings(pd.Removed)
+	}
+	return res, nil
+}
+
+// sameJSON returns whether x and y are the same value, where nil
+// means the key is missing.
+func sameJSON(x, y []byte) bool {
+	return (x == nil) == (y == nil) && bytes.Equal(x, y)
+}
+
+func jsonValue(buf []byte) interface{} {
+	if buf == nil {
+		return nil
+	}
+	var res interface{}
+	json.Unmarshal(buf, &res)
+	return res
+}
+
+// mergeValues tries to combine the changes made to base by ours and
+// theirs.  Each side's changes are patched onto the other, and if
+// both come out the same, that is the result.  It returns nil if the
+// changes overlap.
+func mergeValues(base, ours, theirs []byte) ([]byte, error) {
+	theirPatch, err := jsonpatch2.GenerateFull(base, theirs, true, false)
+	if err != nil {
+		return nil, err
+	}
+	ourPatch, err := jsonpatch2.GenerateFull(base, ours, true, false)
+	if err != nil {
+		return nil, err
+	}
+	a, err, _ := theirPatch.Apply(ours)
+	if err != nil {
+		return nil, nil
+	}
+	b, err, _ := ourPatch.Apply(theirs)
+	if err != nil {
+		return nil, nil
+	}
+	var aVal, bVal interface{}
+	json.Unmarshal(a, &aVal)
+	json.Unmarshal(b, &bVal)
+	if !reflect.DeepEqual(aVal, bVal) {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// Merge brings the changes made between base and theirs into ours,
+// and returns the keys it could not reconcile.  For each key:
+//
+//   - if theirs did not change it, or both sides made the same change,
+//     ours is left alone.
+//   - if only theirs changed it, the change is copied into ours.
+//   - if both sides changed different parts of the same value, the
+//     value is saved with both sets of changes.
+//   - anything else, including one side removing a key the other
+//     changed, is a Conflict, and ours is left alone.
+//
+// All the changes are written to ours in one transaction, even if
+// there are conflicts.
+func Merge(base, ours, theirs Store) ([]Conflict, error) {
+	conflicts := []Conflict{}
+	baseKeys, err := allKeys(base)
+	if err != nil {
+		return nil, err
+	}
+	ourKeys, err := allKeys(ours)
+	if err != nil {
+		return nil, err
+	}
+	theirKeys, err := allKeys(theirs)
+	if err != nil {
+		return nil, err
+	}
+	todo := map[string]map[string]bool{}
+	for _, keys := range []map[string]map[string]bool{baseKeys, theirKeys} {
+		for prefix, pk := range keys {
+			if _, ok := todo[prefix]; !ok {
+				todo[prefix] = map[string]bool{}
+			}
+			for key := range pk {
+				todo[prefix][key] = true
+			}
+		}
+	}
+	prefixes := make([]string, 0, len(todo))
+	for prefix := range todo {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	txn, err := Begin(ours)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		keys := make([]string, 0, len(todo[prefix]))
+		for key := range todo[prefix] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			bufs := [3][]byte{}
+			for i, src := range []struct {
+				s    Store
+				keys map[string]map[string]bool
+			}{{base, baseKeys}, {ours, ourKeys}, {theirs, theirKeys}} {
+				if bufs[i], err = loadJSON(src.s, src.keys, prefix, key); err != nil {
+					txn.Rollback()
+					return nil, err
+				}
+			}
+			baseBuf, ourBuf, theirBuf := bufs[0], bufs[1], bufs[2]
+			switch {
+			case sameJSON(baseBuf, theirBuf), sameJSON(ourBuf, theirBuf):
+				continue
+			case sameJSON(baseBuf, ourBuf):
+				if theirBuf == nil {
+					err = txn.Remove(prefix, key)
+				} else {
+					err = txn.Save(prefix, key, jsonValue(theirBuf))
+				}
+				if err != nil {
+					txn.Rollback()
+					return nil, err
+				}
+				continue
+			case baseBuf != nil && ourBuf != nil && theirBuf != nil:
+				merged, err := mergeValues(baseBuf, ourBuf, theirBuf)
+				if err != nil {
+					txn.Rollback()
+					return nil, err
+				}
+				if merged != nil {
+					if err := txn.Save(prefix, key, jsonValue(merged)); err != nil {
+						txn.Rollback()
+						return nil, err
+					}
+					continue
+				}
+			}
+			conflicts = append(conflicts, Conflict{
+				Prefix: prefix,
+				Key:    key,
+				Base:   jsonValue(baseBuf),
+				Ours:   jsonValue(ourBuf),
+				Theirs: jsonValue(theirBuf),
+			})
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/url"
@@ -8,12 +9,24 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Directory implements a Store that is backed by a local directory tree.
 type Directory struct {
 	storeBase
 	Path string
+	// FileLock turns on advisory locking against other processes
+	// using the same directory, with Path.lock as the lock file.
+	FileLock bool
+	// LockTimeout is how long to wait for other processes to let go
+	// of the lock.  It defaults to DefaultLockTimeout.
+	LockTimeout time.Duration
+	// fsWatch is set when changes are being picked up from the
+	// filesystem instead of from calls to Save and Remove.
+	fsWatch int32
+	flock   *fileLock
 }
 
 func (d *Directory) Type() string {
@@ -24,8 +37,35 @@ func (f *Directory) filename(p, n string) string {
 	return filepath.Join(f.Path, url.QueryEscape(p), url.QueryEscape(n))
 }
 
+// shared takes a shared cross-process lock if FileLock is set.
+func (f *Directory) shared() (func(), error) {
+	if f.flock == nil {
+		return func() {}, nil
+	}
+	if err := f.flock.rlock(); err != nil {
+		return nil, err
+	}
+	return f.flock.runlock, nil
+}
+
+// exclusive takes an exclusive cross-process lock if FileLock is set.
+func (f *Directory) exclusive() (func(), error) {
+	if f.flock == nil {
+		return func() {}, nil
+	}
+	if err := f.flock.lock(); err != nil {
+		return nil, err
+	}
+	return f.flock.unlock, nil
+}
+
 func (f *Directory) entsFor(p string, dir bool) ([]string, error) {
 	f.panicIfClosed()
+	unlock, err := f.shared()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	d, err := os.Open(p)
 	if err != nil {
 		return nil, err
@@ -41,6 +81,10 @@ func (f *Directory) entsFor(p string, dir bool) ([]string, error) {
 			continue
 		}
 		name := info.Name()
+		if dir && strings.HasPrefix(name, ".") {
+			// Skip transaction staging directories.
+			continue
+		}
 		if !dir {
 			if !strings.HasSuffix(name, f.Ext()) {
 				continue
@@ -69,6 +113,11 @@ func (d *Directory) MetaData() (res map[string]string) {
 	d.RLock()
 	defer d.RUnlock()
 	res = map[string]string{}
+	unlock, err := d.shared()
+	if err != nil {
+		return
+	}
+	defer unlock()
 	dir, err := os.Open(d.Path)
 	if err != nil {
 		return
@@ -107,6 +156,11 @@ func (d *Directory) MetaData() (res map[string]string) {
 func (d *Directory) SetMetaData(vals map[string]string) error {
 	d.Lock()
 	defer d.Unlock()
+	unlock, err := d.exclusive()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	written := map[string]struct{}{}
 	for k, v := range vals {
 		fileName := d.filename("", "._"+k+".meta")
@@ -164,7 +218,33 @@ func (f *Directory) Open(codec Codec) error {
 	if err != nil {
 		return err
 	}
+	if f.FileLock {
+		l, err := newFileLock(fullPath+".lock", f.LockTimeout)
+		if err != nil {
+			return err
+		}
+		if err := l.rlock(); err != nil {
+			l.close()
+			return err
+		}
+		l.runlock()
+		f.flock = l
+		f.closer = l.close
+	}
+	unlock, err := f.exclusive()
+	if err != nil {
+		return err
+	}
+	err = f.recoverTxns()
+	unlock()
+	if err != nil {
+		if f.flock != nil {
+			f.flock.close()
+		}
+		return err
+	}
 	f.opened = true
+	f.watchers.started = f.startWatch
 	md := f.MetaData()
 	if n, ok := md["Name"]; ok {
 		f.name = n
@@ -178,9 +258,20 @@ func (f *Directory) Exists(prefix, key string) bool {
 	return err == nil && fi.Mode().IsRegular()
 }
 
-func (f *Directory) Load(prefix, key string, val interface{}) error {
+// LoadRaw returns the contents of the file holding key without
+// decoding them.
+func (f *Directory) LoadRaw(prefix, key string) ([]byte, error) {
 	f.panicIfClosed()
-	buf, err := ioutil.ReadFile(f.filename(prefix, key+f.Ext()))
+	unlock, err := f.shared()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return ioutil.ReadFile(f.filename(prefix, key+f.Ext()))
+}
+
+func (f *Directory) Load(prefix, key string, val interface{}) error {
+	buf, err := f.LoadRaw(prefix, key)
 	if err != nil {
 		return err
 	}
@@ -208,7 +299,22 @@ func (f *Directory) Save(prefix, key string, val interface{}) error {
 	if err != nil {
 		return err
 	}
-	return safeReplace(f.filename(prefix, key+f.Ext()), buf)
+	unlock, err := f.exclusive()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = safeReplace(f.filename(prefix, key+f.Ext()), buf)
+	if err == nil {
+		f.notify(prefix, key, WatchSave)
+	}
+	return err
+}
+
+func (f *Directory) notify(prefix, key string, op WatchOp) {
+	if atomic.LoadInt32(&f.fsWatch) == 0 {
+		f.watchers.notify(prefix, key, op)
+	}
 }
 
 func (f *Directory) Remove(prefix, key string) error {
@@ -216,5 +322,150 @@ func (f *Directory) Remove(prefix, key string) error {
 	if f.ReadOnly() {
 		return UnWritable(key)
 	}
-	return os.Remove(f.filename(prefix, key+f.Ext()))
+	unlock, err := f.exclusive()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(f.filename(prefix, key+f.Ext()))
+	if err == nil {
+		f.notify(prefix, key, WatchRemove)
+	}
+	return err
+}
+
+// Begin starts a transaction against the Directory store.  When the
+// transaction is committed, new values are written into a staging
+// directory first, along with a journal of every change to make.
+// Once the journal is in place the transaction counts as committed,
+// and if applying it is interrupted, the next Open finishes the job.
+func (f *Directory) Begin() (Txn, error) {
+	f.panicIfClosed()
+	return &txn{codec: f.Codec, readOnly: f.ReadOnly, commit: f.commit}, nil
+}
+
+// dirJournalOp is one change recorded in the journal of a Directory
+// transaction.  Target is relative to the top of the Directory, and
+// Staged is the name of the new contents in the staging directory,
+// or empty if Target is to be removed.
+type dirJournalOp struct {
+	Target string
+	Staged string `json:",omitempty"`
+}
+
+const dirJournal = "journal"
+
+// replay applies the journal of the transaction staged in staging.
+// It can be run again if it was interrupted, since staged files that
+// are gone have already been renamed into place.
+func (f *Directory) replay(staging string, journal []dirJournalOp) error {
+	for _, op := range journal {
+		target := filepath.Join(f.Path, op.Target)
+		if op.Staged == "" {
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(staging, op.Staged), target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverTxns finishes any transactions that were committed but not
+// applied when the Directory was last used, and throws away the ones
+// that never got as far as being committed.  It must be called with
+// the Directory locked.
+func (f *Directory) recoverTxns() error {
+	stagings, err := filepath.Glob(filepath.Join(f.Path, ".txn.*"))
+	if err != nil {
+		return err
+	}
+	for _, staging := range stagings {
+		buf, err := ioutil.ReadFile(filepath.Join(staging, dirJournal))
+		if err == nil {
+			journal := []dirJournalOp{}
+			if err := json.Unmarshal(buf, &journal); err != nil {
+				return fmt.Errorf("Corrupt transaction journal in %s: %v", staging, err)
+			}
+			if err := f.replay(staging, journal); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.RemoveAll(staging); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stage writes the new values from ops and the journal of changes
+// into staging.  The journal only shows up under its real name once
+// it has been completely written, which is what commits the
+// transaction.
+func (f *Directory) stage(staging string, ops []txnOp) ([]dirJournalOp, error) {
+	journal := make([]dirJournalOp, len(ops))
+	for i, op := range ops {
+		target, err := filepath.Rel(f.Path, f.filename(op.prefix, op.key+f.Ext()))
+		if err != nil {
+			return nil, err
+		}
+		journal[i].Target = target
+		if op.remove {
+			continue
+		}
+		journal[i].Staged = fmt.Sprintf("%d", i)
+		if err := syncWrite(filepath.Join(staging, journal[i].Staged), op.buf); err != nil {
+			return nil, err
+		}
+	}
+	buf, err := json.Marshal(journal)
+	if err != nil {
+		return nil, err
+	}
+	return journal, safeReplace(filepath.Join(staging, dirJournal), buf)
+}
+
+func (f *Directory) commit(ops []txnOp) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.readOnly {
+		return UnWritable(ops[0].key)
+	}
+	unlock, err := f.exclusive()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := checkOps(ops, f.Exists); err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(f.Path, ".txn.")
+	if err != nil {
+		return err
+	}
+	ops = finalOps(ops)
+	journal, err := f.stage(staging, ops)
+	if err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	// From here on the transaction is committed.  If applying it
+	// fails, the staging directory is left behind for the next Open
+	// to finish the job.
+	if err := f.replay(staging, journal); err != nil {
+		return err
+	}
+	os.RemoveAll(staging)
+	if atomic.LoadInt32(&f.fsWatch) == 0 {
+		f.notifyOps(ops)
+	}
+	return nil
 }
@@ -0,0 +1,178 @@
+// +build linux
+
+package store
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	dirWatchTopMask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+	dirWatchSubMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+)
+
+// dirWatch uses inotify to pick up changes made to a Directory
+// store, including ones made by other processes.
+type dirWatch struct {
+	*Directory
+	fd, epfd int
+	prefixes map[int32]string
+	done     chan struct{}
+}
+
+// startWatch is called the first time something watches a
+// Directory.  If inotify is not usable, the Directory falls back to
+// only reporting changes made through this Store.
+func (f *Directory) startWatch() {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		syscall.Close(fd)
+		return
+	}
+	ev := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, ev); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(fd)
+		return
+	}
+	w := &dirWatch{
+		Directory: f,
+		fd:        fd,
+		epfd:      epfd,
+		prefixes:  map[int32]string{},
+		done:      make(chan struct{}),
+	}
+	wd, err := syscall.InotifyAddWatch(fd, f.Path, dirWatchTopMask)
+	if err != nil {
+		w.close()
+		return
+	}
+	w.prefixes[int32(wd)] = ""
+	prefixes, _ := f.Prefixes()
+	for _, prefix := range prefixes {
+		w.addPrefix(prefix)
+	}
+	f.Lock()
+	closer := f.closer
+	f.closer = func() {
+		close(w.done)
+		if closer != nil {
+			closer()
+		}
+	}
+	f.Unlock()
+	atomic.StoreInt32(&f.fsWatch, 1)
+	go w.run()
+}
+
+func (w *dirWatch) close() {
+	syscall.Close(w.epfd)
+	syscall.Close(w.fd)
+}
+
+func (w *dirWatch) addPrefix(prefix string) {
+	wd, err := syscall.InotifyAddWatch(w.fd,
+		filepath.Join(w.Path, url.QueryEscape(prefix)),
+		dirWatchSubMask)
+	if err == nil {
+		w.prefixes[int32(wd)] = prefix
+	}
+}
+
+func (w *dirWatch) run() {
+	defer w.close()
+	events := make([]syscall.EpollEvent, 1)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		n, err := syscall.EpollWait(w.epfd, events, 500)
+		if err != nil && err != syscall.EINTR {
+			return
+		}
+		if n <= 0 {
+			continue
+		}
+		n, err = syscall.Read(w.fd, buf)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(raw.Len)], "\x00"))
+			offset = nameStart + int(raw.Len)
+			w.handle(raw.Wd, raw.Mask, name)
+		}
+	}
+}
+
+func (w *dirWatch) handle(wd int32, mask uint32, name string) {
+	prefix, ok := w.prefixes[wd]
+	if !ok {
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.prefixes, wd)
+		return
+	}
+	if name == "" || strings.HasPrefix(name, ".") {
+		return
+	}
+	if prefix == "" {
+		// Only new prefix directories are interesting at the top level.
+		if mask&syscall.IN_ISDIR == 0 || mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) == 0 {
+			return
+		}
+		newPrefix, err := url.QueryUnescape(name)
+		if err != nil {
+			return
+		}
+		for _, p := range w.prefixes {
+			if p == newPrefix {
+				return
+			}
+		}
+		w.addPrefix(newPrefix)
+		// Anything written before the watch was added would be missed.
+		keys, _ := w.Keys(newPrefix)
+		for _, key := range keys {
+			w.watchers.notify(newPrefix, key, WatchSave)
+		}
+		return
+	}
+	if mask&syscall.IN_ISDIR != 0 || !strings.HasSuffix(name, w.Ext()) {
+		return
+	}
+	key, err := url.QueryUnescape(strings.TrimSuffix(name, w.Ext()))
+	if err != nil {
+		return
+	}
+	switch {
+	case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+		w.watchers.notify(prefix, key, WatchSave)
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		// Editors frequently move a file aside and then replace it.
+		if _, err := os.Stat(w.filename(prefix, key+w.Ext())); err == nil {
+			return
+		}
+		w.watchers.notify(prefix, key, WatchRemove)
+	}
+}
@@ -0,0 +1,7 @@
+// +build !linux
+
+package store
+
+// startWatch is a no-op on platforms without inotify, so a Directory
+// only reports changes made through this Store.
+func (f *Directory) startWatch() {}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// SealedCorrupt is returned when sealed data cannot be opened, either
+// because it was tampered with or because the wrong key was used.
+var SealedCorrupt = errors.New("Sealed data corrupted or wrong key")
+
+// ParseKey turns a hex or base64 encoded string into a 32 byte
+// secretbox key.
+func ParseKey(s string) (*[32]byte, error) {
+	s = strings.TrimSpace(s)
+	var buf []byte
+	var err error
+	switch len(s) {
+	case 64:
+		buf, err = hex.DecodeString(s)
+	default:
+		buf, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode key: %v", err)
+	}
+	if len(buf) != 32 {
+		return nil, fmt.Errorf("Key must be 32 bytes long, not %d", len(buf))
+	}
+	res := &[32]byte{}
+	copy(res[:], buf)
+	return res, nil
+}
+
+// LoadKey loads a secretbox key from the file at keyFile, or from the
+// environment variable keyEnv if keyFile is empty.
+func LoadKey(keyFile, keyEnv string) (*[32]byte, error) {
+	if keyFile != "" {
+		buf, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return ParseKey(string(buf))
+	}
+	val, ok := os.LookupEnv(keyEnv)
+	if !ok {
+		return nil, fmt.Errorf("Environment variable %s is not set", keyEnv)
+	}
+	return ParseKey(val)
+}
+
+type sealedCodec struct {
+	Codec
+	key *[32]byte
+}
+
+// SealedCodec wraps inner in a Codec that encrypts everything it
+// encodes with the NaCl secretbox API, using the same primitives as
+// models.SecureData.  Encoded data is laid out as a 24 byte random
+// nonce followed by the sealed payload.
+func SealedCodec(inner Codec, key *[32]byte) Codec {
+	return &sealedCodec{Codec: inner, key: key}
+}
+
+func (s *sealedCodec) Encode(i interface{}) ([]byte, error) {
+	buf, err := s.Codec.Encode(i)
+	if err != nil {
+		return nil, err
+	}
+	nonce := [24]byte{}
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, fmt.Errorf("Error generating nonce: %v", err)
+	}
+	return secretbox.Seal(nonce[:], buf, &nonce, s.key), nil
+}
+
+func (s *sealedCodec) Decode(buf []byte, i interface{}) error {
+	if len(buf) < 24+secretbox.Overhead {
+		return SealedCorrupt
+	}
+	nonce := [24]byte{}
+	copy(nonce[:], buf[:24])
+	res, ok := secretbox.Open(nil, buf[24:], &nonce, s.key)
+	if !ok {
+		return SealedCorrupt
+	}
+	return s.Codec.Decode(res, i)
+}
+
+func (s *sealedCodec) Ext() string {
+	return s.Codec.Ext() + ".sealed"
+}
@@ -6,25 +6,116 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
+type fileData struct {
+	Sections map[string]map[string]interface{} `json:"sections,omitempty"`
+	Meta     map[string]string                 `json:"meta,omitempty"`
+}
+
 type File struct {
 	storeBase
 	Path string
-	data struct {
-		Sections map[string]map[string]interface{} `json:"sections,omitempty"`
-		Meta     map[string]string                 `json:"meta,omitempty"`
-	}
+	// FileLock turns on advisory locking against other processes
+	// using the same file, with Path.lock as the lock file.  Reads
+	// pick up changes other processes have made.
+	FileLock bool
+	// LockTimeout is how long to wait for other processes to let go
+	// of the lock.  It defaults to DefaultLockTimeout.
+	LockTimeout time.Duration
+	data        fileData
+	flock       *fileLock
+	// dataMux keeps readers from tripping over each other when a
+	// read has to reload data from disk.
+	dataMux sync.Mutex
+	seen    os.FileInfo
 }
 
 func (f *File) Type() string {
 	return "file"
 }
 
-func (f *File) MetaData() map[string]string {
+// readLock must be held by everything that reads f.data.  When
+// FileLock is set, it also picks up changes made by other processes.
+func (f *File) readLock() error {
 	f.RLock()
-	defer f.RUnlock()
+	if f.flock == nil {
+		return nil
+	}
+	f.dataMux.Lock()
+	err := f.flock.rlock()
+	if err == nil {
+		err = f.reload()
+		f.flock.runlock()
+	}
+	if err != nil {
+		f.dataMux.Unlock()
+		f.RUnlock()
+	}
+	return err
+}
+
+func (f *File) readUnlock() {
+	if f.flock != nil {
+		f.dataMux.Unlock()
+	}
+	f.RUnlock()
+}
+
+// writeLock must be called with f locked before changing anything.
+// When FileLock is set, it locks out other processes and picks up
+// any changes they made.
+func (f *File) writeLock() (func(), error) {
+	if f.flock == nil {
+		return func() {}, nil
+	}
+	if err := f.flock.lock(); err != nil {
+		return nil, err
+	}
+	if err := f.reload(); err != nil {
+		f.flock.unlock()
+		return nil, err
+	}
+	return f.flock.unlock, nil
+}
+
+// reload reads the backing file again if it has changed since we
+// last read or wrote it.
+func (f *File) reload() error {
+	fi, err := os.Stat(f.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if f.seen != nil && os.SameFile(f.seen, fi) && f.seen.ModTime().Equal(fi.ModTime()) && f.seen.Size() == fi.Size() {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	data := fileData{
+		Meta:     map[string]string{},
+		Sections: map[string]map[string]interface{}{},
+	}
+	if err := f.Decode(buf, &data); err != nil {
+		return err
+	}
+	f.data = data
+	f.seen = fi
+	return nil
+}
+
+func (f *File) MetaData() map[string]string {
 	res := map[string]string{}
+	if err := f.readLock(); err != nil {
+		return res
+	}
+	defer f.readUnlock()
 	for k, v := range f.data.Meta {
 		res[k] = v
 	}
@@ -34,12 +125,17 @@ func (f *File) MetaData() map[string]string {
 func (f *File) SetMetaData(vals map[string]string) error {
 	f.Lock()
 	defer f.Unlock()
+	unlock, err := f.writeLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	oldMeta := f.data.Meta
 	f.data.Meta = map[string]string{}
 	for k, v := range vals {
 		f.data.Meta[k] = v
 	}
-	err := f.save()
+	err = f.save()
 	if err != nil {
 		f.data.Meta = oldMeta
 	}
@@ -64,6 +160,19 @@ func (f *File) Open(codec Codec) error {
 	if err := os.MkdirAll(path.Dir(fullPath), 0755); err != nil {
 		return err
 	}
+	if f.FileLock {
+		l, err := newFileLock(fullPath+".lock", f.LockTimeout)
+		if err != nil {
+			return err
+		}
+		if err := l.rlock(); err != nil {
+			l.close()
+			return err
+		}
+		defer l.runlock()
+		f.flock = l
+		f.closer = l.close
+	}
 
 	buf, err := ioutil.ReadFile(fullPath)
 	if err != nil && !os.IsNotExist(err) {
@@ -75,14 +184,17 @@ func (f *File) Open(codec Codec) error {
 		if err := f.Decode(buf, &f.data); err != nil {
 			return err
 		}
+		f.seen, _ = os.Stat(fullPath)
 	}
 	f.opened = true
 	return nil
 }
 
 func (f *File) Prefixes() ([]string, error) {
-	f.RLock()
-	defer f.RUnlock()
+	if err := f.readLock(); err != nil {
+		return nil, err
+	}
+	defer f.readUnlock()
 	res := []string{}
 	for k := range f.data.Sections {
 		res = append(res, k)
@@ -91,8 +203,10 @@ func (f *File) Prefixes() ([]string, error) {
 }
 
 func (f *File) Keys(prefix string) ([]string, error) {
-	f.RLock()
-	defer f.RUnlock()
+	if err := f.readLock(); err != nil {
+		return nil, err
+	}
+	defer f.readUnlock()
 	f.panicIfClosed()
 	vals, ok := f.data.Sections[prefix]
 	if !ok {
@@ -106,25 +220,26 @@ func (f *File) Keys(prefix string) ([]string, error) {
 }
 
 func (f *File) Exists(prefix, key string) bool {
-	f.RLock()
-	defer f.RUnlock()
-	f.panicIfClosed()
-	vals, ok := f.data.Sections[prefix]
-	if !ok {
-		return ok
+	if err := f.readLock(); err != nil {
+		return false
 	}
-	_, ok = vals[key]
+	defer f.readUnlock()
+	f.panicIfClosed()
+	_, ok := f.data.Sections[prefix][key]
 	return ok
 }
 
 func (f *File) Load(prefix, key string, val interface{}) error {
-	f.RLock()
-	defer f.RUnlock()
+	if err := f.readLock(); err != nil {
+		return err
+	}
+	defer f.readUnlock()
 	f.panicIfClosed()
-	if !f.Exists(prefix, key) {
+	item, ok := f.data.Sections[prefix][key]
+	if !ok {
 		return os.ErrNotExist
 	}
-	if err := remarshal(f.data.Sections[prefix][key], &val); err != nil {
+	if err := remarshal(item, &val); err != nil {
 		return err
 	}
 	if ro, ok := val.(ReadOnlySetter); ok {
@@ -145,7 +260,11 @@ func (f *File) save() error {
 	if err != nil {
 		return err
 	}
-	return safeReplace(f.Path, buf)
+	if err := safeReplace(f.Path, buf); err != nil {
+		return err
+	}
+	f.seen, _ = os.Stat(f.Path)
+	return nil
 }
 
 func (f *File) Save(prefix, key string, val interface{}) error {
@@ -154,11 +273,20 @@ func (f *File) Save(prefix, key string, val interface{}) error {
 	if f.readOnly {
 		return UnWritable(key)
 	}
+	unlock, err := f.writeLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if _, ok := f.data.Sections[prefix]; !ok {
 		f.data.Sections[prefix] = map[string]interface{}{}
 	}
 	f.data.Sections[prefix][key] = val
-	return f.save()
+	err = f.save()
+	if err == nil {
+		f.watchers.notify(prefix, key, WatchSave)
+	}
+	return err
 }
 
 func (f *File) Remove(prefix, key string) error {
@@ -167,6 +295,11 @@ func (f *File) Remove(prefix, key string) error {
 	if f.readOnly {
 		return UnWritable(key)
 	}
+	unlock, err := f.writeLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if _, ok := f.data.Sections[prefix]; !ok {
 		return os.ErrNotExist
 	}
@@ -174,5 +307,64 @@ func (f *File) Remove(prefix, key string) error {
 		return os.ErrNotExist
 	}
 	delete(f.data.Sections[prefix], key)
-	return f.save()
+	err = f.save()
+	if err == nil {
+		f.watchers.notify(prefix, key, WatchRemove)
+	}
+	return err
+}
+
+// Begin starts a transaction against the File store.  Committing
+// the transaction rewrites the backing file once.
+func (f *File) Begin() (Txn, error) {
+	f.panicIfClosed()
+	return &txn{codec: f.Codec, readOnly: f.ReadOnly, commit: f.commit}, nil
+}
+
+func (f *File) commit(ops []txnOp) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.readOnly {
+		return UnWritable(ops[0].key)
+	}
+	unlock, err := f.writeLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := checkOps(ops, func(prefix, key string) bool {
+		_, ok := f.data.Sections[prefix][key]
+		return ok
+	}); err != nil {
+		return err
+	}
+	oldSections := f.data.Sections
+	newSections := make(map[string]map[string]interface{}, len(oldSections))
+	for prefix, vals := range oldSections {
+		newSections[prefix] = vals
+	}
+	copied := map[string]bool{}
+	for _, op := range ops {
+		if !copied[op.prefix] {
+			vals := map[string]interface{}{}
+			for k, v := range newSections[op.prefix] {
+				vals[k] = v
+			}
+			newSections[op.prefix] = vals
+			copied[op.prefix] = true
+		}
+		if op.remove {
+			delete(newSections[op.prefix], op.key)
+		} else {
+			newSections[op.prefix][op.key] = op.val
+		}
+	}
+	f.data.Sections = newSections
+	err = f.save()
+	if err != nil {
+		f.data.Sections = oldSections
+	} else {
+		f.notifyOps(ops)
+	}
+	return err
 }
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLockTimeout is how long a File or Directory store will wait
+// for another process to let go of its lock.
+const DefaultLockTimeout = 30 * time.Second
+
+type lockHow int
+
+const (
+	lockNone lockHow = iota
+	lockShared
+	lockExclusive
+)
+
+// LockError is returned when a store could not get a cross-process
+// lock in time.  If the process that last took the lock for writing
+// is known, it is recorded here.  Stale is set when that process is
+// on this machine and no longer running, which usually means the
+// lock file is on a filesystem that does not support flock properly
+// or that something the process started is still holding it open.
+type LockError struct {
+	Path  string
+	Pid   int
+	Host  string
+	Since time.Time
+	Stale bool
+}
+
+func (l *LockError) Error() string {
+	if l.Pid == 0 {
+		return fmt.Sprintf("Timed out waiting for lock %s held by another process", l.Path)
+	}
+	if l.Stale {
+		return fmt.Sprintf("Lock %s is stale: pid %d on %s took it at %s and is no longer running.  Remove %s if nothing else is using the store",
+			l.Path, l.Pid, l.Host, l.Since.Format(time.RFC3339), l.Path)
+	}
+	return fmt.Sprintf("Timed out waiting for lock %s held by pid %d on %s since %s",
+		l.Path, l.Pid, l.Host, l.Since.Format(time.RFC3339))
+}
+
+// fileLock is an advisory lock that File and Directory stores use
+// to keep other processes from changing them underneath us.  flock
+// locks belong to the open file, so readers within this process
+// share one flock, and rw keeps them from racing with writers.
+type fileLock struct {
+	sync.Mutex
+	rw      sync.RWMutex
+	path    string
+	timeout time.Duration
+	fd      *os.File
+	readers int
+}
+
+func newFileLock(path string, timeout time.Duration) (*fileLock, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	return &fileLock{path: path, timeout: timeout, fd: fd}, nil
+}
+
+func (l *fileLock) close() {
+	l.fd.Close()
+}
+
+// take keeps trying to flock the lock file until it gets the lock or
+// runs out of time.
+func (l *fileLock) take(how lockHow) error {
+	deadline := time.Now().Add(l.timeout)
+	for {
+		ok, err := tryFlock(l.fd, how)
+		if err != nil {
+			return fmt.Errorf("Failed to lock %s: %v", l.path, err)
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return l.holder()
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// holder works out who is holding the lock from what the last
+// writer left in the lock file.
+func (l *fileLock) holder() error {
+	res := &LockError{Path: l.path}
+	buf, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return res
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) != 3 {
+		return res
+	}
+	res.Pid, _ = strconv.Atoi(fields[0])
+	res.Host = fields[1]
+	res.Since, _ = time.Parse(time.RFC3339, fields[2])
+	if host, err := os.Hostname(); err == nil && host == res.Host && res.Pid != 0 {
+		res.Stale = processGone(res.Pid)
+	}
+	return res
+}
+
+func (l *fileLock) rlock() error {
+	l.rw.RLock()
+	l.Lock()
+	defer l.Unlock()
+	if l.readers == 0 {
+		if err := l.take(lockShared); err != nil {
+			l.rw.RUnlock()
+			return err
+		}
+	}
+	l.readers++
+	return nil
+}
+
+func (l *fileLock) runlock() {
+	l.Lock()
+	l.readers--
+	if l.readers == 0 {
+		tryFlock(l.fd, lockNone)
+	}
+	l.Unlock()
+	l.rw.RUnlock()
+}
+
+func (l *fileLock) lock() error {
+	l.rw.Lock()
+	if err := l.take(lockExclusive); err != nil {
+		l.rw.Unlock()
+		return err
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "unknown"
+	}
+	l.fd.Truncate(0)
+	l.fd.WriteAt([]byte(fmt.Sprintf("%d %s %s\n", os.Getpid(), host, time.Now().Format(time.RFC3339))), 0)
+	return nil
+}
+
+func (l *fileLock) unlock() {
+	l.fd.Truncate(0)
+	tryFlock(l.fd, lockNone)
+	l.rw.Unlock()
+}
@@ -0,0 +1,16 @@
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package store
+
+import (
+	"errors"
+	"os"
+)
+
+func tryFlock(f *os.File, how lockHow) (bool, error) {
+	return false, errors.New("cross-process store locking is not supported on this platform")
+}
+
+func processGone(pid int) bool {
+	return false
+}
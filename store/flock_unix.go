@@ -0,0 +1,35 @@
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package store
+
+import (
+	"os"
+	"syscall"
+)
+
+func tryFlock(f *os.File, how lockHow) (bool, error) {
+	op := syscall.LOCK_UN
+	switch how {
+	case lockShared:
+		op = syscall.LOCK_SH | syscall.LOCK_NB
+	case lockExclusive:
+		op = syscall.LOCK_EX | syscall.LOCK_NB
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), op)
+		switch err {
+		case nil:
+			return true, nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+}
+
+func processGone(pid int) bool {
+	return syscall.Kill(pid, 0) == syscall.ESRCH
+}
@@ -0,0 +1,357 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Git implements a Store that is backed by a local git repository.
+// Data is laid out in the working tree the same way the Directory
+// store lays it out, and every Save, Remove, metadata update, and
+// committed transaction is recorded as a git commit.  The git command
+// line tool must be installed.
+type Git struct {
+	Directory
+	// Branch is the branch commits are made on.  If empty, whatever
+	// branch the repository currently has checked out is used.
+	Branch string
+	// Author and Email are recorded as the author and committer of
+	// every commit.
+	Author string
+	Email  string
+	// gitMux serializes changes to the working tree and index.
+	gitMux sync.Mutex
+}
+
+// GitRevision describes a single commit in a Git store.
+type GitRevision struct {
+	Rev     string
+	Author  string
+	Email   string
+	Time    time.Time
+	Message string
+}
+
+func (g *Git) Type() string {
+	return "git"
+}
+
+func (g *Git) git(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.Path
+	cmd.Stdin = stdin
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+g.Author,
+		"GIT_AUTHOR_EMAIL="+g.Email,
+		"GIT_COMMITTER_NAME="+g.Author,
+		"GIT_COMMITTER_EMAIL="+g.Email,
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return out, fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(ee.Stderr)))
+		}
+		return out, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return out, nil
+}
+
+func (g *Git) hasCommits() bool {
+	_, err := g.git(nil, "rev-parse", "-q", "--verify", "HEAD")
+	return err == nil
+}
+
+func (g *Git) Open(codec Codec) error {
+	if g.Path == "" {
+		return fmt.Errorf("Cannot store data at ''")
+	}
+	fullPath, err := filepath.Abs(filepath.Clean(g.Path))
+	if err != nil {
+		return err
+	}
+	g.Path = fullPath
+	if g.Author == "" {
+		g.Author = "dr-provision"
+	}
+	if g.Email == "" {
+		g.Email = "dr-provision@localhost"
+	}
+	if err := os.MkdirAll(g.Path, 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(g.Path, ".git")); os.IsNotExist(err) {
+		if _, err := g.git(nil, "init", "-q"); err != nil {
+			return err
+		}
+	}
+	if g.Branch != "" {
+		current, _ := g.git(nil, "symbolic-ref", "-q", "--short", "HEAD")
+		if strings.TrimSpace(string(current)) != g.Branch {
+			if _, err := g.git(nil, "rev-parse", "-q", "--verify", "refs/heads/"+g.Branch); err == nil {
+				_, err = g.git(nil, "checkout", "-q", g.Branch)
+			} else if g.hasCommits() {
+				_, err = g.git(nil, "checkout", "-q", "-b", g.Branch)
+			} else {
+				_, err = g.git(nil, "symbolic-ref", "HEAD", "refs/heads/"+g.Branch)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return g.Directory.Open(codec)
+}
+
+// relName is the path of a key relative to the top of the repository.
+func (g *Git) relName(prefix, key string) string {
+	return url.QueryEscape(prefix) + "/" + url.QueryEscape(key+g.Ext())
+}
+
+// commitPaths stages everything that changed in paths and commits
+// it with message.  If nothing changed, no commit is made.
+func (g *Git) commitPaths(message string, paths ...string) error {
+	args := []string{"add", "-A", "--"}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, ":(") {
+			p = ":(literal)" + p
+		}
+		args = append(args, p)
+	}
+	if _, err := g.git(nil, args...); err != nil {
+		return err
+	}
+	if _, err := g.git(nil, "diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+	_, err := g.git(nil, "commit", "-q", "--no-verify", "-m", message)
+	return err
+}
+
+func (g *Git) SetMetaData(vals map[string]string) error {
+	g.gitMux.Lock()
+	defer g.gitMux.Unlock()
+	if err := g.Directory.SetMetaData(vals); err != nil {
+		return err
+	}
+	return g.commitPaths("Update metadata", ":(glob)._*.meta")
+}
+
+func (g *Git) Save(prefix, key string, val interface{}) error {
+	g.gitMux.Lock()
+	defer g.gitMux.Unlock()
+	if err := g.Directory.Save(prefix, key, val); err != nil {
+		return err
+	}
+	return g.commitPaths(fmt.Sprintf("Save %s/%s", prefix, key), g.relName(prefix, key))
+}
+
+func (g *Git) Remove(prefix, key string) error {
+	g.gitMux.Lock()
+	defer g.gitMux.Unlock()
+	if err := g.Directory.Remove(prefix, key); err != nil {
+		return err
+	}
+	return g.commitPaths(fmt.Sprintf("Remove %s/%s", prefix, key), g.relName(prefix, key))
+}
+
+// Begin starts a transaction against the Git store.  All of the
+// operations in the transaction are recorded in a single commit.
+func (g *Git) Begin() (Txn, error) {
+	return g.BeginCommit("")
+}
+
+// BeginCommit starts a transaction against the Git store that will
+// be committed with message.  If message is empty, one listing the
+// changed keys is generated.
+func (g *Git) BeginCommit(message string) (Txn, error) {
+	g.panicIfClosed()
+	return &txn{
+		codec:    g.Codec,
+		readOnly: g.ReadOnly,
+		commit: func(ops []txnOp) error {
+			return g.commit(message, ops)
+		},
+	}, nil
+}
+
+func (g *Git) commit(message string, ops []txnOp) error {
+	g.gitMux.Lock()
+	defer g.gitMux.Unlock()
+	if err := g.Directory.commit(ops); err != nil {
+		return err
+	}
+	ops = finalOps(ops)
+	paths := make([]string, len(ops))
+	lines := make([]string, len(ops))
+	for i, op := range ops {
+		paths[i] = g.relName(op.prefix, op.key)
+		if op.remove {
+			lines[i] = fmt.Sprintf("Remove %s/%s", op.prefix, op.key)
+		} else {
+			lines[i] = fmt.Sprintf("Save %s/%s", op.prefix, op.key)
+		}
+	}
+	if message == "" {
+		message = fmt.Sprintf("Update %d keys\n\n%s", len(ops), strings.Join(lines, "\n"))
+	}
+	return g.commitPaths(message, paths...)
+}
+
+// History returns the commits that changed key in prefix, newest
+// first.  If key is empty, commits that changed anything in prefix
+// are returned, and if prefix is also empty the history of the whole
+// store is returned.
+func (g *Git) History(prefix, key string) ([]GitRevision, error) {
+	g.panicIfClosed()
+	res := []GitRevision{}
+	if !g.hasCommits() {
+		return res, nil
+	}
+	args := []string{"log", "-z", "--format=%H%x1f%an%x1f%ae%x1f%at%x1f%B"}
+	switch {
+	case key != "":
+		args = append(args, "--", ":(literal)"+g.relName(prefix, key))
+	case prefix != "":
+		args = append(args, "--", ":(literal)"+url.QueryEscape(prefix))
+	}
+	out, err := g.git(nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range strings.Split(string(out), "\x00") {
+		if rec == "" {
+			continue
+		}
+		fields := strings.SplitN(rec, "\x1f", 5)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("Malformed git log entry %q", rec)
+		}
+		stamp, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, GitRevision{
+			Rev:     fields[0],
+			Author:  fields[1],
+			Email:   fields[2],
+			Time:    time.Unix(stamp, 0),
+			Message: strings.TrimSpace(fields[4]),
+		})
+	}
+	return res, nil
+}
+
+// At returns a read-only snapshot of the Git store as it was at rev,
+// which can be anything git rev-parse understands.  Rolling back to
+// rev can be done by copying the snapshot back into the Git store
+// with Copy.
+func (g *Git) At(rev string) (Store, error) {
+	g.panicIfClosed()
+	out, err := g.git(nil, "rev-parse", "-q", "--verify", rev+"^{commit}")
+	if err != nil {
+		return nil, fmt.Errorf("Unknown revision %s", rev)
+	}
+	commit := strings.TrimSpace(string(out))
+	out, err = g.git(nil, "ls-tree", "-r", "-z", "--name-only", commit)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name == "" || strings.Count(name, "/") > 1 {
+			continue
+		}
+		base := name[strings.LastIndex(name, "/")+1:]
+		if strings.HasPrefix(base, ".") && !strings.HasSuffix(base, ".meta") {
+			continue
+		}
+		names = append(names, name)
+	}
+	blobs, err := g.catBlobs(commit, names)
+	if err != nil {
+		return nil, err
+	}
+	res := &Memory{}
+	if err := res.Open(g.Codec); err != nil {
+		return nil, err
+	}
+	meta := map[string]string{}
+	for i, name := range names {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) == 1 {
+			if strings.HasPrefix(name, "._") && strings.HasSuffix(name, ".meta") {
+				val := strings.TrimSpace(string(blobs[i]))
+				if val != "" {
+					meta[strings.TrimSuffix(strings.TrimPrefix(name, "._"), ".meta")] = val
+				}
+			}
+			continue
+		}
+		if !strings.HasSuffix(parts[1], g.Ext()) {
+			continue
+		}
+		prefix, err := url.QueryUnescape(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		key, err := url.QueryUnescape(strings.TrimSuffix(parts[1], g.Ext()))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := res.v[prefix]; !ok {
+			res.v[prefix] = map[string][]byte{}
+		}
+		res.v[prefix][key] = blobs[i]
+	}
+	res.SetMetaData(meta)
+	res.SetReadOnly()
+	return res, nil
+}
+
+// catBlobs fetches the contents of names as of commit with a single
+// git cat-file process.
+func (g *Git) catBlobs(commit string, names []string) ([][]byte, error) {
+	res := make([][]byte, 0, len(names))
+	if len(names) == 0 {
+		return res, nil
+	}
+	req := &bytes.Buffer{}
+	for _, name := range names {
+		fmt.Fprintf(req, "%s:%s\n", commit, name)
+	}
+	out, err := g.git(req, "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	rd := bufio.NewReader(bytes.NewReader(out))
+	for _, name := range names {
+		header, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Cannot read %s at %s: %s", name, commit, strings.TrimSpace(header))
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+1)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		res = append(res, buf[:size])
+	}
+	return res, nil
+}
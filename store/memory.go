@@ -92,6 +92,18 @@ func (m *Memory) Exists(prefix, key string) bool {
 	return ok
 }
 
+// LoadRaw returns the encoded value of key without decoding it.
+func (m *Memory) LoadRaw(prefix, key string) ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+	m.panicIfClosed()
+	buf, ok := m.v[prefix][key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte{}, buf...), nil
+}
+
 func (m *Memory) Load(prefix, key string, val interface{}) error {
 	m.RLock()
 	defer m.RUnlock()
@@ -129,6 +141,7 @@ func (m *Memory) Save(prefix, key string, val interface{}) error {
 		m.v[prefix] = map[string][]byte{}
 	}
 	m.v[prefix][key] = buf
+	m.watchers.notify(prefix, key, WatchSave)
 	return nil
 }
 
@@ -146,5 +159,39 @@ func (m *Memory) Remove(prefix, key string) error {
 		return UnWritable(key)
 	}
 	delete(m.v[prefix], key)
+	m.watchers.notify(prefix, key, WatchRemove)
+	return nil
+}
+
+// Begin starts a transaction against the Memory store.
+func (m *Memory) Begin() (Txn, error) {
+	m.panicIfClosed()
+	return &txn{codec: m.Codec, readOnly: m.ReadOnly, commit: m.commit}, nil
+}
+
+func (m *Memory) commit(ops []txnOp) error {
+	m.Lock()
+	defer m.Unlock()
+	m.panicIfClosed()
+	if m.readOnly {
+		return UnWritable(ops[0].key)
+	}
+	if err := checkOps(ops, func(prefix, key string) bool {
+		_, ok := m.v[prefix][key]
+		return ok
+	}); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.remove {
+			delete(m.v[op.prefix], op.key)
+			continue
+		}
+		if _, ok := m.v[op.prefix]; !ok {
+			m.v[op.prefix] = map[string][]byte{}
+		}
+		m.v[op.prefix][op.key] = op.buf
+	}
+	m.notifyOps(ops)
 	return nil
 }
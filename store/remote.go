@@ -0,0 +1,221 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Remote implements a Store that talks to a Store being exposed over
+// HTTP by Serve.  Values always travel as JSON, so Remote stores
+// always use JsonCodec.  A Remote store is read-only if the Store it
+// talks to is read-only.
+type Remote struct {
+	storeBase
+	// URL is where the served Store is mounted.
+	URL string
+	// Client is used to make requests.  If nil, http.DefaultClient
+	// is used.
+	Client *http.Client
+}
+
+func (r *Remote) Type() string {
+	return "remote"
+}
+
+func (r *Remote) itemPath(prefix, key string) string {
+	return "/prefixes/" + url.PathEscape(prefix) + "/" + url.PathEscape(key)
+}
+
+// do makes a request against the served Store.  Missing keys come
+// back as os.ErrNotExist and refused writes as UnWritable(key).
+func (r *Remote) do(method, path, key string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, r.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return buf, nil
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case http.StatusForbidden:
+		return nil, UnWritable(key)
+	default:
+		return nil, fmt.Errorf("%s %s: %s: %s", method, r.URL+path, resp.Status, strings.TrimSpace(string(buf)))
+	}
+}
+
+func (r *Remote) Open(codec Codec) error {
+	if r.URL == "" {
+		return fmt.Errorf("Cannot talk to a store at ''")
+	}
+	r.URL = strings.TrimSuffix(r.URL, "/")
+	if r.Client == nil {
+		r.Client = http.DefaultClient
+	}
+	if codec != nil && codec != JsonCodec && codec != DefaultCodec {
+		return fmt.Errorf("Remote stores always use JSON, and cannot use another codec")
+	}
+	r.Codec = JsonCodec
+	buf, err := r.do("GET", "/", "", nil)
+	if err != nil {
+		return err
+	}
+	info := &remoteInfo{}
+	if err := json.Unmarshal(buf, info); err != nil {
+		return fmt.Errorf("%s is not a served store: %v", r.URL, err)
+	}
+	r.name = info.Name
+	r.readOnly = info.ReadOnly
+	r.opened = true
+	return nil
+}
+
+func (r *Remote) MetaData() map[string]string {
+	res := map[string]string{}
+	buf, err := r.do("GET", "/meta", "", nil)
+	if err == nil {
+		json.Unmarshal(buf, &res)
+	}
+	return res
+}
+
+func (r *Remote) SetMetaData(vals map[string]string) error {
+	if r.ReadOnly() {
+		return UnWritable("metadata")
+	}
+	buf, err := json.Marshal(vals)
+	if err != nil {
+		return err
+	}
+	if _, err := r.do("PUT", "/meta", "metadata", buf); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	if n, ok := vals["Name"]; ok {
+		r.name = n
+	}
+	return nil
+}
+
+func (r *Remote) list(path string) ([]string, error) {
+	r.panicIfClosed()
+	buf, err := r.do("GET", path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	return res, json.Unmarshal(buf, &res)
+}
+
+func (r *Remote) Prefixes() ([]string, error) {
+	return r.list("/prefixes")
+}
+
+func (r *Remote) Keys(prefix string) ([]string, error) {
+	return r.list("/prefixes/" + url.PathEscape(prefix))
+}
+
+func (r *Remote) Exists(prefix, key string) bool {
+	r.panicIfClosed()
+	_, err := r.do("HEAD", r.itemPath(prefix, key), key, nil)
+	return err == nil
+}
+
+func (r *Remote) Load(prefix, key string, val interface{}) error {
+	r.panicIfClosed()
+	buf, err := r.do("GET", r.itemPath(prefix, key), key, nil)
+	if err != nil {
+		return err
+	}
+	if err := r.Decode(buf, val); err != nil {
+		return err
+	}
+	if ro, ok := val.(ReadOnlySetter); ok {
+		ro.SetReadOnly(r.ReadOnly())
+	}
+	if bb, ok := val.(BundleSetter); ok {
+		n := r.Name()
+		if n != "" {
+			bb.SetBundle(n)
+		}
+	}
+	return nil
+}
+
+func (r *Remote) Save(prefix, key string, val interface{}) error {
+	r.panicIfClosed()
+	if r.ReadOnly() {
+		return UnWritable(key)
+	}
+	buf, err := r.Encode(val)
+	if err != nil {
+		return err
+	}
+	if _, err := r.do("PUT", r.itemPath(prefix, key), key, buf); err != nil {
+		return err
+	}
+	r.watchers.notify(prefix, key, WatchSave)
+	return nil
+}
+
+func (r *Remote) Remove(prefix, key string) error {
+	r.panicIfClosed()
+	if r.ReadOnly() {
+		return UnWritable(key)
+	}
+	if _, err := r.do("DELETE", r.itemPath(prefix, key), key, nil); err != nil {
+		return err
+	}
+	r.watchers.notify(prefix, key, WatchRemove)
+	return nil
+}
+
+// Begin starts a transaction against the Remote store.  The
+// operations are sent to the served Store in a single request when
+// the transaction is committed.
+func (r *Remote) Begin() (Txn, error) {
+	r.panicIfClosed()
+	return &txn{codec: r.Codec, readOnly: r.ReadOnly, commit: r.commit}, nil
+}
+
+func (r *Remote) commit(ops []txnOp) error {
+	if r.ReadOnly() {
+		return UnWritable(ops[0].key)
+	}
+	req := make([]remoteOp, len(ops))
+	for i, op := range ops {
+		req[i] = remoteOp{Prefix: op.prefix, Key: op.key, Remove: op.remove}
+		if !op.remove {
+			req[i].Value = op.buf
+		}
+	}
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := r.do("POST", "/txn", ops[0].key, buf); err != nil {
+		return err
+	}
+	r.notifyOps(ops)
+	return nil
+}
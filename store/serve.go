@@ -0,0 +1,255 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// remoteInfo is what the top level of a served Store reports.
+type remoteInfo struct {
+	Type     string
+	Name     string
+	ReadOnly bool
+}
+
+// remoteOp is a single operation in a transaction sent to a served
+// Store.
+type remoteOp struct {
+	Prefix string
+	Key    string
+	Remove bool            `json:",omitempty"`
+	Value  json.RawMessage `json:",omitempty"`
+}
+
+type server struct {
+	Store
+}
+
+// Serve returns an http.Handler that exposes s over HTTP, for use by
+// the http and https store locators.  The handler expects paths
+// relative to where it is mounted, so wrap it in http.StripPrefix
+// when mounting it anywhere other than /.  It handles:
+//
+//	GET    /                         the type, name, and read-only state of s
+//	GET    /meta                     the metadata of s
+//	PUT    /meta                     replace the metadata of s
+//	GET    /prefixes                 the prefixes in s
+//	GET    /prefixes/{prefix}        the keys in prefix
+//	HEAD   /prefixes/{prefix}/{key}  whether key exists
+//	GET    /prefixes/{prefix}/{key}  load key
+//	PUT    /prefixes/{prefix}/{key}  save key
+//	DELETE /prefixes/{prefix}/{key}  remove key
+//	POST   /txn                      apply a list of saves and removes in one transaction
+//
+// Prefixes and keys must be path escaped, and values are sent as
+// JSON.  Missing keys are reported with a 404, and attempts to write
+// to a read-only store with a 403.
+//
+// The handler does no authentication of its own, and anyone who can
+// reach it can read and change s.  Only listen on localhost with it,
+// or wrap it in a handler that checks who is asking.
+func Serve(s Store) http.Handler {
+	return &server{Store: s}
+}
+
+func (s *server) fail(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case UnWritable:
+		status = http.StatusForbidden
+	case NotFound:
+		status = http.StatusNotFound
+	default:
+		if os.IsNotExist(err) {
+			status = http.StatusNotFound
+		}
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (s *server) reply(w http.ResponseWriter, val interface{}) {
+	buf, err := json.Marshal(val)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.EscapedPath()
+	switch {
+	case p == "" || p == "/":
+		if r.Method != http.MethodGet {
+			break
+		}
+		s.reply(w, &remoteInfo{Type: s.Type(), Name: s.Name(), ReadOnly: s.ReadOnly()})
+		return
+	case p == "/meta":
+		s.meta(w, r)
+		return
+	case p == "/txn":
+		if r.Method != http.MethodPost {
+			break
+		}
+		s.txn(w, r)
+		return
+	case p == "/prefixes":
+		if r.Method != http.MethodGet {
+			break
+		}
+		prefixes, err := s.Prefixes()
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+		s.reply(w, prefixes)
+		return
+	case strings.HasPrefix(p, "/prefixes/"):
+		parts := strings.Split(strings.TrimPrefix(p, "/prefixes/"), "/")
+		if len(parts) > 2 {
+			http.NotFound(w, r)
+			return
+		}
+		for i := range parts {
+			part, err := url.PathUnescape(parts[i])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			parts[i] = part
+		}
+		if len(parts) == 1 {
+			if r.Method != http.MethodGet {
+				break
+			}
+			keys, err := s.Keys(parts[0])
+			if err != nil {
+				s.fail(w, err)
+				return
+			}
+			s.reply(w, keys)
+			return
+		}
+		s.item(w, r, parts[0], parts[1])
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func (s *server) meta(w http.ResponseWriter, r *http.Request) {
+	ms, ok := s.Store.(MetaSaver)
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			s.reply(w, map[string]string{})
+			return
+		}
+		s.reply(w, ms.MetaData())
+	case http.MethodPut:
+		if !ok {
+			http.Error(w, "Store cannot save metadata", http.StatusNotImplemented)
+			return
+		}
+		if s.ReadOnly() {
+			s.fail(w, UnWritable("metadata"))
+			return
+		}
+		vals := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&vals); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := ms.SetMetaData(vals); err != nil {
+			s.fail(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) item(w http.ResponseWriter, r *http.Request, prefix, key string) {
+	switch r.Method {
+	case http.MethodHead:
+		if !s.Exists(prefix, key) {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case http.MethodGet:
+		var val interface{}
+		if err := s.Load(prefix, key, &val); err != nil {
+			s.fail(w, err)
+			return
+		}
+		s.reply(w, val)
+	case http.MethodPut:
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var val interface{}
+		if err := json.Unmarshal(buf, &val); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Save(prefix, key, val); err != nil {
+			s.fail(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := s.Remove(prefix, key); err != nil {
+			s.fail(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) txn(w http.ResponseWriter, r *http.Request) {
+	ops := []remoteOp{}
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	txn, err := Begin(s.Store)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	for _, op := range ops {
+		if op.Remove {
+			err = txn.Remove(op.Prefix, op.Key)
+		} else {
+			var val interface{}
+			if err = json.Unmarshal(op.Value, &val); err != nil {
+				txn.Rollback()
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = txn.Save(op.Prefix, op.Key, val)
+		}
+		if err != nil {
+			txn.Rollback()
+			s.fail(w, err)
+			return
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		s.fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
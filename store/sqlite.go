@@ -0,0 +1,259 @@
+// +build cgo
+
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	// Registers the sqlite3 driver with database/sql
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite implements a Store that is backed by a SQLite database.
+// All values live in a single table keyed by prefix and key, and
+// metadata is kept in a separate table.  The database is opened in
+// WAL mode, so other processes can read it while we write to it.
+type SQLite struct {
+	storeBase
+	Path string
+	db   *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS store_data (
+  prefix TEXT NOT NULL,
+  key    TEXT NOT NULL,
+  value  BLOB NOT NULL,
+  PRIMARY KEY (prefix, key)
+);
+CREATE TABLE IF NOT EXISTS store_meta (
+  key   TEXT NOT NULL PRIMARY KEY,
+  value TEXT NOT NULL
+);`
+
+func (s *SQLite) Type() string {
+	return "sqlite"
+}
+
+func (s *SQLite) Open(codec Codec) error {
+	if s.Path == "" {
+		return fmt.Errorf("Cannot store data at ''")
+	}
+	fullPath, err := filepath.Abs(filepath.Clean(s.Path))
+	if err != nil {
+		return err
+	}
+	s.Path = fullPath
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	s.Codec = codec
+	db, err := sql.Open("sqlite3", "file:"+s.Path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
+	s.closer = func() {
+		s.db.Close()
+	}
+	s.opened = true
+	md := s.MetaData()
+	if n, ok := md["Name"]; ok {
+		s.name = n
+	}
+	return nil
+}
+
+func (s *SQLite) MetaData() map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	res := map[string]string{}
+	rows, err := s.db.Query(`SELECT key, value FROM store_meta`)
+	if err != nil {
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k, v string
+		if rows.Scan(&k, &v) == nil {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func (s *SQLite) SetMetaData(vals map[string]string) error {
+	s.Lock()
+	defer s.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM store_meta`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for k, v := range vals {
+		if _, err := tx.Exec(`INSERT INTO store_meta (key, value) VALUES (?, ?)`, k, v); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if n, ok := vals["Name"]; ok {
+		s.name = n
+	}
+	return nil
+}
+
+func (s *SQLite) strings(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLite) Prefixes() ([]string, error) {
+	s.panicIfClosed()
+	return s.strings(`SELECT DISTINCT prefix FROM store_data`)
+}
+
+func (s *SQLite) Keys(prefix string) ([]string, error) {
+	s.panicIfClosed()
+	return s.strings(`SELECT key FROM store_data WHERE prefix = ?`, prefix)
+}
+
+func (s *SQLite) Exists(prefix, key string) bool {
+	s.panicIfClosed()
+	var found int
+	err := s.db.QueryRow(`SELECT 1 FROM store_data WHERE prefix = ? AND key = ?`, prefix, key).Scan(&found)
+	return err == nil
+}
+
+// LoadRaw returns the encoded value of key without decoding it.
+func (s *SQLite) LoadRaw(prefix, key string) ([]byte, error) {
+	s.panicIfClosed()
+	var buf []byte
+	err := s.db.QueryRow(`SELECT value FROM store_data WHERE prefix = ? AND key = ?`, prefix, key).Scan(&buf)
+	if err == sql.ErrNoRows {
+		return nil, os.ErrNotExist
+	}
+	return buf, err
+}
+
+func (s *SQLite) Load(prefix, key string, val interface{}) error {
+	buf, err := s.LoadRaw(prefix, key)
+	if err != nil {
+		return err
+	}
+	if err := s.Decode(buf, val); err != nil {
+		return err
+	}
+	if ro, ok := val.(ReadOnlySetter); ok {
+		ro.SetReadOnly(s.ReadOnly())
+	}
+	if bb, ok := val.(BundleSetter); ok {
+		n := s.Name()
+		if n != "" {
+			bb.SetBundle(n)
+		}
+	}
+	return nil
+}
+
+func (s *SQLite) Save(prefix, key string, val interface{}) error {
+	s.panicIfClosed()
+	if s.ReadOnly() {
+		return UnWritable(key)
+	}
+	buf, err := s.Encode(val)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO store_data (prefix, key, value) VALUES (?, ?, ?)`, prefix, key, buf)
+	if err == nil {
+		s.watchers.notify(prefix, key, WatchSave)
+	}
+	return err
+}
+
+func (s *SQLite) Remove(prefix, key string) error {
+	s.panicIfClosed()
+	if s.ReadOnly() {
+		return UnWritable(key)
+	}
+	res, err := s.db.Exec(`DELETE FROM store_data WHERE prefix = ? AND key = ?`, prefix, key)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return os.ErrNotExist
+	}
+	if err == nil {
+		s.watchers.notify(prefix, key, WatchRemove)
+	}
+	return err
+}
+
+// Begin starts a transaction against the SQLite store.  All of the
+// operations are applied in a single SQL transaction.
+func (s *SQLite) Begin() (Txn, error) {
+	s.panicIfClosed()
+	return &txn{codec: s.Codec, readOnly: s.ReadOnly, commit: s.commit}, nil
+}
+
+func (s *SQLite) commit(ops []txnOp) error {
+	if s.ReadOnly() {
+		return UnWritable(ops[0].key)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := checkOps(ops, func(prefix, key string) bool {
+		var found int
+		return tx.QueryRow(`SELECT 1 FROM store_data WHERE prefix = ? AND key = ?`, prefix, key).Scan(&found) == nil
+	}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, op := range ops {
+		if op.remove {
+			_, err = tx.Exec(`DELETE FROM store_data WHERE prefix = ? AND key = ?`, op.prefix, op.key)
+		} else {
+			_, err = tx.Exec(`INSERT OR REPLACE INTO store_data (prefix, key, value) VALUES (?, ?, ?)`, op.prefix, op.key, op.buf)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.notifyOps(ops)
+	return nil
+}
@@ -0,0 +1,21 @@
+// +build !cgo
+
+package store
+
+import "errors"
+
+// SQLite is a placeholder for the SQLite store in binaries built
+// without cgo, which the SQLite driver needs.  Opening it always
+// fails.
+type SQLite struct {
+	Memory
+	Path string
+}
+
+func (s *SQLite) Type() string {
+	return "sqlite"
+}
+
+func (s *SQLite) Open(codec Codec) error {
+	return errors.New("sqlite store support is not compiled in: rebuild with CGO_ENABLED=1")
+}
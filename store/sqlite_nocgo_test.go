@@ -0,0 +1,25 @@
+// +build !cgo
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const haveSQLite = false
+
+func TestSQLiteNotCompiledIn(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = Open("sqlite:" + path.Join(tmpDir, "sqlite.db"))
+	if err == nil || !strings.Contains(err.Error(), "not compiled in") {
+		t.Errorf("Expected a not compiled in error, got %v", err)
+	}
+}
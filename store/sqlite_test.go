@@ -0,0 +1,39 @@
+// +build cgo
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const haveSQLite = true
+
+func TestStackSQLiteLayer(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tobj := struct{ Foo, Bar string }{"foo", "bar"}
+	s2, err := Open("sqlite:" + path.Join(tmpDir, "layer.db"))
+	if err != nil {
+		t.Fatalf("Failed to open sqlite store: %v", err)
+	}
+	s2.Save("sample", "foo", &tobj)
+	st := makeStack(t, mks(nil, s2), false)
+	if st == nil {
+		return
+	}
+	defer st.Close()
+	if ro, ok := st.ItemReadOnly("sample", "foo"); !ro || !ok {
+		t.Errorf("Expected sample/foo to be read-only in the stack")
+	}
+	checkErr(t, UnWritable(""), st.Remove("sample", "foo"))
+	checkErr(t, nil, st.Save("sample", "foo", &tobj))
+	if ro, _ := st.ItemReadOnly("sample", "foo"); ro {
+		t.Errorf("Expected sample/foo to be overridden by the writable layer")
+	}
+}
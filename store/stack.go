@@ -26,6 +26,12 @@ type StackedStore struct {
 	stores     []Store
 	storeFlags []layerFlags
 	keys       map[string]map[string]int
+	// forwarding is set once we are passing events from our layers
+	// along to our own watchers.
+	forwarding bool
+	// forwards holds the watch handles for each layer we are
+	// forwarding events from.
+	forwards map[Store]int64
 }
 
 func (s *StackedStore) Type() string {
@@ -37,7 +43,9 @@ func (s *StackedStore) Open(codec Codec) error {
 	s.stores = []Store{}
 	s.storeFlags = []layerFlags{}
 	s.keys = map[string]map[string]int{}
+	s.forwards = map[Store]int64{}
 	s.opened = true
+	s.watchers.started = s.startWatch
 	s.closer = func() {
 		for _, item := range s.stores {
 			item.Close()
@@ -59,6 +67,9 @@ func (pt *pushTracker) unlock() {
 	if len(pt.stores) > 1 && pt.pushing {
 		pt.newLayer.SetReadOnly()
 	}
+	if pt.pushing && pt.forwarding {
+		pt.forwardFrom(pt.newLayer)
+	}
 	pt.Unlock()
 }
 
@@ -70,18 +81,64 @@ func (pt *pushTracker) push(kCBO, kCO bool) {
 	}
 	pt.storeFlags = append(pt.storeFlags, newFlags)
 	pt.stores = append(pt.stores, pt.newLayer)
-	for prefix, keys := range pt.newLayerKeys {
-		if _, ok := pt.keys[prefix]; !ok {
-			pt.keys[prefix] = map[string]int{}
+	addLayerKeys(pt.keys, pt.newLayerKeys, len(pt.stores)-1)
+}
+
+// addLayerKeys records that the keys in layerKeys come from layer
+// idx, unless a higher layer already has them.
+func addLayerKeys(keys map[string]map[string]int, layerKeys map[string][]string, idx int) {
+	for prefix, lk := range layerKeys {
+		if _, ok := keys[prefix]; !ok {
+			keys[prefix] = map[string]int{}
 		}
-		for _, key := range keys {
-			if _, ok := pt.keys[prefix][key]; !ok {
-				pt.keys[prefix][key] = len(pt.stores) - 1
+		for _, key := range lk {
+			if _, ok := keys[prefix][key]; !ok {
+				keys[prefix][key] = idx
 			}
 		}
 	}
 }
 
+// checkLayerKeys returns a description of every key in layerKeys
+// that would break the override rules if a layer holding them were
+// added below the layers described by keys and flags.
+func checkLayerKeys(keys map[string]map[string]int, flags []layerFlags, layerKeys map[string][]string, kCBO bool) []string {
+	badKeys := []string{}
+	for prefix, lk := range layerKeys {
+		for _, k := range lk {
+			i, ok := keys[prefix][k]
+			if !ok {
+				// New key.  Cannot be overridden, and nothing else would override it that should not.
+				continue
+			}
+			if kCBO {
+				badKeys = append(badKeys,
+					fmt.Sprintf("keysCannotBeOverridden: %s is already in layer %d", k, i))
+			}
+			if flags[i].keysCannotOverride {
+				badKeys = append(badKeys,
+					fmt.Sprintf("keysCannotOverride: %s would be overridden by layer %d", k, i))
+			}
+		}
+	}
+	return badKeys
+}
+
+// layerKeys returns all the keys in layer, grouped by prefix.
+func layerKeys(layer Store) (map[string][]string, error) {
+	res := map[string][]string{}
+	prefixes, err := layer.Prefixes()
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		if res[prefix], err = layer.Keys(prefix); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
 type StackPushError string
 
 func (s StackPushError) Error() string {
@@ -100,33 +157,11 @@ func (s *StackedStore) pushOK(layer Store, kCBO, kCO bool) (res *pushTracker) {
 		newLayer:     layer,
 		newLayerKeys: map[string][]string{},
 	}
-	prefixes, err := layer.Prefixes()
-	if err != nil {
-		res.err = err
+	res.newLayerKeys, res.err = layerKeys(layer)
+	if res.err != nil {
 		return
 	}
-	badKeys := []string{}
-	for _, prefix := range prefixes {
-		res.newLayerKeys[prefix], res.err = layer.Keys(prefix)
-		if res.err != nil {
-			return
-		}
-		for _, k := range res.newLayerKeys[prefix] {
-			i, ok := s.keys[prefix][k]
-			if !ok {
-				// New key.  Cannot be overridden, and nothing else would override it that should not.
-				continue
-			}
-			if kCBO {
-				badKeys = append(badKeys,
-					fmt.Sprintf("keysCannotBeOverridden: %s is already in layer %d", k, i))
-			}
-			if s.storeFlags[i].keysCannotOverride {
-				badKeys = append(badKeys,
-					fmt.Sprintf("keysCannotOverride: %s would be overridden by layer %d", k, i))
-			}
-		}
-	}
+	badKeys := checkLayerKeys(s.keys, s.storeFlags, res.newLayerKeys, kCBO)
 	if len(badKeys) != 0 {
 		res.err = StackPushError(fmt.Sprintf("New layer violates key restrictions: %s", strings.Join(badKeys, "\n\t")))
 	}
@@ -148,6 +183,176 @@ func (s *StackedStore) Push(layer Store, keysCannotBeOverridden, keysCannotOverr
 	return nil
 }
 
+// stackKeys works out which layer each key in stores comes from, and
+// makes sure that the layers obey each other's override rules the
+// same way pushing them one at a time would.
+func stackKeys(stores []Store, flags []layerFlags) (map[string]map[string]int, error) {
+	keys := map[string]map[string]int{}
+	badKeys := []string{}
+	for i, layer := range stores {
+		lk, err := layerKeys(layer)
+		if err != nil {
+			return nil, err
+		}
+		badKeys = append(badKeys, checkLayerKeys(keys, flags, lk, flags[i].keysCannotBeOverridden)...)
+		addLayerKeys(keys, lk, i)
+	}
+	if len(badKeys) != 0 {
+		return nil, StackPushError(fmt.Sprintf("New layer violates key restrictions: %s", strings.Join(badKeys, "\n\t")))
+	}
+	return keys, nil
+}
+
+// rebuild replaces the layers of the stack with stores and flags,
+// as long as they obey the override rules.  Watchers are told about
+// every key that changes which layer it comes from.  It must be
+// called with the stack locked.
+func (s *StackedStore) rebuild(stores []Store, flags []layerFlags) error {
+	keys, err := stackKeys(stores, flags)
+	if err != nil {
+		return err
+	}
+	oldStores, oldKeys := s.stores, s.keys
+	s.stores, s.storeFlags, s.keys = stores, flags, keys
+	for _, layer := range oldStores {
+		if _, ok := s.forwards[layer]; ok && !s.hasLayer(layer) {
+			s.unforward(layer)
+		}
+	}
+	for i, layer := range stores {
+		if i != 0 {
+			layer.SetReadOnly()
+		}
+		if _, ok := s.forwards[layer]; s.forwarding && !ok {
+			s.forwardFrom(layer)
+		}
+	}
+	for prefix, pk := range keys {
+		for key, idx := range pk {
+			if oldIdx, ok := oldKeys[prefix][key]; !ok || oldStores[oldIdx] != stores[idx] {
+				s.watchers.notify(prefix, key, WatchSave)
+			}
+		}
+	}
+	for prefix, pk := range oldKeys {
+		for key := range pk {
+			if _, ok := keys[prefix][key]; !ok {
+				s.watchers.notify(prefix, key, WatchRemove)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *StackedStore) hasLayer(layer Store) bool {
+	for _, l := range s.stores {
+		if l == layer {
+			return true
+		}
+	}
+	return false
+}
+
+// Pop removes the layer at layerIndex from the stack and returns it.
+// The layers left behind are checked against each other's
+// keysCannotBeOverridden and keysCannotOverride flags in the same
+// way Push checks them, and if they would break them the stack is
+// left alone.  The writable layer at index 0 can only be popped if
+// it is the only layer left.
+func (s *StackedStore) Pop(layerIndex int) (Store, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.panicIfClosed()
+	if layerIndex < 0 || layerIndex >= len(s.stores) {
+		return nil, fmt.Errorf("No layer %d in the stack", layerIndex)
+	}
+	if layerIndex == 0 && len(s.stores) > 1 {
+		return nil, fmt.Errorf("Cannot pop the writable layer while other layers remain")
+	}
+	res := s.stores[layerIndex]
+	stores := append(append([]Store{}, s.stores[:layerIndex]...), s.stores[layerIndex+1:]...)
+	flags := append(append([]layerFlags{}, s.storeFlags[:layerIndex]...), s.storeFlags[layerIndex+1:]...)
+	if err := s.rebuild(stores, flags); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Replace swaps the layer at layerIndex for layer, and returns the
+// layer that was replaced.  The new stack is checked in the same way
+// Push checks it, and if it would break the override rules the stack
+// is left alone.  Any layer but the one at index 0 will be marked as
+// read-only.
+func (s *StackedStore) Replace(layerIndex int, layer Store, keysCannotBeOverridden, keysCannotOverride bool) (Store, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.panicIfClosed()
+	if layer.Closed() {
+		panic("Cannot push a closed store")
+	}
+	if layerIndex < 0 || layerIndex >= len(s.stores) {
+		return nil, fmt.Errorf("No layer %d in the stack", layerIndex)
+	}
+	res := s.stores[layerIndex]
+	stores := append([]Store{}, s.stores...)
+	flags := append([]layerFlags{}, s.storeFlags...)
+	stores[layerIndex] = layer
+	flags[layerIndex] = layerFlags{
+		keysCannotBeOverridden: keysCannotBeOverridden,
+		keysCannotOverride:     keysCannotOverride,
+	}
+	if err := s.rebuild(stores, flags); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Provenance describes one layer of a StackedStore that holds a key.
+type Provenance struct {
+	// Layer is the index of the layer in the stack.
+	Layer int
+	// Name and Type are the name and type of the layer.
+	Name string
+	Type string
+	// Active is true for the layer that Load will read the key from.
+	Active bool
+	// ReadOnly is true if the layer is read-only.
+	ReadOnly bool
+	// KeysCannotBeOverridden and KeysCannotOverride are the flags
+	// the layer was pushed with.
+	KeysCannotBeOverridden bool
+	KeysCannotOverride     bool
+}
+
+// Provenance lists every layer that holds key in prefix, starting
+// from the top of the stack.  It returns an empty list if no layer
+// has the key.
+func (s *StackedStore) Provenance(prefix, key string) []Provenance {
+	s.RLock()
+	defer s.RUnlock()
+	s.panicIfClosed()
+	res := []Provenance{}
+	active, ok := s.keys[prefix][key]
+	if !ok {
+		return res
+	}
+	for i, layer := range s.stores {
+		if !layer.Exists(prefix, key) {
+			continue
+		}
+		res = append(res, Provenance{
+			Layer:                  i,
+			Name:                   layer.Name(),
+			Type:                   layer.Type(),
+			Active:                 i == active,
+			ReadOnly:               layer.ReadOnly(),
+			KeysCannotBeOverridden: s.storeFlags[i].keysCannotBeOverridden,
+			KeysCannotOverride:     s.storeFlags[i].keysCannotOverride,
+		})
+	}
+	return res
+}
+
 func (s *StackedStore) Layers() []Store {
 	s.Lock()
 	defer s.Unlock()
@@ -286,3 +491,166 @@ func (s *StackedStore) SetReadOnly() bool {
 	defer s.RUnlock()
 	return s.stores[0].SetReadOnly()
 }
+
+// Begin starts a transaction against the writable layer of the
+// stack.  Operations are checked against the same override rules as
+// Save and Remove when the transaction is committed.
+func (s *StackedStore) Begin() (Txn, error) {
+	s.RLock()
+	defer s.RUnlock()
+	s.panicIfClosed()
+	if len(s.stores) == 0 {
+		return nil, fmt.Errorf("Cannot start a transaction on an empty stack")
+	}
+	return &txn{codec: s.stores[0].GetCodec(), readOnly: s.ReadOnly, commit: s.commit}, nil
+}
+
+func (s *StackedStore) commit(ops []txnOp) error {
+	s.Lock()
+	defer s.Unlock()
+	seen := map[string]map[string]int{}
+	for _, op := range ops {
+		if _, ok := seen[op.prefix]; !ok {
+			seen[op.prefix] = map[string]int{}
+		}
+		idx, ok := seen[op.prefix][op.key]
+		if !ok {
+			idx, ok = s.keys[op.prefix][op.key]
+		} else {
+			ok = idx != -1
+		}
+		if op.remove {
+			if !ok {
+				return os.ErrNotExist
+			}
+			if idx != 0 {
+				return UnWritable(op.key)
+			}
+			seen[op.prefix][op.key] = -1
+			continue
+		}
+		if ok && idx != 0 {
+			if s.storeFlags[idx].keysCannotBeOverridden {
+				return StackCannotBeOverridden(op.key)
+			}
+			if s.storeFlags[0].keysCannotOverride {
+				return StackCannotOverride(op.key)
+			}
+		}
+		seen[op.prefix][op.key] = 0
+	}
+	layerTxn, err := Begin(s.stores[0])
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.remove {
+			err = layerTxn.Remove(op.prefix, op.key)
+		} else {
+			err = layerTxn.Save(op.prefix, op.key, op.val)
+		}
+		if err != nil {
+			layerTxn.Rollback()
+			return err
+		}
+	}
+	if err := layerTxn.Commit(); err != nil {
+		return err
+	}
+	for prefix, keys := range seen {
+		if _, ok := s.keys[prefix]; !ok {
+			s.keys[prefix] = map[string]int{}
+		}
+		for key, idx := range keys {
+			if idx == 0 {
+				s.keys[prefix][key] = 0
+			} else {
+				delete(s.keys[prefix], key)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *StackedStore) startWatch() {
+	s.Lock()
+	defer s.Unlock()
+	if s.forwarding {
+		return
+	}
+	s.forwarding = true
+	for _, layer := range s.stores {
+		s.forwardFrom(layer)
+	}
+}
+
+// forwardFrom passes events from layer along to anything watching
+// the stack.  It must be called with the stack locked.
+func (s *StackedStore) forwardFrom(layer Store) {
+	w, ok := layer.(Watcher)
+	if !ok {
+		return
+	}
+	handle, ch := w.Watch()
+	s.forwards[layer] = handle
+	go func() {
+		for evt := range ch {
+			s.forward(layer, evt)
+		}
+	}()
+}
+
+// unforward stops passing events from layer along.  It must be
+// called with the stack locked.
+func (s *StackedStore) unforward(layer Store) {
+	if handle, ok := s.forwards[layer]; ok {
+		layer.(Watcher).Unwatch(handle)
+		delete(s.forwards, layer)
+	}
+}
+
+// forward figures out whether a change in a layer is visible through
+// the stack, updates which layer each key comes from, and tells our
+// watchers about it if it is.
+func (s *StackedStore) forward(layer Store, evt WatchEvent) {
+	s.Lock()
+	defer s.Unlock()
+	i := -1
+	for j := range s.stores {
+		if s.stores[j] == layer {
+			i = j
+			break
+		}
+	}
+	if i == -1 {
+		return
+	}
+	if _, ok := s.keys[evt.Prefix]; !ok {
+		s.keys[evt.Prefix] = map[string]int{}
+	}
+	idx, ok := s.keys[evt.Prefix][evt.Key]
+	if ok && idx < i {
+		// A higher layer hides this key.
+		return
+	}
+	switch evt.Op {
+	case WatchSave:
+		s.keys[evt.Prefix][evt.Key] = i
+	case WatchRemove:
+		if ok && idx > i {
+			return
+		}
+		delete(s.keys[evt.Prefix], evt.Key)
+		if ok {
+			for j := i + 1; j < len(s.stores); j++ {
+				if s.stores[j].Exists(evt.Prefix, evt.Key) {
+					// A lower layer's copy is now visible.
+					s.keys[evt.Prefix][evt.Key] = j
+					s.watchers.notify(evt.Prefix, evt.Key, WatchSave)
+					return
+				}
+			}
+		}
+	}
+	s.watchers.notify(evt.Prefix, evt.Key, evt.Op)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 )
 
 func mks(s ...Store) []Store {
@@ -109,3 +110,148 @@ func TestStackCannotOverride(t *testing.T) {
 		t.Logf("Stack creation failed, as expected.")
 	}
 }
+
+func TestStackTxn(t *testing.T) {
+	tobj := struct{ Foo, Bar string }{"foo", "bar"}
+	s2, _ := Open("memory://")
+	s2.Save("sample", "foo", &tobj)
+	s3, _ := Open("memory://")
+	s3.Save("sample", "bar", &tobj)
+	st := makeStack(t, mks(nil, s2, s3), false,
+		false, true,
+		true, true,
+		false, false)
+	if st == nil {
+		return
+	}
+	defer st.Close()
+	txn, _ := st.Begin()
+	txn.Save("sample", "baz", &tobj)
+	txn.Save("sample", "bar", &tobj)
+	checkErr(t, StackCannotOverride(""), txn.Commit())
+	if st.Exists("sample", "baz") {
+		t.Errorf("Failed stack transaction left partial state behind")
+	}
+	txn, _ = st.Begin()
+	txn.Save("sample", "baz", &tobj)
+	txn.Remove("sample", "foo")
+	checkErr(t, UnWritable(""), txn.Commit())
+	txn, _ = st.Begin()
+	txn.Save("sample", "baz", &tobj)
+	txn.Save("sample", "qux", &tobj)
+	txn.Remove("sample", "qux")
+	checkErr(t, nil, txn.Commit())
+	if ro, ok := st.ItemReadOnly("sample", "baz"); ro || !ok {
+		t.Errorf("Expected sample/baz in the writable layer")
+	}
+	if st.Exists("sample", "qux") {
+		t.Errorf("Expected sample/qux to be removed")
+	}
+}
+
+func TestStackWatch(t *testing.T) {
+	tobj := struct{ Foo, Bar string }{"foo", "bar"}
+	s1, _ := Open("memory://")
+	s2, _ := Open("memory://")
+	s2.Save("sample", "foo", &tobj)
+	st := makeStack(t, mks(s1, s2), false)
+	if st == nil {
+		return
+	}
+	defer st.Close()
+	_, ch := st.Watch()
+	checkErr(t, nil, st.Save("sample", "bar", &tobj))
+	waitEvents(t, ch, WatchEvent{"sample", "bar", WatchSave})
+	// Changes to a lower layer are only visible if nothing above hides them.
+	s2.(*Memory).readOnly = false
+	s2.Save("sample", "bar", &tobj)
+	s2.Save("sample", "baz", &tobj)
+	waitEvents(t, ch, WatchEvent{"sample", "baz", WatchSave})
+	if ro, _ := st.ItemReadOnly("sample", "bar"); ro {
+		t.Errorf("Expected sample/bar to still come from the writable layer")
+	}
+	s2.Remove("sample", "foo")
+	waitEvents(t, ch, WatchEvent{"sample", "foo", WatchRemove})
+	if st.Exists("sample", "foo") {
+		t.Errorf("Expected sample/foo to be gone from the stack")
+	}
+	select {
+	case evt := <-ch:
+		t.Errorf("Unexpected event %v", evt)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStackPopReplace(t *testing.T) {
+	tobj := struct{ Foo, Bar string }{"foo", "bar"}
+	s2, _ := Open("memory://")
+	s2.Save("sample", "foo", &tobj)
+	s3, _ := Open("memory://")
+	s3.Save("sample", "foo", &tobj)
+	s3.Save("sample", "bar", &tobj)
+	st := makeStack(t, mks(nil, s2, s3), false)
+	if st == nil {
+		return
+	}
+	defer st.Close()
+	_, ch := st.Watch()
+	prov := st.Provenance("sample", "foo")
+	if len(prov) != 2 || !prov[0].Active || prov[0].Layer != 1 || prov[1].Active || prov[1].Layer != 2 {
+		t.Errorf("Unexpected provenance for sample/foo: %#v", prov)
+	}
+	if len(st.Provenance("sample", "missing")) != 0 {
+		t.Errorf("Expected no provenance for a missing key")
+	}
+	if _, err := st.Pop(0); err == nil {
+		t.Errorf("Expected an error popping the writable layer")
+	}
+	if _, err := st.Pop(3); err == nil {
+		t.Errorf("Expected an error popping a missing layer")
+	}
+	popped, err := st.Pop(2)
+	if err != nil || popped != s3 {
+		t.Fatalf("Failed to pop layer 2: %v", err)
+	}
+	waitEvents(t, ch, WatchEvent{"sample", "bar", WatchRemove})
+	if st.Exists("sample", "bar") || len(st.Layers()) != 2 {
+		t.Errorf("Expected sample/bar to be gone with its layer")
+	}
+	s4, _ := Open("memory://")
+	s4.Save("sample", "qux", &tobj)
+	if err := st.Push(s4, true, false); err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+	// Nothing above layer 2 may override its keys.
+	s5, _ := Open("memory://")
+	s5.Save("sample", "qux", &tobj)
+	checkErr(t, StackPushError(""), func() error { _, err := st.Replace(1, s5, false, false); return err }())
+	if st.Layers()[1] != s2 {
+		t.Errorf("Failed Replace changed the stack")
+	}
+	s6, _ := Open("memory://")
+	s6.Save("sample", "baz", &tobj)
+	replaced, err := st.Replace(1, s6, false, false)
+	if err != nil || replaced != s2 {
+		t.Fatalf("Failed to replace layer 1: %v", err)
+	}
+	waitEvents(t, ch,
+		WatchEvent{"sample", "foo", WatchRemove},
+		WatchEvent{"sample", "baz", WatchSave})
+	if !s6.ReadOnly() {
+		t.Errorf("Expected replaced layer to be read-only")
+	}
+	prov = st.Provenance("sample", "qux")
+	if len(prov) != 1 || prov[0].Layer != 2 || !prov[0].KeysCannotBeOverridden || !prov[0].ReadOnly {
+		t.Errorf("Unexpected provenance for sample/qux: %#v", prov)
+	}
+	s6.(*Memory).readOnly = false
+	s2.(*Memory).readOnly = false
+	s6.Save("sample", "later", &tobj)
+	waitEvents(t, ch, WatchEvent{"sample", "later", WatchSave})
+	s2.Save("sample", "ignored", &tobj)
+	select {
+	case evt := <-ch:
+		t.Errorf("Unexpected event %v from a replaced layer", evt)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,939 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testObj struct {
+	Name  string
+	Count int
+}
+
+func storeLocators(t *testing.T) (map[string]string, func()) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	res := map[string]string{
+		"memory":    "memory://",
+		"file":      "file:" + path.Join(tmpDir, "file.json"),
+		"directory": "directory:" + path.Join(tmpDir, "directory"),
+		"bolt":      "bolt:" + path.Join(tmpDir, "bolt") + "?bucket=test",
+		"json.gz":   "directory:" + path.Join(tmpDir, "jsongz") + "?codec=json.gz",
+		"yaml.gz":   "file:" + path.Join(tmpDir, "file.yaml.gz") + "?codec=yaml.gz",
+		"cbor":      "directory:" + path.Join(tmpDir, "cbor") + "?codec=cbor",
+		"msgpack":   "bolt:" + path.Join(tmpDir, "msgpack") + "?codec=msgpack",
+		"file-lock": "file:" + path.Join(tmpDir, "locked.json") + "?lock=true",
+		"dir-lock":  "directory:" + path.Join(tmpDir, "locked") + "?lock=true",
+		"archive":   "archive:" + path.Join(tmpDir, "bundle.tgz") + "?write=true",
+	}
+	if haveSQLite {
+		res["sqlite"] = "sqlite:" + path.Join(tmpDir, "sqlite.db") + "?codec=json"
+	}
+	if _, err := exec.LookPath("git"); err == nil {
+		res["git"] = "git:" + path.Join(tmpDir, "git") + "?branch=main"
+	}
+	served, _ := Open("memory://")
+	srv := httptest.NewServer(http.StripPrefix("/store", Serve(served)))
+	res["remote"] = srv.URL + "/store"
+	return res, func() {
+		srv.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func sorted(s []string) []string {
+	sort.Strings(s)
+	return s
+}
+
+func testStoreBehavior(t *testing.T, locator string) {
+	s, err := Open(locator)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", locator, err)
+	}
+	ms, ok := s.(MetaSaver)
+	if !ok {
+		t.Fatalf("%s is not a MetaSaver", locator)
+	}
+	meta := map[string]string{"Name": "test", "Version": "1.0"}
+	if err := ms.SetMetaData(meta); err != nil {
+		t.Errorf("SetMetaData failed: %v", err)
+	}
+	if md := ms.MetaData(); !reflect.DeepEqual(md, meta) {
+		t.Errorf("Expected metadata %v, got %v", meta, md)
+	}
+	if s.Name() != "test" {
+		t.Errorf("Expected store name test, got %s", s.Name())
+	}
+	if err := s.Save("things", "one", &testObj{Name: "one", Count: 1}); err != nil {
+		t.Errorf("Save failed: %v", err)
+	}
+	if err := s.Save("things", "two", &testObj{Name: "two", Count: 2}); err != nil {
+		t.Errorf("Save failed: %v", err)
+	}
+	if err := s.Save("others", "three", &testObj{Name: "three", Count: 3}); err != nil {
+		t.Errorf("Save failed: %v", err)
+	}
+	prefixes, _ := s.Prefixes()
+	if p := sorted(prefixes); !reflect.DeepEqual(p, []string{"others", "things"}) {
+		t.Errorf("Unexpected prefixes %v", p)
+	}
+	keys, _ := s.Keys("things")
+	if k := sorted(keys); !reflect.DeepEqual(k, []string{"one", "two"}) {
+		t.Errorf("Unexpected keys %v", k)
+	}
+	if !s.Exists("things", "one") {
+		t.Errorf("Expected things/one to exist")
+	}
+	if s.Exists("things", "three") {
+		t.Errorf("Did not expect things/three to exist")
+	}
+	res := &testObj{}
+	if err := s.Load("things", "two", res); err != nil {
+		t.Errorf("Load failed: %v", err)
+	} else if res.Name != "two" || res.Count != 2 {
+		t.Errorf("Loaded unexpected value %#v", res)
+	}
+	if err := s.Load("things", "three", res); err == nil {
+		t.Errorf("Expected error loading missing key")
+	}
+	if err := s.Remove("things", "one"); err != nil {
+		t.Errorf("Remove failed: %v", err)
+	}
+	if s.Exists("things", "one") {
+		t.Errorf("Expected things/one to be removed")
+	}
+	if err := s.Remove("things", "one"); err == nil {
+		t.Errorf("Expected error removing missing key")
+	}
+	mem, _ := Open("memory://")
+	if err := Copy(mem, s); err != nil {
+		t.Errorf("Copy failed: %v", err)
+	}
+	if !mem.Exists("things", "two") || !mem.Exists("others", "three") || mem.Exists("things", "one") {
+		t.Errorf("Copy did not clone the store")
+	}
+	if md := mem.(MetaSaver).MetaData(); !reflect.DeepEqual(md, meta) {
+		t.Errorf("Copy did not copy metadata: %v", md)
+	}
+	s.SetReadOnly()
+	if _, ok := s.Save("things", "four", &testObj{}).(UnWritable); !ok {
+		t.Errorf("Expected UnWritable saving to a read-only store")
+	}
+	if _, ok := s.Remove("things", "two").(UnWritable); !ok {
+		t.Errorf("Expected UnWritable removing from a read-only store")
+	}
+	s.Close()
+	if !s.Closed() {
+		t.Errorf("Expected store to be closed")
+	}
+}
+
+func TestStoreBehavior(t *testing.T) {
+	locators, cleanup := storeLocators(t)
+	defer cleanup()
+	for name, locator := range locators {
+		t.Run(name, func(t *testing.T) {
+			testStoreBehavior(t, locator)
+		})
+	}
+}
+
+func TestBoltReopen(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	s, err := Open("bolt:" + tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to open bolt store: %v", err)
+	}
+	s.(MetaSaver).SetMetaData(map[string]string{"Name": "persist"})
+	s.Save("things", "one", &testObj{Name: "one", Count: 1})
+	s.Close()
+	s, err = Open("bolt:" + tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen bolt store: %v", err)
+	}
+	defer s.Close()
+	if s.Name() != "persist" {
+		t.Errorf("Expected name persist, got %s", s.Name())
+	}
+	res := &testObj{}
+	if err := s.Load("things", "one", res); err != nil || res.Count != 1 {
+		t.Errorf("Expected to load persisted value, got %#v (%v)", res, err)
+	}
+}
+
+func TestBoltClosed(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	s, err := Open("bolt:" + tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to open bolt store: %v", err)
+	}
+	s.Close()
+	for name, op := range map[string]func(){
+		"Load":   func() { s.Load("things", "one", &testObj{}) },
+		"Save":   func() { s.Save("things", "one", &testObj{}) },
+		"Remove": func() { s.Remove("things", "one") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected %s on a closed store to panic", name)
+				}
+			}()
+			op()
+		}()
+	}
+}
+
+func TestDirectoryTxnRecovery(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	s, err := Open("directory:" + tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to open directory store: %v", err)
+	}
+	s.Save("things", "one", &testObj{Name: "one", Count: 1})
+	d := s.(*Directory)
+	ops := []txnOp{{prefix: "things", key: "one", remove: true}}
+	for _, name := range []string{"two", "three"} {
+		buf, _ := d.Encode(&testObj{Name: name})
+		ops = append(ops, txnOp{prefix: "things", key: name, buf: buf})
+	}
+	// Pretend a commit got as far as writing its journal, and
+	// renamed one of the new values into place before it stopped.
+	committed, _ := ioutil.TempDir(tmpDir, ".txn.")
+	journal, err := d.stage(committed, ops)
+	if err != nil {
+		t.Fatalf("Failed to stage transaction: %v", err)
+	}
+	os.Rename(filepath.Join(committed, journal[1].Staged), filepath.Join(tmpDir, journal[1].Target))
+	// ... and that another one never got that far.
+	uncommitted, _ := ioutil.TempDir(tmpDir, ".txn.")
+	ioutil.WriteFile(filepath.Join(uncommitted, "0"), []byte("{}"), 0644)
+	s.Close()
+	s, err = Open("directory:" + tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen directory store: %v", err)
+	}
+	defer s.Close()
+	if s.Exists("things", "one") || !s.Exists("things", "two") || !s.Exists("things", "three") {
+		t.Errorf("Committed transaction was not finished when reopening")
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(tmpDir, ".txn.*")); len(leftover) != 0 {
+		t.Errorf("Staging directories were left behind: %v", leftover)
+	}
+}
+
+func testStoreTxn(t *testing.T, locator string) {
+	s, err := Open(locator)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", locator, err)
+	}
+	defer s.Close()
+	if _, ok := s.(Transactor); !ok {
+		t.Fatalf("%s is not a Transactor", locator)
+	}
+	s.Save("things", "one", &testObj{Name: "one", Count: 1})
+	txn, _ := Begin(s)
+	txn.Save("things", "two", &testObj{Name: "two", Count: 2})
+	txn.Save("others", "three", &testObj{Name: "three", Count: 3})
+	txn.Remove("things", "one")
+	if s.Exists("things", "two") || !s.Exists("things", "one") {
+		t.Errorf("Transaction changes visible before commit")
+	}
+	if err := txn.Commit(); err != nil {
+		t.Errorf("Commit failed: %v", err)
+	}
+	if !s.Exists("things", "two") || !s.Exists("others", "three") || s.Exists("things", "one") {
+		t.Errorf("Transaction changes not visible after commit")
+	}
+	if err := txn.Save("things", "four", &testObj{}); err != TxnDone {
+		t.Errorf("Expected TxnDone after commit, got %v", err)
+	}
+	txn, _ = Begin(s)
+	txn.Save("things", "four", &testObj{Name: "four", Count: 4})
+	txn.Remove("things", "missing")
+	if err := txn.Commit(); err == nil {
+		t.Errorf("Expected commit removing a missing key to fail")
+	}
+	if s.Exists("things", "four") {
+		t.Errorf("Failed commit left partial state behind")
+	}
+	txn, _ = Begin(s)
+	txn.Save("things", "five", &testObj{Name: "five", Count: 5})
+	txn.Remove("things", "five")
+	txn.Rollback()
+	if err := txn.Commit(); err != TxnDone {
+		t.Errorf("Expected TxnDone after rollback, got %v", err)
+	}
+	if s.Exists("things", "five") {
+		t.Errorf("Rolled back transaction was applied")
+	}
+	s.SetReadOnly()
+	txn, _ = Begin(s)
+	if _, ok := txn.Save("things", "six", &testObj{}).(UnWritable); !ok {
+		t.Errorf("Expected UnWritable saving to a read-only store")
+	}
+}
+
+func TestStoreTxn(t *testing.T) {
+	locators, cleanup := storeLocators(t)
+	defer cleanup()
+	for name, locator := range locators {
+		t.Run(name, func(t *testing.T) {
+			testStoreTxn(t, locator)
+		})
+	}
+}
+
+func waitEvents(t *testing.T, ch <-chan WatchEvent, want ...WatchEvent) {
+	t.Helper()
+	pending := map[WatchEvent]bool{}
+	for _, evt := range want {
+		pending[evt] = true
+	}
+	timeout := time.After(5 * time.Second)
+	for len(pending) > 0 {
+		select {
+		case evt := <-ch:
+			delete(pending, evt)
+		case <-timeout:
+			t.Errorf("Timed out waiting for events %v", pending)
+			return
+		}
+	}
+}
+
+func testStoreWatch(t *testing.T, locator string) {
+	s, err := Open(locator)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", locator, err)
+	}
+	defer s.Close()
+	w, ok := s.(Watcher)
+	if !ok {
+		t.Fatalf("%s is not a Watcher", locator)
+	}
+	handle, ch := w.Watch()
+	s.Save("things", "one", &testObj{Name: "one", Count: 1})
+	waitEvents(t, ch, WatchEvent{"things", "one", WatchSave})
+	s.Remove("things", "one")
+	waitEvents(t, ch, WatchEvent{"things", "one", WatchRemove})
+	txn, _ := Begin(s)
+	txn.Save("things", "two", &testObj{Name: "two", Count: 2})
+	txn.Save("others", "three", &testObj{Name: "three", Count: 3})
+	txn.Commit()
+	waitEvents(t, ch,
+		WatchEvent{"things", "two", WatchSave},
+		WatchEvent{"others", "three", WatchSave})
+	if err := w.Unwatch(handle); err != nil {
+		t.Errorf("Unwatch failed: %v", err)
+	}
+	// Stores watching the filesystem can report a change twice, so
+	// skip anything left in the channel.
+	timeout := time.After(time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-ch:
+		case <-timeout:
+			t.Errorf("Expected channel to be closed after Unwatch")
+			open = false
+		}
+	}
+}
+
+func TestStoreWatch(t *testing.T) {
+	locators, cleanup := storeLocators(t)
+	defer cleanup()
+	for name, locator := range locators {
+		t.Run(name, func(t *testing.T) {
+			testStoreWatch(t, locator)
+		})
+	}
+}
+
+func TestDirectoryWatchExternal(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("External change detection needs inotify")
+	}
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	s, err := Open("directory:" + tmpDir + "?codec=yaml")
+	if err != nil {
+		t.Fatalf("Failed to open directory store: %v", err)
+	}
+	defer s.Close()
+	s.Save("things", "one", &testObj{Name: "one", Count: 1})
+	_, ch := s.(Watcher).Watch()
+	if err := ioutil.WriteFile(path.Join(tmpDir, "things", "one.yaml"), []byte("Name: one\nCount: 5\n"), 0644); err != nil {
+		t.Fatalf("Failed to edit file: %v", err)
+	}
+	waitEvents(t, ch, WatchEvent{"things", "one", WatchSave})
+	os.MkdirAll(path.Join(tmpDir, "others"), 0755)
+	if err := ioutil.WriteFile(path.Join(tmpDir, "others", "two.yaml"), []byte("Name: two\n"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	waitEvents(t, ch, WatchEvent{"others", "two", WatchSave})
+	os.Remove(path.Join(tmpDir, "things", "one.yaml"))
+	waitEvents(t, ch, WatchEvent{"things", "one", WatchRemove})
+}
+
+func TestSealedStore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	keyFile := path.Join(tmpDir, "key")
+	ioutil.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600)
+	os.Setenv("STORE_TEST_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xab}, 32)))
+	defer os.Unsetenv("STORE_TEST_KEY")
+	for name, locator := range map[string]string{
+		"file":      "file:" + path.Join(tmpDir, "file.json") + "?keyfile=" + keyFile,
+		"directory": "directory:" + path.Join(tmpDir, "directory") + "?codec=yaml&keyenv=STORE_TEST_KEY",
+		"bolt":      "bolt:" + path.Join(tmpDir, "bolt") + "?keyfile=" + keyFile,
+	} {
+		t.Run(name, func(t *testing.T) {
+			testStoreBehavior(t, locator)
+			s, err := Open(locator)
+			if err != nil {
+				t.Fatalf("Failed to reopen %s: %v", locator, err)
+			}
+			res := &testObj{}
+			if err := s.Load("things", "two", res); err != nil || res.Count != 2 {
+				t.Errorf("Failed to load sealed data: %#v (%v)", res, err)
+			}
+			s.Close()
+			plain := strings.Split(locator, "?")[0]
+			if name == "directory" {
+				plain += "?codec=yaml"
+			}
+			if ps, err := Open(plain); err == nil {
+				if err := ps.Load("things", "two", res); err == nil {
+					t.Errorf("Loaded sealed data without the key")
+				}
+				ps.Close()
+			}
+		})
+	}
+	if _, err := Open("memory://?keyenv=STORE_TEST_MISSING_KEY"); err == nil {
+		t.Errorf("Expected an error with a missing key")
+	}
+	st := makeStack(t, mks(nil, nil), false)
+	layer, _ := Open("memory://?keyenv=STORE_TEST_KEY")
+	layer.Save("sample", "foo", &testObj{Name: "foo"})
+	if err := st.Push(layer, false, false); err != nil {
+		t.Errorf("Failed to push sealed layer: %v", err)
+	}
+	res := &testObj{}
+	if err := st.Load("sample", "foo", res); err != nil || res.Name != "foo" {
+		t.Errorf("Failed to load through sealed layer: %#v (%v)", res, err)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	type nested struct {
+		Name   string
+		Params map[string]interface{}
+		List   []int
+	}
+	val := &nested{
+		Name:   "test",
+		Params: map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{"c", 1.5}}},
+		List:   []int{1, 2, 3},
+	}
+	for name := range codecs {
+		c, err := CodecByName(name)
+		if err != nil {
+			t.Errorf("No codec for %s: %v", name, err)
+			continue
+		}
+		buf, err := c.Encode(val)
+		if err != nil {
+			t.Errorf("%s: encode failed: %v", name, err)
+			continue
+		}
+		res := &nested{}
+		if err := c.Decode(buf, res); err != nil {
+			t.Errorf("%s: decode failed: %v", name, err)
+		} else if !reflect.DeepEqual(val, res) {
+			t.Errorf("%s: expected %#v, got %#v", name, val, res)
+		}
+		found, foundName, err := CodecByExt("bundle" + c.Ext())
+		if err != nil || found != c || foundName != name {
+			t.Errorf("%s: CodecByExt found %s (%v)", name, foundName, err)
+		}
+	}
+	if _, name, _ := CodecByExt("bundle.yml.gz"); name != "yaml.gz" {
+		t.Errorf("Expected .yml.gz to map to yaml.gz, not %s", name)
+	}
+	if _, _, err := CodecByExt("bundle.txt"); err == nil {
+		t.Errorf("Expected an error for an unknown extension")
+	}
+}
+
+func TestGitHistory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	s, err := Open("git:" + tmpDir + "?branch=main&codec=yaml&author=Tester&email=tester@example.com")
+	if err != nil {
+		t.Fatalf("Failed to open git store: %v", err)
+	}
+	defer s.Close()
+	g := s.(*Git)
+	g.SetMetaData(map[string]string{"Name": "history"})
+	g.Save("things", "one", &testObj{Name: "one", Count: 1})
+	g.Save("things", "one", &testObj{Name: "one", Count: 1})
+	g.Save("things", "two", &testObj{Name: "two", Count: 2})
+	txn, _ := g.BeginCommit("Bump one")
+	txn.Save("things", "one", &testObj{Name: "one", Count: 5})
+	txn.Remove("things", "two")
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	hist, err := g.History("things", "one")
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if len(hist) != 2 {
+		t.Fatalf("Expected 2 revisions of things/one, got %#v", hist)
+	}
+	if hist[0].Message != "Bump one" || hist[1].Message != "Save things/one" {
+		t.Errorf("Unexpected commit messages: %#v", hist)
+	}
+	if hist[0].Author != "Tester" || hist[0].Email != "tester@example.com" {
+		t.Errorf("Unexpected author: %#v", hist[0])
+	}
+	if all, _ := g.History("", ""); len(all) != 4 {
+		t.Errorf("Expected 4 commits in total, got %d", len(all))
+	}
+	old, err := g.At(hist[1].Rev)
+	if err != nil {
+		t.Fatalf("At failed: %v", err)
+	}
+	res := &testObj{}
+	if err := old.Load("things", "one", res); err != nil || res.Count != 1 {
+		t.Errorf("Expected old revision of things/one, got %#v (%v)", res, err)
+	}
+	if old.Exists("things", "two") || old.Name() != "history" || !old.ReadOnly() {
+		t.Errorf("Snapshot at %s is wrong", hist[1].Rev)
+	}
+	prev, _ := g.At("HEAD~1")
+	if err := Copy(g, prev); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if err := g.Load("things", "one", res); err != nil || res.Count != 1 {
+		t.Errorf("Expected rolled back things/one, got %#v (%v)", res, err)
+	}
+	if !g.Exists("things", "two") {
+		t.Errorf("Expected things/two to be restored")
+	}
+	if _, err := g.At("no-such-rev"); err == nil {
+		t.Errorf("Expected an error for an unknown revision")
+	}
+}
+
+func TestRemoteStore(t *testing.T) {
+	served, _ := Open("memory://")
+	served.(MetaSaver).SetMetaData(map[string]string{"Name": "shared"})
+	served.Save("a/b", "c/d", &testObj{Name: "slashes", Count: 1})
+	served.Save("things", "one", &testObj{Name: "one", Count: 1})
+	srv := httptest.NewServer(Serve(served))
+	defer srv.Close()
+	s, err := Open(srv.URL + "?ro=true")
+	if err != nil {
+		t.Fatalf("Failed to open remote store: %v", err)
+	}
+	defer s.Close()
+	res := &testObj{}
+	if err := s.Load("a/b", "c/d", res); err != nil || res.Name != "slashes" {
+		t.Errorf("Failed to load escaped key: %#v (%v)", res, err)
+	}
+	if err := s.Load("things", "two", res); !os.IsNotExist(err) {
+		t.Errorf("Expected os.ErrNotExist for a missing key, got %v", err)
+	}
+	if _, ok := s.Save("things", "two", &testObj{}).(UnWritable); !ok {
+		t.Errorf("Expected UnWritable saving to a read-only remote store")
+	}
+	served.SetReadOnly()
+	rw, err := Open(srv.URL)
+	if err != nil {
+		t.Fatalf("Failed to open remote store: %v", err)
+	}
+	defer rw.Close()
+	if !rw.ReadOnly() || rw.Name() != "shared" {
+		t.Errorf("Expected remote store to pick up the served name and read-only state")
+	}
+	if _, err := rw.(*Remote).do("DELETE", rw.(*Remote).itemPath("things", "one"), "one", nil); err != UnWritable("one") {
+		t.Errorf("Expected the server to refuse writes with UnWritable, got %v", err)
+	}
+	local, _ := Open("memory://")
+	st := makeStack(t, mks(local, s), false)
+	if err := st.Save("things", "two", &testObj{Name: "two", Count: 2}); err != nil {
+		t.Errorf("Failed to save to the local layer: %v", err)
+	}
+	if err := st.Load("things", "one", res); err != nil || res.Count != 1 {
+		t.Errorf("Failed to load from the remote layer: %#v (%v)", res, err)
+	}
+	if _, err := Open("http://127.0.0.1:1/nothing"); err == nil {
+		t.Errorf("Expected an error talking to a missing server")
+	}
+	for _, param := range []string{"codec=yaml", "keyfile=/nothing", "keyenv=NOTHING"} {
+		if _, err := Open(srv.URL + "?" + param); err == nil {
+			t.Errorf("Expected %s to be refused for a remote store", param)
+		}
+	}
+	if err := (&Remote{URL: srv.URL}).Open(YamlCodec); err == nil {
+		t.Errorf("Expected a remote store to refuse a YAML codec")
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, locator := range []string{
+		"file:" + path.Join(tmpDir, "file.json"),
+		"directory:" + path.Join(tmpDir, "directory"),
+	} {
+		s1, err := Open(locator + "?lock=true")
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", locator, err)
+		}
+		s2, err := Open(locator + "?lock=true&locktimeout=200ms")
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", locator, err)
+		}
+		// Neither store should lose what the other wrote.
+		s1.Save("things", "one", &testObj{Name: "one", Count: 1})
+		s2.Save("things", "two", &testObj{Name: "two", Count: 2})
+		s1.Save("things", "three", &testObj{Name: "three", Count: 3})
+		for _, s := range []Store{s1, s2} {
+			keys, _ := s.Keys("things")
+			if k := sorted(keys); !reflect.DeepEqual(k, []string{"one", "three", "two"}) {
+				t.Errorf("%s: unexpected keys %v", locator, k)
+			}
+		}
+		// Pretend another process is holding the lock.
+		lockPath := strings.TrimPrefix(strings.TrimPrefix(locator, "file:"), "directory:") + ".lock"
+		other, err := newFileLock(lockPath, 0)
+		if err != nil {
+			t.Fatalf("Failed to open lock file: %v", err)
+		}
+		if err := other.lock(); err != nil {
+			t.Fatalf("Failed to take lock: %v", err)
+		}
+		err = s2.Save("things", "four", &testObj{})
+		if le, ok := err.(*LockError); !ok || le.Pid != os.Getpid() || le.Stale {
+			t.Errorf("%s: expected a LockError naming this process, got %v", locator, err)
+		}
+		if err := s2.Load("things", "one", &testObj{}); err == nil {
+			t.Errorf("%s: expected Load to wait for the writer", locator)
+		}
+		host, _ := os.Hostname()
+		other.fd.Truncate(0)
+		other.fd.WriteAt([]byte(fmt.Sprintf("%d %s %s\n", 1<<22+1, host, time.Now().Format(time.RFC3339))), 0)
+		err = s2.Save("things", "four", &testObj{})
+		if le, ok := err.(*LockError); !ok || !le.Stale || !strings.Contains(le.Error(), "stale") {
+			t.Errorf("%s: expected a stale LockError, got %v", locator, err)
+		}
+		other.unlock()
+		other.close()
+		if err := s2.Save("things", "four", &testObj{}); err != nil {
+			t.Errorf("%s: Save failed after the lock was released: %v", locator, err)
+		}
+		s1.Close()
+		s2.Close()
+	}
+	if _, err := Open("file:" + path.Join(tmpDir, "x.json") + "?locktimeout=soon"); err == nil {
+		t.Errorf("Expected an error for a bad locktimeout")
+	}
+}
+
+func TestArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	src, _ := Open("memory://")
+	src.(MetaSaver).SetMetaData(map[string]string{"Name": "bundle", "Version": "1.0"})
+	src.Save("things", "one", &testObj{Name: "one", Count: 1})
+	src.Save("things", "a/b", &testObj{Name: "a/b", Count: 2})
+	for _, ext := range []string{"tar", "tar.gz", "tgz", "zip"} {
+		name := path.Join(tmpDir, "bundle."+ext)
+		dst, err := Open("archive:" + name + "?write=true&codec=yaml")
+		if err != nil {
+			t.Fatalf("Failed to open %s for writing: %v", name, err)
+		}
+		if err := Copy(dst, src); err != nil {
+			t.Errorf("Failed to copy into %s: %v", name, err)
+		}
+		dst.Close()
+		s, err := Open("archive:" + name)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", name, err)
+		}
+		res := &testObj{}
+		if err := s.Load("things", "a/b", res); err != nil || res.Count != 2 {
+			t.Errorf("%s: failed to load things/a/b: %#v (%v)", ext, res, err)
+		}
+		if s.Name() != "bundle" || s.(MetaSaver).MetaData()["Version"] != "1.0" {
+			t.Errorf("%s: metadata not read back", ext)
+		}
+		if _, ok := s.Save("things", "two", &testObj{}).(UnWritable); !ok {
+			t.Errorf("%s: expected archive to be read-only", ext)
+		}
+		s.Close()
+	}
+	// Archives made by hand may have everything inside one directory,
+	// and may mix codecs.
+	buf := &bytes.Buffer{}
+	files := map[string][]byte{
+		"bundle/._Name.meta":     []byte("wrapped\n"),
+		"bundle/things/one.yaml": []byte("Name: one\nCount: 1\n"),
+		"bundle/things/two.json": []byte(`{"Name":"two","Count":2}`),
+		"bundle/README.md":       []byte("Not part of the store"),
+	}
+	names := []string{"bundle/._Name.meta", "bundle/README.md", "bundle/things/one.yaml", "bundle/things/two.json"}
+	if err := writeArchive(buf, "zip", names, files); err != nil {
+		t.Fatalf("Failed to write zip: %v", err)
+	}
+	name := path.Join(tmpDir, "wrapped.zip")
+	ioutil.WriteFile(name, buf.Bytes(), 0644)
+	s, err := Open("archive:" + name)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", name, err)
+	}
+	defer s.Close()
+	keys, _ := s.Keys("things")
+	if k := sorted(keys); !reflect.DeepEqual(k, []string{"one", "two"}) || s.Name() != "wrapped" {
+		t.Errorf("Unexpected keys %v in %s", k, s.Name())
+	}
+	res := &testObj{}
+	if err := s.Load("things", "one", res); err != nil || res.Count != 1 {
+		t.Errorf("Failed to load yaml value: %#v (%v)", res, err)
+	}
+	if _, err := Open("archive:" + path.Join(tmpDir, "missing.tgz")); err == nil {
+		t.Errorf("Expected an error opening a missing archive")
+	}
+	if _, err := Open("archive:" + path.Join(tmpDir, "bundle.rar")); err == nil {
+		t.Errorf("Expected an error opening an unknown archive type")
+	}
+}
+
+func TestDiffMerge(t *testing.T) {
+	type obj struct {
+		Name   string
+		Count  int
+		Params map[string]interface{} `json:",omitempty"`
+	}
+	base, _ := Open("memory://")
+	base.Save("things", "same", &obj{Name: "same"})
+	base.Save("things", "theirs", &obj{Name: "theirs"})
+	base.Save("things", "both", &obj{Name: "both", Params: map[string]interface{}{"a": 1}})
+	base.Save("things", "clash", &obj{Name: "clash"})
+	base.Save("things", "gone", &obj{Name: "gone"})
+	base.Save("things", "edited", &obj{Name: "edited"})
+	ours, _ := Open("memory://")
+	theirs, _ := Open("memory://")
+	Copy(ours, base)
+	Copy(theirs, base)
+	ours.Save("things", "both", &obj{Name: "both", Count: 1, Params: map[string]interface{}{"a": 1}})
+	ours.Save("things", "clash", &obj{Name: "clash", Count: 1})
+	ours.Save("things", "edited", &obj{Name: "edited", Count: 1})
+	theirs.Save("things", "theirs", &obj{Name: "theirs", Count: 5})
+	theirs.Save("things", "both", &obj{Name: "both", Params: map[string]interface{}{"a": 1, "b": 2}})
+	theirs.Save("things", "clash", &obj{Name: "clash", Count: 2})
+	theirs.Remove("things", "gone")
+	theirs.Remove("things", "edited")
+	theirs.Save("others", "new", &obj{Name: "new"})
+
+	diff, err := Diff(base, theirs)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(diff) != 2 || !reflect.DeepEqual(diff["others"].Added, []string{"new"}) {
+		t.Errorf("Unexpected diff %#v", diff)
+	}
+	things := diff["things"]
+	if !reflect.DeepEqual(things.Removed, []string{"edited", "gone"}) || len(things.Changed) != 3 {
+		t.Errorf("Unexpected diff for things: %#v", things)
+	}
+	var val interface{}
+	base.Load("things", "theirs", &val)
+	buf, _ := json.Marshal(val)
+	if res, err, _ := things.Changed["theirs"].Apply(buf); err != nil {
+		t.Errorf("Failed to apply patch: %v", err)
+	} else if err := json.Unmarshal(res, &val); err != nil || val.(map[string]interface{})["Count"] != 5.0 {
+		t.Errorf("Patch did not produce the new value: %s", string(res))
+	}
+	if same, _ := Diff(base, base); len(same) != 0 {
+		t.Errorf("Expected no differences between a store and itself, got %#v", same)
+	}
+
+	conflicts, err := Merge(base, ours, theirs)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if len(conflicts) != 2 || conflicts[0].Key != "clash" || conflicts[1].Key != "edited" || conflicts[1].Theirs != nil {
+		t.Errorf("Unexpected conflicts %#v", conflicts)
+	}
+	res := &obj{}
+	if ours.Load("things", "theirs", res); res.Count != 5 {
+		t.Errorf("Expected their change to be merged, got %#v", res)
+	}
+	if ours.Load("things", "both", res); res.Count != 1 || res.Params["b"] != 2.0 {
+		t.Errorf("Expected both changes to be merged, got %#v", res)
+	}
+	if ours.Load("things", "clash", res); res.Count != 1 {
+		t.Errorf("Expected our side of a conflict to be kept, got %#v", res)
+	}
+	if ours.Exists("things", "gone") || !ours.Exists("things", "edited") || !ours.Exists("others", "new") {
+		t.Errorf("Merge did not apply removes and adds properly")
+	}
+}
+
+func TestSync(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	src, _ := Open("memory://")
+	dst, err := Open("directory:" + path.Join(tmpDir, "sync") + "?codec=yaml")
+	if err != nil {
+		t.Fatalf("Failed to open directory store: %v", err)
+	}
+	defer dst.Close()
+	for i := 0; i < 5; i++ {
+		src.Save("things", fmt.Sprintf("thing%d", i), map[string]interface{}{"Count": i})
+	}
+	src.(MetaSaver).SetMetaData(map[string]string{"Name": "sync"})
+	stats, err := Sync(dst, src, SyncOptions{})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if stats.Saved != 5 || stats.Unchanged != 0 || stats.Removed != 0 {
+		t.Errorf("Unexpected first sync stats: %#v", stats)
+	}
+	if dst.Name() != "sync" {
+		t.Errorf("Metadata was not synced, got name %q", dst.Name())
+	}
+	src.Save("things", "thing1", map[string]interface{}{"Count": 10})
+	src.Remove("things", "thing2")
+	dst.Save("things", "extra", map[string]interface{}{"Count": 20})
+	progress := []SyncProgress{}
+	stats, err = Sync(dst, src, SyncOptions{Progress: func(p SyncProgress) { progress = append(progress, p) }})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if stats.Saved != 1 || stats.Unchanged != 3 || stats.Removed != 0 {
+		t.Errorf("Unexpected second sync stats: %#v", stats)
+	}
+	if len(progress) != 4 || progress[3].Done != 4 || progress[3].Total != 4 || progress[1].Op != WatchSave || progress[1].Key != "thing1" {
+		t.Errorf("Unexpected progress: %#v", progress)
+	}
+	if !dst.Exists("things", "extra") || !dst.Exists("things", "thing2") {
+		t.Errorf("Sync without Delete removed keys")
+	}
+	stats, err = Sync(dst, src, SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if stats.Saved != 0 || stats.Unchanged != 4 || stats.Removed != 2 {
+		t.Errorf("Unexpected delete sync stats: %#v", stats)
+	}
+	if dst.Exists("things", "extra") || dst.Exists("things", "thing2") {
+		t.Errorf("Sync with Delete left keys behind")
+	}
+	var val map[string]interface{}
+	if err := dst.Load("things", "thing1", &val); err != nil || fmt.Sprint(val["Count"]) != "10" {
+		t.Errorf("Expected thing1 to have Count 10, got %v (%v)", val, err)
+	}
+}
+
+// countingCodec counts how many values it decodes.
+type countingCodec struct {
+	Codec
+	decodes int
+}
+
+func (c *countingCodec) Decode(buf []byte, val interface{}) error {
+	c.decodes++
+	return c.Codec.Decode(buf, val)
+}
+
+func TestSyncRaw(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "store-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	codec := &countingCodec{Codec: JsonCodec}
+	src := &Memory{}
+	src.Open(codec)
+	dst := &Directory{Path: path.Join(tmpDir, "raw")}
+	if err := dst.Open(codec); err != nil {
+		t.Fatalf("Failed to open directory store: %v", err)
+	}
+	defer dst.Close()
+	for i := 0; i < 5; i++ {
+		src.Save("things", fmt.Sprintf("thing%d", i), map[string]interface{}{"Count": i})
+	}
+	if _, err := Sync(dst, src, SyncOptions{}); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	src.Save("things", "thing1", map[string]interface{}{"Count": 10})
+	codec.decodes = 0
+	stats, err := Sync(dst, src, SyncOptions{})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if stats.Saved != 1 || stats.Unchanged != 4 {
+		t.Errorf("Unexpected sync stats: %#v", stats)
+	}
+	// thing1 is decoded twice to compare it and once more to copy it.
+	if codec.decodes != 3 {
+		t.Errorf("Expected only the changed key to be decoded, got %d decodes", codec.decodes)
+	}
+}
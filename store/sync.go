@@ -0,0 +1,220 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// SyncOptions controls what Sync does.
+type SyncOptions struct {
+	// Delete makes Sync remove keys from dst that are not in src.
+	Delete bool
+	// Progress, if set, is called once for every key Sync looks at.
+	Progress func(SyncProgress)
+}
+
+// SyncProgress reports on one key that Sync looked at.  Op is
+// WatchSave if the key was written to dst, WatchRemove if it was
+// removed from dst, and empty if it was already up to date.  Done
+// counts the keys looked at so far, including this one, out of Total.
+type SyncProgress struct {
+	Prefix string
+	Key    string
+	Op     WatchOp
+	Done   int
+	Total  int
+}
+
+// SyncStats counts what Sync did.
+type SyncStats struct {
+	Saved     int
+	Removed   int
+	Unchanged int
+}
+
+// RawLoader is a Store that can hand back the encoded value of a key
+// without decoding it.
+type RawLoader interface {
+	Store
+	// LoadRaw returns the value of key as it was encoded by the
+	// Store's Codec.
+	LoadRaw(prefix, key string) ([]byte, error)
+}
+
+// sameCodec returns whether a and b are the same Codec.
+func sameCodec(a, b Codec) bool {
+	ta := reflect.TypeOf(a)
+	return ta != nil && ta == reflect.TypeOf(b) && ta.Comparable() && a == b
+}
+
+// hashKey returns a hash of the value of key in s.  Values are hashed
+// as JSON so that Stores using different codecs can be compared.
+func hashKey(s Store, prefix, key string) ([sha256.Size]byte, error) {
+	var val interface{}
+	if err := s.Load(prefix, key, &val); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	buf, err := json.Marshal(val)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(buf), nil
+}
+
+// sameValue returns whether key has the same value in dst and src.
+// If both Stores are RawLoaders using the same Codec, the encoded
+// values are compared first, so unchanged keys do not have to be
+// decoded.  Otherwise, or if the encoded values differ
+// (as they always do for sealed values), the decoded values are
+// compared.
+func sameValue(dst, src Store, prefix, key string) (bool, error) {
+	dr, dok := dst.(RawLoader)
+	sr, sok := src.(RawLoader)
+	if dok && sok && sameCodec(dst.GetCodec(), src.GetCodec()) {
+		dbuf, err := dr.LoadRaw(prefix, key)
+		if err != nil {
+			return false, err
+		}
+		sbuf, err := sr.LoadRaw(prefix, key)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(dbuf, sbuf) {
+			return true, nil
+		}
+	}
+	srcSum, err := hashKey(src, prefix, key)
+	if err != nil {
+		return false, err
+	}
+	dstSum, err := hashKey(dst, prefix, key)
+	if err != nil {
+		return false, err
+	}
+	return srcSum == dstSum, nil
+}
+
+// Sync makes dst hold the same contents as src, like Copy does, but
+// it only writes keys whose values differ, and it can remove keys
+// that are not in src.  Values are compared by hashing them, so the
+// two Stores do not need to use the same codec.  When they do, and
+// both are RawLoaders, the encoded values are compared as they are
+// stored, and only keys whose encoded values differ get decoded.
+//
+// Unlike Copy, Sync does not hold a lock on src the whole time, so
+// changes made to src while Sync is running may or may not make it
+// into dst.  Changes to each prefix are written to dst in their own
+// transaction, so an interrupted Sync keeps the prefixes it finished
+// and the next one picks up from there.
+func Sync(dst, src Store, opts SyncOptions) (SyncStats, error) {
+	stats := SyncStats{}
+	dmeta, dok := dst.(MetaSaver)
+	smeta, sok := src.(MetaSaver)
+	if dok && sok {
+		if meta := smeta.MetaData(); !reflect.DeepEqual(meta, dmeta.MetaData()) {
+			if err := dmeta.SetMetaData(meta); err != nil {
+				return stats, err
+			}
+		}
+	}
+	srcKeys, err := allKeys(src)
+	if err != nil {
+		return stats, err
+	}
+	dstKeys, err := allKeys(dst)
+	if err != nil {
+		return stats, err
+	}
+	total := 0
+	todo := map[string]map[string]bool{}
+	for prefix, keys := range srcKeys {
+		todo[prefix] = map[string]bool{}
+		for key := range keys {
+			todo[prefix][key] = true
+		}
+	}
+	if opts.Delete {
+		for prefix, keys := range dstKeys {
+			if _, ok := todo[prefix]; !ok {
+				todo[prefix] = map[string]bool{}
+			}
+			for key := range keys {
+				todo[prefix][key] = true
+			}
+		}
+	}
+	prefixes := make([]string, 0, len(todo))
+	for prefix := range todo {
+		prefixes = append(prefixes, prefix)
+		total += len(todo[prefix])
+	}
+	sort.Strings(prefixes)
+	done := 0
+	for _, prefix := range prefixes {
+		keys := make([]string, 0, len(todo[prefix]))
+		for key := range todo[prefix] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		txn, err := Begin(dst)
+		if err != nil {
+			return stats, err
+		}
+		ps := SyncStats{}
+		for _, key := range keys {
+			var op WatchOp
+			switch {
+			case !srcKeys[prefix][key]:
+				if err := txn.Remove(prefix, key); err != nil {
+					txn.Rollback()
+					return stats, err
+				}
+				op = WatchRemove
+			case !dstKeys[prefix][key]:
+				op = WatchSave
+			default:
+				same, err := sameValue(dst, src, prefix, key)
+				if err != nil {
+					txn.Rollback()
+					return stats, err
+				}
+				if !same {
+					op = WatchSave
+				}
+			}
+			if op == WatchSave {
+				var val interface{}
+				if err := src.Load(prefix, key, &val); err != nil {
+					txn.Rollback()
+					return stats, err
+				}
+				if err := txn.Save(prefix, key, val); err != nil {
+					txn.Rollback()
+					return stats, err
+				}
+			}
+			switch op {
+			case WatchSave:
+				ps.Saved++
+			case WatchRemove:
+				ps.Removed++
+			default:
+				ps.Unchanged++
+			}
+			done++
+			if opts.Progress != nil {
+				opts.Progress(SyncProgress{Prefix: prefix, Key: key, Op: op, Done: done, Total: total})
+			}
+		}
+		if err := txn.Commit(); err != nil {
+			return stats, err
+		}
+		stats.Saved += ps.Saved
+		stats.Removed += ps.Removed
+		stats.Unchanged += ps.Unchanged
+	}
+	return stats, nil
+}
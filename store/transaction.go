@@ -0,0 +1,183 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// TxnDone is returned when trying to use a transaction that has
+// already been committed or rolled back.
+var TxnDone = errors.New("transaction already committed or rolled back")
+
+// Txn is a batch of pending Save and Remove operations against a
+// Store.  None of the operations are visible in the Store until
+// Commit is called, and either all of them are applied or none of
+// them are.
+type Txn interface {
+	// Save data for a key as part of the transaction.
+	Save(string, string, interface{}) error
+	// Remove a key/value pair as part of the transaction.
+	Remove(string, string) error
+	// Commit applies all the pending operations to the Store.
+	Commit() error
+	// Rollback discards all the pending operations.
+	Rollback() error
+}
+
+// Transactor is a Store that can batch writes into a Txn.
+type Transactor interface {
+	Store
+	// Begin starts a new transaction.
+	Begin() (Txn, error)
+}
+
+// Begin starts a transaction against s.  If s is not a Transactor,
+// the returned Txn writes straight through to s, and Rollback cannot
+// undo anything that has already been written.
+func Begin(s Store) (Txn, error) {
+	if t, ok := s.(Transactor); ok {
+		return t.Begin()
+	}
+	return &directTxn{Store: s}, nil
+}
+
+type directTxn struct {
+	Store
+	done bool
+}
+
+func (d *directTxn) Save(prefix, key string, val interface{}) error {
+	if d.done {
+		return TxnDone
+	}
+	return d.Store.Save(prefix, key, val)
+}
+
+func (d *directTxn) Remove(prefix, key string) error {
+	if d.done {
+		return TxnDone
+	}
+	return d.Store.Remove(prefix, key)
+}
+
+func (d *directTxn) Commit() error {
+	if d.done {
+		return TxnDone
+	}
+	d.done = true
+	return nil
+}
+
+func (d *directTxn) Rollback() error {
+	d.done = true
+	return nil
+}
+
+type txnOp struct {
+	prefix, key string
+	val         interface{}
+	buf         []byte
+	remove      bool
+}
+
+// txn tracks the pending operations for a transaction, and hands
+// them to the commit function of the Store that created it.
+type txn struct {
+	sync.Mutex
+	codec    Codec
+	readOnly func() bool
+	commit   func([]txnOp) error
+	ops      []txnOp
+	done     bool
+}
+
+func (t *txn) Save(prefix, key string, val interface{}) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.done {
+		return TxnDone
+	}
+	if t.readOnly() {
+		return UnWritable(key)
+	}
+	buf, err := t.codec.Encode(val)
+	if err != nil {
+		return err
+	}
+	t.ops = append(t.ops, txnOp{prefix: prefix, key: key, val: val, buf: buf})
+	return nil
+}
+
+func (t *txn) Remove(prefix, key string) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.done {
+		return TxnDone
+	}
+	if t.readOnly() {
+		return UnWritable(key)
+	}
+	t.ops = append(t.ops, txnOp{prefix: prefix, key: key, remove: true})
+	return nil
+}
+
+func (t *txn) Commit() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.done {
+		return TxnDone
+	}
+	t.done = true
+	if len(t.ops) == 0 {
+		return nil
+	}
+	return t.commit(t.ops)
+}
+
+func (t *txn) Rollback() error {
+	t.Lock()
+	defer t.Unlock()
+	t.done = true
+	t.ops = nil
+	return nil
+}
+
+// checkOps makes sure that every Remove in ops refers to a key that
+// will exist at that point in the transaction.  exists reports
+// whether a key is present in the Store before the transaction.
+func checkOps(ops []txnOp, exists func(string, string) bool) error {
+	seen := map[string]map[string]bool{}
+	for _, op := range ops {
+		if _, ok := seen[op.prefix]; !ok {
+			seen[op.prefix] = map[string]bool{}
+		}
+		present, ok := seen[op.prefix][op.key]
+		if !ok {
+			present = exists(op.prefix, op.key)
+		}
+		if op.remove && !present {
+			return os.ErrNotExist
+		}
+		seen[op.prefix][op.key] = !op.remove
+	}
+	return nil
+}
+
+// finalOps collapses ops down to the last operation on each key.
+func finalOps(ops []txnOp) []txnOp {
+	idx := map[string]map[string]int{}
+	res := []txnOp{}
+	for _, op := range ops {
+		if _, ok := idx[op.prefix]; !ok {
+			idx[op.prefix] = map[string]int{}
+		}
+		if i, ok := idx[op.prefix][op.key]; ok {
+			res[i] = op
+			continue
+		}
+		idx[op.prefix][op.key] = len(res)
+		res = append(res, op)
+	}
+	return res
+}
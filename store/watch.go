@@ -0,0 +1,122 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// WatchOp is the kind of change a WatchEvent reports.
+type WatchOp string
+
+const (
+	// WatchSave means that the key was created or updated.
+	WatchSave WatchOp = "save"
+	// WatchRemove means that the key was removed.
+	WatchRemove WatchOp = "remove"
+)
+
+// WatchEvent describes a change to a single key in a Store.
+type WatchEvent struct {
+	Prefix string
+	Key    string
+	Op     WatchOp
+}
+
+// Watcher is a Store that can tell callers about changes made to it.
+type Watcher interface {
+	Store
+	// Watch returns a handle and a channel that WatchEvents will be
+	// sent on.  Events that cannot be delivered because the channel
+	// is full are dropped.
+	Watch() (int64, <-chan WatchEvent)
+	// Unwatch closes the channel associated with handle and stops
+	// sending events to it.
+	Unwatch(int64) error
+}
+
+// watchHub keeps track of everything watching a Store.  It has its
+// own lock, as events are sent while the Store is locked.
+type watchHub struct {
+	sync.Mutex
+	handleId  int64
+	receivers map[int64]chan WatchEvent
+	// started is called the first time something starts watching.
+	started func()
+	running bool
+}
+
+func (w *watchHub) watch() (int64, <-chan WatchEvent) {
+	newID := atomic.AddInt64(&w.handleId, 1)
+	ch := make(chan WatchEvent, 100)
+	w.Lock()
+	if w.receivers == nil {
+		w.receivers = map[int64]chan WatchEvent{}
+	}
+	w.receivers[newID] = ch
+	start := !w.running && w.started != nil
+	w.running = true
+	w.Unlock()
+	if start {
+		w.started()
+	}
+	return newID, ch
+}
+
+func (w *watchHub) unwatch(handle int64) error {
+	w.Lock()
+	defer w.Unlock()
+	ch, ok := w.receivers[handle]
+	if !ok {
+		return fmt.Errorf("No such handle %d", handle)
+	}
+	delete(w.receivers, handle)
+	close(ch)
+	return nil
+}
+
+func (w *watchHub) watching() bool {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.receivers) != 0
+}
+
+func (w *watchHub) notify(prefix, key string, op WatchOp) {
+	w.Lock()
+	defer w.Unlock()
+	evt := WatchEvent{Prefix: prefix, Key: key, Op: op}
+	for _, ch := range w.receivers {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+}
+
+func (w *watchHub) closeAll() {
+	w.Lock()
+	defer w.Unlock()
+	for h, ch := range w.receivers {
+		close(ch)
+		delete(w.receivers, h)
+	}
+	w.running = false
+}
+
+func (s *storeBase) Watch() (int64, <-chan WatchEvent) {
+	return s.watchers.watch()
+}
+
+func (s *storeBase) Unwatch(handle int64) error {
+	return s.watchers.unwatch(handle)
+}
+
+func (s *storeBase) notifyOps(ops []txnOp) {
+	for _, op := range ops {
+		if op.remove {
+			s.watchers.notify(op.prefix, op.key, WatchRemove)
+		} else {
+			s.watchers.notify(op.prefix, op.key, WatchSave)
+		}
+	}
+}